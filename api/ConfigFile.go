@@ -0,0 +1,161 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goproxy/config"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const configPollInterval = time.Second
+
+// Read config.json.  The default config is returned if there is no config.json.
+// Without a config file, the configs last applied are copied.
+func (d *Dashboard) readConfig() ([]*config.ProxyConfig, []byte, error) {
+	if len(d.configFile) == 0 {
+		return d.copyConfigs()
+	}
+	configJson := d.configFile
+	data, err := os.ReadFile(configJson)
+	if os.IsNotExist(err) {
+		return config.Default, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	proxyConfigs, errs := config.ValidateJson(data, d.listen)
+	if len(errs) > 0 {
+		return nil, data, fmt.Errorf("%s:\n%w", configJson, errs)
+	}
+	return proxyConfigs, data, nil
+}
+
+// Re-read config.json and make it the active config of every socket.  The
+// new config is pushed to the browsers.  On error the active config is kept.
+func (d *Dashboard) ReloadConfig() error {
+	d.configFileMutex.Lock()
+	defer d.configFileMutex.Unlock()
+	return d.reloadConfig()
+}
+
+func (d *Dashboard) reloadConfig() error {
+	proxyConfigs, data, err := d.readConfig()
+	d.configFileData = data
+	if err != nil {
+		d.emitConfigError(err)
+		return err
+	}
+	d.applyConfig(proxyConfigs)
+	return nil
+}
+
+// Without a config file, copy the configs last applied the way they would
+// be read from one
+func (d *Dashboard) copyConfigs() ([]*config.ProxyConfig, []byte, error) {
+	d.configsMutex.Lock()
+	proxyConfigs := d.configs
+	d.configsMutex.Unlock()
+	if proxyConfigs == nil {
+		return config.Default, nil, nil
+	}
+	data, err := json.Marshal(config.ProxyConfigJson{Configs: proxyConfigs})
+	if err != nil {
+		return nil, nil, err
+	}
+	var proxyConfigJson config.ProxyConfigJson
+	if err := json.Unmarshal(data, &proxyConfigJson); err != nil {
+		return nil, nil, err
+	}
+	return proxyConfigJson.Configs, nil, nil
+}
+
+func (d *Dashboard) setConfigs(proxyConfigs []*config.ProxyConfig) {
+	d.configsMutex.Lock()
+	defer d.configsMutex.Unlock()
+	d.configs = proxyConfigs
+}
+
+// Poll config.json, and apply it whenever it is edited, until the dashboard
+// is stopped.  Changes made by saveConfig() are not applied again.
+func (d *Dashboard) WatchConfig() {
+	if len(d.configFile) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(configPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+			}
+
+			data, err := os.ReadFile(d.configFile)
+			if err != nil {
+				continue
+			}
+			d.configFileMutex.Lock()
+			if !bytes.Equal(data, d.configFileData) {
+				log.Println("ConfigFile WatchConfig() config.json changed")
+				if err := d.reloadConfig(); err != nil {
+					log.Println("ConfigFile WatchConfig()", err)
+				}
+			}
+			d.configFileMutex.Unlock()
+		}
+	}()
+}
+
+func (d *Dashboard) saveConfig(proxyConfigs []*config.ProxyConfig) {
+	if len(d.configFile) == 0 {
+		return
+	}
+	// Cache the config, to configure the proxy on the next start up prior
+	// to receiving the config from the browser.
+	proxyConfigJson := config.ProxyConfigJson{Configs: proxyConfigs}
+	data, err := json.MarshalIndent(proxyConfigJson, "", "  ")
+	if err != nil {
+		log.Println("ConfigFile saveConfig()", err)
+		return
+	}
+
+	d.configFileMutex.Lock()
+	defer d.configFileMutex.Unlock()
+	// Write a temporary file and rename it, so config.json is never seen half written
+	configJson := d.configFile
+	tmp := filepath.Join(filepath.Dir(configJson), "."+filepath.Base(configJson)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Println("ConfigFile saveConfig()", err)
+		return
+	}
+	if err := os.Rename(tmp, configJson); err != nil {
+		log.Println("ConfigFile saveConfig()", err)
+		return
+	}
+	d.configFileData = data
+}
+
+// Tell the browsers why config.json was not applied
+func (d *Dashboard) emitConfigError(err error) {
+	d.sockets.Range(func(_ interface{}, value interface{}) bool {
+		if socket := value.(*socketIoInfo).socket; socket != nil {
+			socket.Emit("config error", configErrors(err))
+		}
+		return true
+	})
+}
+
+// Validation errors are sent as a list, so the browser can show each one
+// next to its config.
+func configErrors(err error) config.ValidationErrors {
+	var errs config.ValidationErrors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	return config.ValidationErrors{{Index: -1, Message: err.Error()}}
+}
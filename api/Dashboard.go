@@ -0,0 +1,72 @@
+package api
+
+import (
+	"goproxy/config"
+	"sync"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Browsers connected to one goproxy instance, the configs it proxies, and
+// the listeners of the messages it emits.  A process may run any number of
+// dashboards.
+type Dashboard struct {
+	configFile string   // see NewDashboard()
+	listen     []string // see SetListen()
+	sockets    sync.Map // *socketIoInfo, key=socket ID or cacheSocketId
+	server     *socketio.Server
+	events     []socketEvent // see OnEvent()
+
+	configFileMutex sync.Mutex
+	configFileData  []byte // config.json content last loaded, saved or rejected
+
+	configsMutex sync.Mutex
+	configs      []*config.ProxyConfig // last applied
+
+	listenerMutex    sync.Mutex
+	messageListeners []MessageListener
+	historySource    HistorySource
+
+	healthMutex sync.Mutex
+	probes      map[string]*probe // key=probe URL, e.g. "tcp://localhost:8000"
+
+	variantMutex    sync.Mutex
+	variantStatsMap map[string]*variantStats // key=protocol, path, hostname and variant
+
+	stopOnce sync.Once
+	done     chan struct{} // closed by Stop()
+}
+
+// Dashboard whose configs are loaded from and saved to configFile, e.g.
+// paths.ConfigJson().  Without a configFile, the configs are those given to
+// ApplyConfig() or sent by a browser, and are not saved.
+func NewDashboard(configFile string) *Dashboard {
+	return &Dashboard{
+		configFile:      configFile,
+		probes:          make(map[string]*probe),
+		variantStatsMap: make(map[string]*variantStats),
+		done:            make(chan struct{}),
+	}
+}
+
+// Addresses goproxy listens on, which configs are validated against.  Must
+// be called before configs are applied.
+func (d *Dashboard) SetListen(addresses []string) {
+	d.listen = addresses
+}
+
+// Closed when the dashboard is stopped
+func (d *Dashboard) Done() <-chan struct{} {
+	return d.done
+}
+
+// Stop the health checks, variant summaries and config file polling, and
+// close the browser connections.
+func (d *Dashboard) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.done)
+		if d.server != nil {
+			d.server.Close()
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"goproxy/config"
+	"log"
+)
+
+// Enable or disable the fault rule name of the configs with path.  The
+// active configs of every browser are changed and pushed to it, and the
+// change is saved to config.json when the rule is there.  False if no rule
+// matched.
+func (d *Dashboard) ToggleFault(path string, name string, enabled bool) bool {
+	found := false
+	d.sockets.Range(func(_ interface{}, value interface{}) bool {
+		socketInfo := value.(*socketIoInfo)
+		if proxyConfigs, ok := toggleFault(socketInfo.getConfigs(), path, name, enabled); ok {
+			socketInfo.setConfigs(proxyConfigs)
+			if socketInfo.socket != nil {
+				socketInfo.socket.Emit("proxy config", proxyConfigs)
+			}
+			found = true
+		}
+		return true
+	})
+	d.configsMutex.Lock()
+	if proxyConfigs, ok := toggleFault(d.configs, path, name, enabled); ok {
+		d.configs = proxyConfigs
+		found = true
+	}
+	d.configsMutex.Unlock()
+	if !found {
+		log.Printf("Fault ToggleFault() no fault %q for path %s\n", name, path)
+		return false
+	}
+	log.Printf("Fault ToggleFault() %s %q enabled=%v\n", path, name, enabled)
+
+	if len(d.configFile) > 0 {
+		if fileConfigs, _, err := d.readConfig(); err == nil {
+			if proxyConfigs, ok := toggleFault(fileConfigs, path, name, enabled); ok {
+				d.saveConfig(proxyConfigs)
+			}
+		}
+	}
+	return true
+}
+
+// Copy of proxyConfigs with the fault rule toggled.  The configs and rules
+// changed are copied, so requests in flight are not affected.  False if no
+// rule matched.
+func toggleFault(proxyConfigs []*config.ProxyConfig, path string, name string, enabled bool) ([]*config.ProxyConfig, bool) {
+	found := false
+	toggled := make([]*config.ProxyConfig, 0, len(proxyConfigs))
+	for _, proxyConfig := range proxyConfigs {
+		if proxyConfig.Path == path {
+			copied := false
+			for i, rule := range proxyConfig.Faults {
+				if rule.Name != name {
+					continue
+				}
+				if !copied {
+					c := *proxyConfig
+					c.Faults = append([]*config.FaultRule{}, proxyConfig.Faults...)
+					proxyConfig = &c
+					copied = true
+				}
+				r := *rule
+				r.Enabled = enabled
+				proxyConfig.Faults[i] = &r
+				found = true
+			}
+		}
+		toggled = append(toggled, proxyConfig)
+	}
+	return toggled, found
+}
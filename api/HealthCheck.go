@@ -0,0 +1,315 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"goproxy/config"
+	"goproxy/upstream"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	healthCheckTick      = time.Second
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+	checkHistorySize     = 50 // results kept per backend
+)
+
+// Outcome of one probe
+type HealthCheckResult struct {
+	Time      int                    `json:"time"` // milliseconds since the epoch
+	Type      config.HealthCheckType `json:"type"`
+	Address   string                 `json:"address"`
+	Reachable bool                   `json:"reachable"`
+	Latency   float64                `json:"latency"` // milliseconds
+	Status    int                    `json:"status,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+// Emitted as "host reachable" when a config's HostReachable changes
+type HostReachability struct {
+	Protocol  config.ConfigProtocol `json:"protocol"`
+	Path      string                `json:"path"`
+	Hostname  string                `json:"hostname"`
+	Reachable bool                  `json:"reachable"`
+	Results   []*HealthCheckResult  `json:"results"` // latest result of each backend
+}
+
+// Probe of one backend, shared by every config using it
+type probe struct {
+	check   config.HealthCheck
+	scheme  string
+	address string
+	running bool
+	nextRun time.Time
+	history []*HealthCheckResult
+}
+
+var healthClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Probe the backend of every active config until the dashboard is stopped,
+// updating HostReachable and telling the browsers when it changes.
+func (d *Dashboard) StartHealthChecks() {
+	go func() {
+		ticker := time.NewTicker(healthCheckTick)
+		defer ticker.Stop()
+		for {
+			d.runHealthChecks()
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Check history of each backend, key=probe URL
+func (d *Dashboard) HealthHistory() map[string][]*HealthCheckResult {
+	d.healthMutex.Lock()
+	defer d.healthMutex.Unlock()
+	history := make(map[string][]*HealthCheckResult)
+	for key, p := range d.probes {
+		history[key] = append([]*HealthCheckResult(nil), p.history...)
+	}
+	return history
+}
+
+func (d *Dashboard) runHealthChecks() {
+	d.healthMutex.Lock()
+	defer d.healthMutex.Unlock()
+
+	wanted := make(map[string]bool)
+	now := time.Now()
+	d.forEachConfig(func(_ *socketIoInfo, proxyConfig *config.ProxyConfig) {
+		for _, key := range d.probeKeys(proxyConfig) {
+			wanted[key] = true
+		}
+	})
+	for key := range d.probes {
+		if !wanted[key] {
+			delete(d.probes, key)
+		}
+	}
+	for key, p := range d.probes {
+		if !p.running && !now.Before(p.nextRun) {
+			p.running = true
+			go d.runProbe(key, p)
+		}
+	}
+}
+
+// Register the probes of a config, returning their keys.  Browser and log
+// configs have no backend.
+func (d *Dashboard) probeKeys(proxyConfig *config.ProxyConfig) []string {
+	if proxyConfig.Protocol == config.Browser || proxyConfig.Protocol == config.Log {
+		return nil
+	}
+	check := config.HealthCheck{Type: config.TcpCheck}
+	if proxyConfig.HealthCheck != nil {
+		check = *proxyConfig.HealthCheck
+	}
+	if len(check.Type) == 0 {
+		check.Type = config.TcpCheck
+	}
+	if check.Type == config.HttpCheck && len(check.Path) == 0 {
+		check.Path = "/"
+	}
+	scheme := "http"
+	if proxyConfig.IsSecure || proxyConfig.Protocol == config.Https {
+		scheme = "https"
+	}
+
+	hosts := proxyConfig.Targets
+	if len(hosts) == 0 && len(proxyConfig.Hostname) > 0 {
+		hosts = []string{proxyConfig.Hostname}
+	}
+	// Without a port anywhere, the backend is on the default port of its scheme
+	port := proxyConfig.Port
+	if port == 0 {
+		port = 80
+		if scheme == "https" {
+			port = 443
+		}
+	}
+	keys := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		address := upstream.Address(host, port)
+		var key string
+		switch check.Type {
+		case config.HttpCheck:
+			key = scheme + "://" + address + check.Path
+		default:
+			key = string(check.Type) + "://" + address
+		}
+		if _, ok := d.probes[key]; !ok {
+			d.probes[key] = &probe{check: check, scheme: scheme, address: address}
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (d *Dashboard) runProbe(key string, p *probe) {
+	result := p.run()
+	if !result.Reachable {
+		log.Printf("HealthCheck runProbe() %s: %s\n", key, result.Error)
+	}
+
+	d.healthMutex.Lock()
+	defer d.healthMutex.Unlock()
+	interval := defaultCheckInterval
+	if p.check.Interval > 0 {
+		interval = time.Duration(p.check.Interval) * time.Second
+	}
+	p.running = false
+	p.nextRun = time.Now().Add(interval)
+	p.history = append(p.history, result)
+	if len(p.history) > checkHistorySize {
+		p.history = p.history[len(p.history)-checkHistorySize:]
+	}
+	d.updateHostReachable()
+}
+
+func (p *probe) run() *HealthCheckResult {
+	timeout := defaultCheckTimeout
+	if p.check.Timeout > 0 {
+		timeout = time.Duration(p.check.Timeout) * time.Second
+	}
+	start := time.Now()
+	result := &HealthCheckResult{
+		Time:    int(start.UnixNano() / int64(time.Millisecond)),
+		Type:    p.check.Type,
+		Address: p.address,
+	}
+
+	var err error
+	switch p.check.Type {
+	case config.HttpCheck:
+		result.Status, err = p.httpCheck(timeout)
+	case config.TlsCheck:
+		err = p.tlsCheck(timeout)
+	default:
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", p.address, timeout); err == nil {
+			conn.Close()
+		}
+	}
+	result.Latency = float64(time.Since(start).Microseconds()) / 1000
+	result.Reachable = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (p *probe) httpCheck(timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.scheme+"://"+p.address+p.check.Path, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := healthClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if p.check.ExpectStatus != 0 && res.StatusCode != p.check.ExpectStatus {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if p.check.ExpectStatus == 0 && res.StatusCode >= 500 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+func (p *probe) tlsCheck(timeout time.Duration) error {
+	host, _, err := net.SplitHostPort(p.address)
+	if err != nil {
+		host = p.address
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", p.address, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Set HostReachable from the latest results: a config is reachable when
+// any of its backends is.  A config that changes is replaced by a copy, as
+// requests in flight read the configs.  Changes are emitted to the
+// config's socket.  Called with healthMutex held.
+func (d *Dashboard) updateHostReachable() {
+	d.sockets.Range(func(_ interface{}, value interface{}) bool {
+		socketInfo := value.(*socketIoInfo)
+		proxyConfigs := socketInfo.getConfigs()
+		var updated []*config.ProxyConfig // copy of proxyConfigs, once a config changed
+		for i, proxyConfig := range proxyConfigs {
+			if reachable, changed := d.hostReachable(socketInfo, proxyConfig); changed {
+				if updated == nil {
+					updated = append([]*config.ProxyConfig{}, proxyConfigs...)
+				}
+				c := *proxyConfig
+				c.HostReachable = reachable
+				updated[i] = &c
+			}
+		}
+		if updated != nil {
+			socketInfo.setConfigs(updated)
+		}
+		return true
+	})
+}
+
+// Reachability of a config's backends, and whether it differs from
+// HostReachable, in which case the change is emitted
+func (d *Dashboard) hostReachable(socketInfo *socketIoInfo, proxyConfig *config.ProxyConfig) (reachable bool, changed bool) {
+	keys := d.probeKeys(proxyConfig)
+	if len(keys) == 0 {
+		return false, false
+	}
+	results := make([]*HealthCheckResult, 0, len(keys))
+	for _, key := range keys {
+		if history := d.probes[key].history; len(history) > 0 {
+			result := history[len(history)-1]
+			results = append(results, result)
+			reachable = reachable || result.Reachable
+		}
+	}
+	if len(results) == 0 || reachable == proxyConfig.HostReachable {
+		return reachable, false
+	}
+	log.Printf("HealthCheck updateHostReachable() %s%s %s reachable=%v\n",
+		proxyConfig.Protocol, proxyConfig.Path, proxyConfig.Hostname, reachable)
+	if socketInfo.socket != nil {
+		socketInfo.socket.Emit("host reachable", &HostReachability{
+			Protocol:  proxyConfig.Protocol,
+			Path:      proxyConfig.Path,
+			Hostname:  proxyConfig.Hostname,
+			Reachable: reachable,
+			Results:   results,
+		})
+	}
+	return reachable, true
+}
+
+func (d *Dashboard) forEachConfig(f func(*socketIoInfo, *config.ProxyConfig)) {
+	d.sockets.Range(func(_ interface{}, value interface{}) bool {
+		socketInfo := value.(*socketIoInfo)
+		for _, proxyConfig := range socketInfo.getConfigs() {
+			f(socketInfo, proxyConfig)
+		}
+		return true
+	})
+}
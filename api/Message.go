@@ -27,7 +27,7 @@ const (
 
 type Message struct {
 	Type            MessageType         `json:"type"`
-	Timestamp       int                 `json:"timestamp"`
+	Timestamp       int                 `json:"timestamp"` // milliseconds since the epoch
 	SequenceNumber  int                 `json:"sequenceNumber"`
 	RequestHeaders  map[string]string   `json:"requestHeaders"`
 	ResponseHeaders map[string]string   `json:"responseHeaders"`
@@ -40,7 +40,51 @@ type Message struct {
 	ClientIp        string              `json:"clientIp"`
 	ServerHost      string              `json:"serverHost"`
 	Path            string              `json:"path"`
-	ElapsedTime     int                 `json:"elapsedTime"`
+	ElapsedTime     int                 `json:"elapsedTime"` // milliseconds
 	Status          int                 `json:"status"`
 	ProxyConfig     *config.ProxyConfig `json:"proxyConfig"`
+	Timing          *Timing             `json:"timing,omitempty"`
+	Error           *MessageError       `json:"error,omitempty"`
+	Backend         string              `json:"backend,omitempty"`  // upstream "host:port" of a load balanced config
+	Variant         string              `json:"variant,omitempty"`  // split variant that served the request
+	Shaping         []string            `json:"shaping,omitempty"`  // simulated network conditions applied
+	Fault           *InjectedFault      `json:"fault,omitempty"`    // set when goproxy injected a fault
+	Rewrites        []string            `json:"rewrites,omitempty"` // names of the rewrite rules applied
+	Imported        string              `json:"imported,omitempty"` // HAR file the message was imported from
+	Cassette        string              `json:"cassette,omitempty"` // VCR cassette the response was recorded to or played back from
+}
+
+// Fault injection rule applied to the exchange
+type InjectedFault struct {
+	Name string           `json:"name"`
+	Type config.FaultType `json:"type"`
+}
+
+type ErrorKind string
+
+const (
+	DnsError          ErrorKind = "dns"
+	ConnectionRefused ErrorKind = "connectionRefused"
+	ConnectionReset   ErrorKind = "connectionReset"
+	CassetteMiss      ErrorKind = "cassetteMiss" // no recorded response in VCR playback
+	TlsError          ErrorKind = "tls"
+	Timeout           ErrorKind = "timeout"
+	Canceled          ErrorKind = "canceled"
+	OtherError        ErrorKind = "error"
+)
+
+// Why goproxy could not get a response from upstream
+type MessageError struct {
+	Kind    ErrorKind `json:"kind"`
+	Message string    `json:"message"`
+}
+
+// Upstream latency breakdown in milliseconds
+type Timing struct {
+	DnsLookup       float64 `json:"dnsLookup"`
+	TcpConnect      float64 `json:"tcpConnect"`
+	TlsHandshake    float64 `json:"tlsHandshake"`
+	RequestWrite    float64 `json:"requestWrite"`
+	TimeToFirstByte float64 `json:"timeToFirstByte"`
+	Total           float64 `json:"total"`
 }
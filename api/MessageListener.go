@@ -0,0 +1,42 @@
+package api
+
+// Called with every message emitted, before it is sent to the browsers,
+// unless recording is turned off for its config.  The raw request and
+// response bodies are nil when unknown.
+type MessageListener func(message *Message, requestBody []byte, responseBody []byte)
+
+// Returns up to limit stored messages with sequence numbers below before
+// (0 for the latest), oldest first
+type HistorySource func(before int, limit int) []*Message
+
+func (d *Dashboard) AddMessageListener(listener MessageListener) {
+	d.listenerMutex.Lock()
+	defer d.listenerMutex.Unlock()
+	d.messageListeners = append(d.messageListeners, listener)
+}
+
+// Where the "history" socket event loads messages from
+func (d *Dashboard) SetHistorySource(source HistorySource) {
+	d.listenerMutex.Lock()
+	defer d.listenerMutex.Unlock()
+	d.historySource = source
+}
+
+func (d *Dashboard) notifyMessageListeners(message *Message, requestBody []byte, responseBody []byte) {
+	d.listenerMutex.Lock()
+	listeners := d.messageListeners
+	d.listenerMutex.Unlock()
+	for _, listener := range listeners {
+		listener(message, requestBody, responseBody)
+	}
+}
+
+func (d *Dashboard) history(before int, limit int) []*Message {
+	d.listenerMutex.Lock()
+	source := d.historySource
+	d.listenerMutex.Unlock()
+	if source == nil {
+		return []*Message{}
+	}
+	return source(before, limit)
+}
@@ -0,0 +1,42 @@
+package api
+
+import "goproxy/config"
+
+type DifferenceKind string
+
+const (
+	StatusDifference DifferenceKind = "status"
+	HeaderDifference DifferenceKind = "header"
+	BodyDifference   DifferenceKind = "body"
+)
+
+// One mismatch between the primary and shadow responses.  Path is the
+// header name, or the JSON path for body differences.  A missing value is
+// null.
+type Difference struct {
+	Kind    DifferenceKind `json:"kind"`
+	Path    string         `json:"path,omitempty"`
+	Primary interface{}    `json:"primary"`
+	Shadow  interface{}    `json:"shadow"`
+}
+
+// Emitted as "shadow diff" when the shadow response differs from the
+// primary response, or the shadow request failed.
+type ShadowDiff struct {
+	SequenceNumber int           `json:"sequenceNumber"` // of the primary message
+	Timestamp      int           `json:"timestamp"`      // milliseconds since the epoch
+	Method         string        `json:"method"`
+	Url            string        `json:"url"`
+	Endpoint       string        `json:"endpoint"`
+	Shadow         string        `json:"shadow"` // shadow "host:port"
+	PrimaryStatus  int           `json:"primaryStatus"`
+	ShadowStatus   int           `json:"shadowStatus"`
+	PrimaryElapsed int           `json:"primaryElapsed"` // milliseconds
+	ShadowElapsed  int           `json:"shadowElapsed"`  // milliseconds
+	Differences    []*Difference `json:"differences"`
+	Error          *MessageError `json:"error,omitempty"` // shadow request failed
+}
+
+func (d *Dashboard) EmitShadowDiff(diff *ShadowDiff, proxyConfig *config.ProxyConfig) {
+	d.emitToConfigSockets("shadow diff", diff, proxyConfig)
+}
@@ -1,13 +1,11 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"goproxy/config"
-	"goproxy/paths"
 	"log"
-	"net/http"
-	"os"
-	"sync"
+	"time"
 
 	socketio "github.com/googollee/go-socket.io"
 )
@@ -17,20 +15,39 @@ var cacheSocketId = "cache"
 var windowSize = 500 // windows size - maximum outstanding messages
 var maxOut = 2       // two message batches
 
-func Start() *socketio.Server {
+type socketEvent struct {
+	event   string
+	handler interface{}
+}
+
+// Handle a socket.io event in a package that api cannot import, e.g. har.
+// Must be called before Start().
+func (d *Dashboard) OnEvent(event string, handler interface{}) {
+	d.events = append(d.events, socketEvent{event, handler})
+}
+
+// Socket.io server of the dashboard, which the caller routes "/socket.io/"
+// requests to
+func (d *Dashboard) Start() *socketio.Server {
 	server := socketio.NewServer(nil)
+	d.server = server
 
 	server.OnConnect("/", func(s socketio.Conn) error {
 		// log.Println("SocketIo OnConnect() connected:", s.ID())
 		s.SetContext("")
-		proxyConfig := GetConfig()
+		proxyConfig := d.GetConfig()
 		s.Emit("proxy config", proxyConfig) // send config to browser
 		return nil
 	})
 
 	server.OnEvent("/", "proxy config", func(s socketio.Conn, proxyConfigs []*config.ProxyConfig) {
 		// log.Printf("SocketIo OnEvent \"proxy config\"\n%s\n", FmtConfig(proxyConfigs))
-		saveConfig(proxyConfigs)
+		if errs := config.Validate(proxyConfigs, d.listen); len(errs) > 0 {
+			log.Printf("SocketIo OnEvent \"proxy config\" rejected\n%v\n", errs)
+			s.Emit("config error", errs)
+			return
+		}
+		d.saveConfig(proxyConfigs)
 
 		// Make sure all matching connection based servers are closed.
 		for i := range proxyConfigs {
@@ -38,7 +55,7 @@ func Start() *socketio.Server {
 				closeAnyServerWithPort(proxyConfigs[i].Port)
 			}
 		}
-		activateConfig(proxyConfigs, s)
+		d.activateConfig(proxyConfigs, s)
 	})
 
 	server.OnEvent("/", "resend", func(
@@ -52,6 +69,27 @@ func Start() *socketio.Server {
 		// resend(forwardProxy, method, url, message, body);
 	})
 
+	server.OnEvent("/", "health history", func(s socketio.Conn) {
+		s.Emit("health history", d.HealthHistory())
+	})
+
+	server.OnEvent("/", "history", func(s socketio.Conn, before int, limit int) {
+		messagesBytes, err := json.Marshal(d.history(before, limit))
+		if err != nil {
+			log.Println("SocketIo OnEvent \"history\"", err)
+			return
+		}
+		s.Emit("history", string(messagesBytes))
+	})
+
+	server.OnEvent("/", "fault toggle", func(s socketio.Conn, path string, name string, enabled bool) {
+		d.ToggleFault(path, name, enabled)
+	})
+
+	for _, e := range d.events {
+		server.OnEvent("/", e.event, e.handler)
+	}
+
 	server.OnError("/", func(s socketio.Conn, e error) {
 		// log.Println("SocketIo OnError() meet error:", e)
 	})
@@ -59,61 +97,88 @@ func Start() *socketio.Server {
 	server.OnDisconnect("/", func(socket socketio.Conn, reason string) {
 		// log.Println("SocketIo OnDisconnect()", reason)
 		closeAnyServersWithSocket(socket.ID())
-		socketIoMapDelete(socket.ID())
+		d.sockets.Delete(socket.ID())
 	})
 
 	go server.Serve()
-	http.Handle("/socket.io/", server)
 	return server
 }
 
-func GetConfig() []*config.ProxyConfig {
-	configJson := paths.ConfigJson()
-	if data, err := os.ReadFile(configJson); err == nil {
-		var proxyConfigJson config.ProxyConfigJson
-		if err := json.Unmarshal(data, &proxyConfigJson); err != nil {
-			log.Panicln(err)
-		}
-		return proxyConfigJson.Configs
-	} else {
+// The configs, decoded afresh so they can be changed without affecting
+// requests in flight
+func (d *Dashboard) GetConfig() []*config.ProxyConfig {
+	proxyConfigs, _, err := d.readConfig()
+	if err != nil {
+		log.Println("SocketIo GetConfig()", err)
 		return config.Default
 	}
+	return proxyConfigs
 }
 
-func FmtConfig(proxyConfigJson []*config.ProxyConfig) string {
-	str, err := json.MarshalIndent(proxyConfigJson, "", "  ")
-	if err != nil {
-		log.Panicln(err)
+// Validate proxyConfigs and make them the active config, without saving
+// them to config.json, e.g. when goproxy is embedded in tests
+func (d *Dashboard) ApplyConfig(proxyConfigs []*config.ProxyConfig) error {
+	if errs := config.Validate(proxyConfigs, d.listen); len(errs) > 0 {
+		return errs
+	}
+	d.applyConfig(proxyConfigs)
+	return nil
+}
+
+func (d *Dashboard) applyConfig(proxyConfigs []*config.ProxyConfig) {
+	d.setConfigs(proxyConfigs)
+	active := false
+	d.sockets.Range(func(_ interface{}, value interface{}) bool {
+		socketInfo := value.(*socketIoInfo)
+		socketInfo.setConfigs(proxyConfigs)
+		if socketInfo.socket != nil {
+			socketInfo.socket.Emit("proxy config", proxyConfigs)
+		}
+		active = true
+		return true
+	})
+	if !active {
+		d.activateConfig(proxyConfigs, nil)
 	}
-	return string(str)
 }
 
-func UpdateHostReachable() {
-	var wg sync.WaitGroup
-	proxyConfigs := GetConfig()
-	for i := range proxyConfigs {
-		if proxyConfigs[i].Protocol == config.Browser || proxyConfigs[i].Protocol == config.Log {
-			proxyConfigs[i].HostReachable = true
-		} else {
-			wg.Add(1)
-			SetHostReachable(proxyConfigs[i], wg)
+// Wait until the messages queued for each browser have been sent and
+// acknowledged, or ctx is done.
+func (d *Dashboard) Flush(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pending := 0
+		d.sockets.Range(func(_ interface{}, value interface{}) bool {
+			socketInfo := value.(*socketIoInfo)
+			if socketInfo.socket != nil {
+				socketInfo.messagesMutex.Lock()
+				pending += len(socketInfo.queuedMessages) + socketInfo.messagesOut
+				socketInfo.messagesMutex.Unlock()
+			}
+			return true
+		})
+		if pending == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("SocketIo Flush() messages not sent:", pending)
+			return
+		case <-ticker.C:
 		}
 	}
-	wg.Wait()
 }
 
-func saveConfig(proxyConfigs []*config.ProxyConfig) {
-	// Cache the config, to configure the proxy on the next start up prior
-	// to receiving the config from the browser.
-	proxyConfigJson := config.ProxyConfigJson{Configs: proxyConfigs}
-	if data, err := json.MarshalIndent(proxyConfigJson, "", "  "); err == nil {
-		os.WriteFile(paths.ConfigJson(), data, 0644)
-	} else {
+func FmtConfig(proxyConfigJson []*config.ProxyConfig) string {
+	str, err := json.MarshalIndent(proxyConfigJson, "", "  ")
+	if err != nil {
 		log.Panicln(err)
 	}
+	return string(str)
 }
 
-func activateConfig(proxyConfigs []*config.ProxyConfig, socket socketio.Conn) {
+func (d *Dashboard) activateConfig(proxyConfigs []*config.ProxyConfig, socket socketio.Conn) {
 	// for _, proxyConfig := range proxyConfigs {
 	// if proxyConfig.protocol == config.Log {
 	// 	new LogProxy(proxyConfig);
@@ -133,7 +198,8 @@ func activateConfig(proxyConfigs []*config.ProxyConfig, socket socketio.Conn) {
 	if socket != nil {
 		key = socket.ID()
 	}
-	socketIoMapAdd(
+	d.setConfigs(proxyConfigs)
+	d.sockets.Store(
 		key,
 		&socketIoInfo{
 			socket:          socket,
@@ -143,7 +209,7 @@ func activateConfig(proxyConfigs []*config.ProxyConfig, socket socketio.Conn) {
 	)
 	if socket != nil {
 		closeAnyServersWithSocket(cacheSocketId)
-		socketIoMapDelete(cacheSocketId)
+		d.sockets.Delete(cacheSocketId)
 	}
 }
 
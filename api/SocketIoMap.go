@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"goproxy/config"
 	"log"
-	"net/url"
+	"net/http"
 	"regexp"
 	"strings"
 	"sync"
@@ -14,28 +14,36 @@ import (
 
 type socketIoInfo struct {
 	socket          socketio.Conn
-	configs         []*config.ProxyConfig
+	configsMutex    sync.Mutex
+	configs         []*config.ProxyConfig // use getConfigs() and setConfigs()
+	messagesMutex   sync.Mutex            // guards the flow control fields below
 	seqNum          int
 	remainingWindow int
 	messagesOut     int
 	queuedMessages  []*Message
 }
 
-var socketIoMap = sync.Map{}
-
-func socketIoMapAdd(key string, socketInfo *socketIoInfo) {
-	socketIoMap.Store(key, socketInfo)
+func (socketInfo *socketIoInfo) getConfigs() []*config.ProxyConfig {
+	socketInfo.configsMutex.Lock()
+	defer socketInfo.configsMutex.Unlock()
+	return socketInfo.configs
 }
 
-func socketIoMapDelete(key string) {
-	socketIoMap.Delete(key)
+// Replace the active configs.  The slice is swapped as a whole, so requests
+// in flight keep using the configs they matched.
+func (socketInfo *socketIoInfo) setConfigs(proxyConfigs []*config.ProxyConfig) {
+	socketInfo.configsMutex.Lock()
+	defer socketInfo.configsMutex.Unlock()
+	socketInfo.configs = proxyConfigs
 }
 
 func isMatch(needle string, haystack string) bool {
-	if strings.Contains(haystack, ".*") {
+	if strings.Contains(needle, ".*") {
 		b, err := regexp.MatchString(needle, haystack)
 		if err != nil {
-			log.Fatalln(err)
+			// Rejected by config.Validate(), so only reached by an unvalidated config
+			log.Println("SocketIoMap isMatch()", err)
+			return false
 		}
 		return b
 	} else {
@@ -44,34 +52,45 @@ func isMatch(needle string, haystack string) bool {
 }
 
 /**
- * Find proxy config matching URL
- * @params isSecure
+ * Find the proxy config matching a request.  The config's Path must match
+ * the URL path (or client host name + path), and its Match conditions must
+ * hold.  The highest Priority wins, then the longest Path, then a config
+ * with Match conditions over one without.
+ * @params scheme - scheme used by the client
  * @params clientHostName
- * @param {*} reqUrl
+ * @param request
  * @param isForwardProxy
  * @returns ProxyConfig
  */
-func FindProxyConfigMatchingURL(
-	isSecure bool,
+func (d *Dashboard) FindProxyConfigMatchingRequest(
+	scheme string,
 	clientHostName string,
-	reqUrl *url.URL,
+	request *http.Request,
 	isForwardProxy bool,
 ) *config.ProxyConfig {
-	reqUrlPath := strings.ReplaceAll(reqUrl.Path, "//", "/")
+	reqUrlPath := strings.ReplaceAll(request.URL.Path, "//", "/")
 	var matchingProxyConfig *config.ProxyConfig
 
 	// Find matching proxy configuration
-	socketIoMap.Range(func(_ interface{}, value interface{}) bool {
-		for _, proxyConfig := range value.(*socketIoInfo).configs {
-			if proxyConfig.Protocol != config.Http && proxyConfig.Protocol != config.Browser {
+	d.sockets.Range(func(_ interface{}, value interface{}) bool {
+		for _, proxyConfig := range value.(*socketIoInfo).getConfigs() {
+			switch proxyConfig.Protocol {
+			case config.Http, config.Https, config.Browser:
+			default:
 				continue
 			}
-			if (isMatch(proxyConfig.Path, reqUrlPath) ||
-				isMatch(proxyConfig.Path, clientHostName+reqUrlPath)) &&
-				isForwardProxy == (proxyConfig.Protocol == config.Browser) {
-				if matchingProxyConfig == nil || len(proxyConfig.Path) > len(matchingProxyConfig.Path) {
-					matchingProxyConfig = proxyConfig
-				}
+			if isForwardProxy != (proxyConfig.Protocol == config.Browser) {
+				continue
+			}
+			if !isMatch(proxyConfig.Path, reqUrlPath) &&
+				!isMatch(proxyConfig.Path, clientHostName+reqUrlPath) {
+				continue
+			}
+			if !proxyConfig.Match.Matches(request, scheme) {
+				continue
+			}
+			if matchingProxyConfig == nil || isBetterMatch(proxyConfig, matchingProxyConfig) {
+				matchingProxyConfig = proxyConfig
 			}
 		}
 		return true
@@ -80,23 +99,50 @@ func FindProxyConfigMatchingURL(
 	return matchingProxyConfig
 }
 
+func isBetterMatch(proxyConfig *config.ProxyConfig, than *config.ProxyConfig) bool {
+	if proxyConfig.Priority != than.Priority {
+		return proxyConfig.Priority > than.Priority
+	}
+	if len(proxyConfig.Path) != len(than.Path) {
+		return len(proxyConfig.Path) > len(than.Path)
+	}
+	return proxyConfig.Match != nil && than.Match == nil
+}
+
 /**
  * Emit message to browser.
  * @param {*} message
  * @param {*} proxyConfig
  */
-func EmitMessageToBrowser(messageType MessageType, message *Message, inProxyConfig *config.ProxyConfig) {
-	// log.Println("SocketIo EmitMessageToBrowser()", socketIoMap)
+func (d *Dashboard) EmitMessageToBrowser(messageType MessageType, message *Message, inProxyConfig *config.ProxyConfig) {
+	d.EmitMessageWithBodies(messageType, message, inProxyConfig, nil, nil)
+}
+
+// Emit message to browser.  The raw bodies are passed to the message
+// listeners, e.g. capture storage.
+func (d *Dashboard) EmitMessageWithBodies(
+	messageType MessageType,
+	message *Message,
+	inProxyConfig *config.ProxyConfig,
+	requestBody []byte,
+	responseBody []byte,
+) {
+	// log.Println("SocketIo EmitMessageToBrowser()", d.sockets)
 	message.Type = messageType
+	// Recording is turned off?  Then the message is not stored either.
+	if inProxyConfig == nil || inProxyConfig.Recording {
+		d.notifyMessageListeners(message, requestBody, responseBody)
+	}
 	path := ""
 	if inProxyConfig != nil {
 		path = inProxyConfig.Path
 	}
 	var currentSocketId string
-	socketIoMap.Range(func(key interface{}, value interface{}) bool {
-		for _, proxyConfig := range value.(*socketIoInfo).configs {
+	d.sockets.Range(func(key interface{}, value interface{}) bool {
+		for _, proxyConfig := range value.(*socketIoInfo).getConfigs() {
 			if inProxyConfig == nil ||
-				(proxyConfig.Path == path && inProxyConfig.Protocol == proxyConfig.Protocol) {
+				(proxyConfig.Path == path && inProxyConfig.Protocol == proxyConfig.Protocol &&
+					proxyConfig.Hostname == inProxyConfig.Hostname) {
 				// Don't emit to same socket again
 				if key == currentSocketId {
 					continue
@@ -119,7 +165,32 @@ func EmitMessageToBrowser(messageType MessageType, message *Message, inProxyConf
 	})
 }
 
+// Emit an event to every socket with a recording config like proxyConfig
+func (d *Dashboard) emitToConfigSockets(event string, payload interface{}, inProxyConfig *config.ProxyConfig) {
+	d.sockets.Range(func(_ interface{}, value interface{}) bool {
+		socketInfo := value.(*socketIoInfo)
+		if socketInfo.socket == nil {
+			return true
+		}
+		for _, proxyConfig := range socketInfo.getConfigs() {
+			if proxyConfig.Path == inProxyConfig.Path && proxyConfig.Protocol == inProxyConfig.Protocol &&
+				proxyConfig.Hostname == inProxyConfig.Hostname && proxyConfig.Recording {
+				socketInfo.socket.Emit(event, payload)
+				break
+			}
+		}
+		return true
+	})
+}
+
 func emitMessageWithFlowControl(messages []*Message, socketInfo *socketIoInfo, socketId string) {
+	socketInfo.messagesMutex.Lock()
+	defer socketInfo.messagesMutex.Unlock()
+	emitMessagesLocked(messages, socketInfo, socketId)
+}
+
+// Emit or queue messages, with socketInfo.messagesMutex held
+func emitMessagesLocked(messages []*Message, socketInfo *socketIoInfo, socketId string) {
 	// log.Println("SocketIo emitMessageWithFlowControl", socketId)
 	if socketInfo.remainingWindow == 0 || socketInfo.messagesOut >= maxOut {
 		socketInfo.queuedMessages = append(socketInfo.queuedMessages, messages...)
@@ -140,6 +211,8 @@ func emitMessageWithFlowControl(messages []*Message, socketInfo *socketIoInfo, s
 				len(socketInfo.queuedMessages),
 				// callback:
 				func(response string) {
+					socketInfo.messagesMutex.Lock()
+					defer socketInfo.messagesMutex.Unlock()
 					socketInfo.messagesOut--
 					socketInfo.remainingWindow += batchCount
 
@@ -154,15 +227,42 @@ func emitMessageWithFlowControl(messages []*Message, socketInfo *socketIoInfo, s
 						count = socketInfo.remainingWindow
 					}
 					if count > 0 {
-						emitMessageWithFlowControl(
-							socketInfo.queuedMessages[0:count],
-							socketInfo,
-							socketId,
-						)
+						batch := socketInfo.queuedMessages[0:count]
 						socketInfo.queuedMessages = socketInfo.queuedMessages[count:]
+						emitMessagesLocked(batch, socketInfo, socketId)
 					}
 				},
 			)
 		}
 	}
 }
+
+// Shaping rule for requests to host.  The rules of proxyConfig are searched,
+// or those of every browser config when proxyConfig is nil, e.g. for CONNECT
+// tunnels.
+func (d *Dashboard) FindShaping(proxyConfig *config.ProxyConfig, host string) *config.Shaping {
+	if proxyConfig != nil {
+		return findShaping(proxyConfig, host)
+	}
+	var found *config.Shaping
+	d.sockets.Range(func(_ interface{}, value interface{}) bool {
+		for _, proxyConfig := range value.(*socketIoInfo).getConfigs() {
+			if proxyConfig.Protocol == config.Browser {
+				if found = findShaping(proxyConfig, host); found != nil {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	return found
+}
+
+func findShaping(proxyConfig *config.ProxyConfig, host string) *config.Shaping {
+	for _, rule := range proxyConfig.Shaping {
+		if rule.MatchesHost(host) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"goproxy/config"
+	"sort"
+	"time"
+)
+
+const variantSummaryInterval = 10 * time.Second
+
+// Traffic served by one split variant during the last interval.  Errors are
+// upstream failures and 5xx responses.
+type VariantSummary struct {
+	Path       string  `json:"path"` // of the split config
+	Variant    string  `json:"variant"`
+	Requests   int     `json:"requests"`
+	Errors     int     `json:"errors"`
+	ErrorRate  float64 `json:"errorRate"`  // 0 to 1
+	LatencyAvg float64 `json:"latencyAvg"` // milliseconds
+	LatencyP50 float64 `json:"latencyP50"`
+	LatencyP95 float64 `json:"latencyP95"`
+	LatencyMax float64 `json:"latencyMax"`
+	Interval   int     `json:"interval"` // seconds
+}
+
+type variantStats struct {
+	proxyConfig *config.ProxyConfig
+	variant     string
+	errors      int
+	latencies   []float64
+}
+
+// Count a response served by a split variant
+func (d *Dashboard) RecordVariant(proxyConfig *config.ProxyConfig, variant string, failed bool, elapsed time.Duration) {
+	d.variantMutex.Lock()
+	defer d.variantMutex.Unlock()
+	key := string(proxyConfig.Protocol) + "\x00" + proxyConfig.Path + "\x00" + proxyConfig.Hostname + "\x00" + variant
+	stats, ok := d.variantStatsMap[key]
+	if !ok {
+		stats = &variantStats{proxyConfig: proxyConfig, variant: variant}
+		d.variantStatsMap[key] = stats
+	}
+	if failed {
+		stats.errors++
+	}
+	stats.latencies = append(stats.latencies, float64(elapsed.Microseconds())/1000)
+}
+
+// Emit a "variant summary" of each split config every interval until the
+// dashboard is stopped.
+func (d *Dashboard) StartVariantSummaries() {
+	go func() {
+		ticker := time.NewTicker(variantSummaryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+				d.emitVariantSummaries()
+			}
+		}
+	}()
+}
+
+func (d *Dashboard) emitVariantSummaries() {
+	d.variantMutex.Lock()
+	statsMap := d.variantStatsMap
+	d.variantStatsMap = make(map[string]*variantStats)
+	d.variantMutex.Unlock()
+
+	// One event per config, listing its variants
+	byConfig := make(map[*config.ProxyConfig][]*VariantSummary)
+	for _, stats := range statsMap {
+		byConfig[stats.proxyConfig] = append(byConfig[stats.proxyConfig], stats.summary())
+	}
+	for proxyConfig, summaries := range byConfig {
+		sort.Slice(summaries, func(i, j int) bool { return summaries[i].Variant < summaries[j].Variant })
+		d.emitToConfigSockets("variant summary", summaries, proxyConfig)
+	}
+}
+
+func (stats *variantStats) summary() *VariantSummary {
+	latencies := stats.latencies
+	sort.Float64s(latencies)
+	total := 0.0
+	for _, latency := range latencies {
+		total += latency
+	}
+	n := len(latencies)
+	return &VariantSummary{
+		Path:       stats.proxyConfig.Path,
+		Variant:    stats.variant,
+		Requests:   n,
+		Errors:     stats.errors,
+		ErrorRate:  float64(stats.errors) / float64(n),
+		LatencyAvg: total / float64(n),
+		LatencyP50: latencies[(n-1)*50/100],
+		LatencyP95: latencies[(n-1)*95/100],
+		LatencyMax: latencies[n-1],
+		Interval:   int(variantSummaryInterval.Seconds()),
+	}
+}
@@ -5,14 +5,18 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"goproxy/paths"
 	"log"
 	"math/big"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -21,18 +25,128 @@ const (
 	caPrivateKeyName = "ca.private.key"
 )
 
-type ca struct {
+// Certificate authority issuing the certificates of the hosts goproxy
+// intercepts.  Each goproxy instance has its own.
+type Authority struct {
+	mutex       sync.Mutex
+	signer      *signer
+	dir         paths.DataDir
+	inMemory    bool                        // see NewMemoryAuthority()
+	serverCerts map[string]*tls.Certificate // key=host
+}
+
+type signer struct {
+	dir      paths.DataDir
 	template *x509.Certificate
 	key      *rsa.PrivateKey
+	cert     *x509.Certificate // as issued, for clients that must trust it
 }
 
-var Ca ca
+// CA stored in the data dir, created on first use
+func NewAuthority(dir paths.DataDir) (*Authority, error) {
+	dir.MakeCaDir()
+	dir.MakeCaPemSymLink()
+	c, err := loadSigner(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{signer: c, dir: dir, serverCerts: make(map[string]*tls.Certificate)}, nil
+}
 
-// Init CA
-func InitCa() {
-	log.Println("InitCa()")
-	Ca.template = &x509.Certificate{
-		SerialNumber: randomSerialNumber(),
+// CA that only exists in memory, e.g. for tests.  Server certificates are
+// not written to the data dir either.
+func NewMemoryAuthority() (*Authority, error) {
+	log.Println("NewMemoryAuthority()")
+	c := &signer{}
+	var err error
+	if c.template, err = caTemplate(); err != nil {
+		return nil, err
+	}
+	if c.key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		return nil, err
+	}
+	caBytes, err := x509.CreateCertificate(rand.Reader, c.template, c.template, &c.key.PublicKey, c.key)
+	if err != nil {
+		return nil, err
+	}
+	if c.cert, err = x509.ParseCertificate(caBytes); err != nil {
+		return nil, err
+	}
+	return &Authority{signer: c, inMemory: true, serverCerts: make(map[string]*tls.Certificate)}, nil
+}
+
+// CA certificate
+func (a *Authority) Certificate() *x509.Certificate {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.signer.cert
+}
+
+// Load the CA files, creating them if there are none
+func loadSigner(dir paths.DataDir) (*signer, error) {
+	log.Println("loadSigner()")
+	c := &signer{dir: dir}
+	var err error
+	if c.template, err = caTemplate(); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir.SslCertsDir(), caPemName)); err == nil {
+		// Read the private key from file (ca.private.key)
+		buffer, err := os.ReadFile(filepath.Join(dir.SslKeysDir(), caPrivateKeyName))
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(buffer)
+		if block == nil {
+			return nil, fmt.Errorf("pem.Decode failed for %s", caPrivateKeyName)
+		}
+		c.key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		buffer, err = os.ReadFile(filepath.Join(dir.SslCertsDir(), caPemName))
+		if err != nil {
+			return nil, err
+		}
+		if block, _ = pem.Decode(buffer); block == nil {
+			return nil, fmt.Errorf("pem.Decode failed for %s", caPemName)
+		}
+		if c.cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, err
+		}
+	} else {
+		c.key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		if err := keyWriteToFile(dir, "ca", c.key); err != nil {
+			return nil, err
+		}
+
+		caBytes, err := x509.CreateCertificate(rand.Reader, c.template, c.template, &c.key.PublicKey, c.key)
+		if err != nil {
+			return nil, err
+		}
+
+		// CA Certificate in PEM format
+		if err := certWriteToFile(dir, "ca", caBytes); err != nil {
+			return nil, err
+		}
+		if c.cert, err = x509.ParseCertificate(caBytes); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func caTemplate() (*x509.Certificate, error) {
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			CommonName:         "goproxyCA",
 			Organization:       []string{"goproxy CA"},
@@ -57,149 +171,194 @@ func InitCa() {
 			x509.KeyUsageDataEncipherment |
 			x509.KeyUsageKeyEncipherment,
 		BasicConstraintsValid: true,
-	}
+	}, nil
+}
 
-	if stat, err := os.Stat(filepath.Join(paths.SslCertsDir(), caPemName)); err == nil {
-		// Read the private key from file (ca.private.key)
-		f, err := os.Open(filepath.Join(paths.SslKeysDir(), caPrivateKeyName))
-		if err != nil {
-			log.Panicln(err)
-		}
-		buffer := make([]byte, stat.Size()*2)
-		_, err = f.Read(buffer)
+// Generate Server Certificate/Key files
+func (c *signer) newServerCertKey(host string) (certFile string, keyFile string, err error) {
+	log.Printf("newServerCertKey(%s)\n", host)
+	certFile, keyFile = filepath.Join(c.dir.SslCertsDir(), host+".pem"), filepath.Join(c.dir.SslKeysDir(), host+".key")
+
+	if !c.isSignedBy(certFile) {
+		certBytes, privateKey, err := c.issue(host)
 		if err != nil {
-			log.Panic(err)
-		}
-		block, _ := pem.Decode(buffer)
-		if block == nil {
-			log.Panicf("pem.Decode failed for:\n %s", buffer)
+			return "", "", err
 		}
-		Ca.key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
-		if err != nil {
-			log.Panicln(err)
+		// Write the key first, so a certificate file is never present without its key
+		if err := keyWriteToFile(c.dir, host, privateKey); err != nil {
+			return "", "", err
 		}
-	} else {
-		var err error
-		Ca.key, err = rsa.GenerateKey(rand.Reader, 2048)
-		if err != nil {
-			log.Panicln(err)
+		if err := certWriteToFile(c.dir, host, certBytes); err != nil {
+			return "", "", err
 		}
-		keyWriteToFile("ca", Ca.key)
+	}
 
-		caBytes, err := x509.CreateCertificate(rand.Reader, Ca.template, Ca.template, &Ca.key.PublicKey, Ca.key)
-		if err != nil {
-			log.Panicln(err)
-		}
+	return certFile, keyFile, nil
+}
 
-		// CA Certificate in PEM format
-		certWriteToFile("ca", caBytes)
+// New server certificate for host, signed by the CA
+func (c *signer) issue(host string) ([]byte, *rsa.PrivateKey, error) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	keyId, err := subjectKeyId(privateKey)
+	if err != nil {
+		return nil, nil, err
 	}
-}
 
-// Generate Server Certificate/Key
-func NewServerCertKey(host string) (certFile string, keyFile string) {
-	log.Printf("NewServerCertKey(%s)\n", host)
-	if Ca.template == nil {
-		log.Panicln("ca.NewCa() function was not called!")
+	certTemplate := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization:       []string{"goproxy Server Certificate"},
+			OrganizationalUnit: []string{"goproxy Server Certificate"},
+			Country:            []string{"Internet"},
+			Province:           []string{"Internet"},
+			Locality:           []string{"Internet"},
+			CommonName:         host,
+		},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  false,
+		BasicConstraintsValid: true,
+		SubjectKeyId:          keyId,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageServerAuth,
+		},
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment,
+	}
+	// Clients only match an IP address host against the IP SANs
+	if ip := net.ParseIP(host); ip != nil {
+		certTemplate.IPAddresses = []net.IP{ip}
 	}
 
-	certFile, keyFile = filepath.Join(paths.SslCertsDir(), host+".pem"), filepath.Join(paths.SslKeysDir(), host+".key")
+	certBytes, err := x509.CreateCertificate(rand.Reader, certTemplate, c.template, &privateKey.PublicKey, c.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certBytes, privateKey, nil
+}
 
-	if _, err := os.Stat(certFile); err != nil {
+// True if certFile exists and was issued by the CA.  Certificates left
+// behind by a previous CA are regenerated.
+func (c *signer) isSignedBy(certFile string) bool {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	caCert := &x509.Certificate{PublicKeyAlgorithm: x509.RSA, PublicKey: &c.key.PublicKey}
+	return caCert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
 
-		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// TLS certificate for host, generated on first use.
+func (a *Authority) ServerCertificate(host string) (*tls.Certificate, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if cert, ok := a.serverCerts[host]; ok {
+		return cert, nil
+	}
+	var cert tls.Certificate
+	if a.inMemory {
+		certBytes, privateKey, err := a.signer.issue(host)
 		if err != nil {
-			log.Panicln(err)
-		}
-
-		certTemplate := &x509.Certificate{
-			SerialNumber: randomSerialNumber(),
-			Subject: pkix.Name{
-				Organization:       []string{"goproxy Server Certificate"},
-				OrganizationalUnit: []string{"goproxy Server Certificate"},
-				Country:            []string{"Internet"},
-				Province:           []string{"Internet"},
-				Locality:           []string{"Internet"},
-				CommonName:         host,
-			},
-			DNSNames:              []string{host},
-			NotBefore:             time.Now(),
-			NotAfter:              time.Now().AddDate(10, 0, 0),
-			IsCA:                  false,
-			BasicConstraintsValid: true,
-			SubjectKeyId:          subjectKeyId(privateKey),
-			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth,
-				x509.ExtKeyUsageServerAuth,
-			},
-			KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment,
-		}
-
-		certBytes, err := x509.CreateCertificate(rand.Reader, certTemplate, Ca.template, &privateKey.PublicKey, Ca.key)
+			return nil, err
+		}
+		cert = tls.Certificate{Certificate: [][]byte{certBytes}, PrivateKey: privateKey}
+	} else {
+		certFile, keyFile, err := a.signer.newServerCertKey(host)
 		if err != nil {
-			log.Panicln(err)
+			return nil, err
+		}
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			return nil, err
 		}
-		certWriteToFile(host, certBytes)
-
-		keyWriteToFile(host, privateKey)
 	}
+	a.serverCerts[host] = &cert
+	return &cert, nil
+}
 
-	return certFile, keyFile
+// Re-read the CA files.  New TLS connections get certificates issued by the
+// reloaded CA, and established connections are not affected.
+func (a *Authority) Reload() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.inMemory {
+		return nil // there are no files
+	}
+	c, err := loadSigner(a.dir)
+	if err != nil {
+		return err
+	}
+	a.signer = c
+	a.serverCerts = make(map[string]*tls.Certificate)
+	return nil
 }
 
-func certWriteToFile(name string, certBytes []byte) {
-	fileName := filepath.Join(paths.SslCertsDir(), name+".pem")
+func certWriteToFile(dir paths.DataDir, name string, certBytes []byte) error {
+	fileName := filepath.Join(dir.SslCertsDir(), name+".pem")
 	certPEM := new(bytes.Buffer)
 	pem.Encode(certPEM, &pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: certBytes,
 	})
-	os.WriteFile(fileName, certPEM.Bytes(), 0644)
+	return os.WriteFile(fileName, certPEM.Bytes(), 0644)
 }
 
-func keyWriteToFile(name string, key *rsa.PrivateKey) {
+func keyWriteToFile(dir paths.DataDir, name string, key *rsa.PrivateKey) error {
 	private := ""
 	if name == "ca" {
 		private = ".private" // only ca has ".private"
 	}
-	privateKeyFile := filepath.Join(paths.SslKeysDir(), name+private+".key")
+	privateKeyFile := filepath.Join(dir.SslKeysDir(), name+private+".key")
 	certPrivKeyPEM := new(bytes.Buffer)
 	pem.Encode(certPrivKeyPEM, &pem.Block{
 		Type:  "RSA PRIVATE KEY",
 		Bytes: x509.MarshalPKCS1PrivateKey(key),
 	})
-	os.WriteFile(privateKeyFile, certPrivKeyPEM.Bytes(), 0644)
+	if err := os.WriteFile(privateKeyFile, certPrivKeyPEM.Bytes(), 0644); err != nil {
+		return err
+	}
 
-	publicKeyFile := filepath.Join(paths.SslKeysDir(), name+".public.key")
+	publicKeyFile := filepath.Join(dir.SslKeysDir(), name+".public.key")
 	certPublicKeyPEM := new(bytes.Buffer)
 	pem.Encode(certPublicKeyPEM, &pem.Block{
 		Type:  "PUBLIC KEY",
 		Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey),
 	})
-	os.WriteFile(publicKeyFile, certPublicKeyPEM.Bytes(), 0644)
+	return os.WriteFile(publicKeyFile, certPublicKeyPEM.Bytes(), 0644)
 }
 
-func randomSerialNumber() *big.Int {
+func randomSerialNumber() (*big.Int, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		log.Panicln(err)
-	}
-	return serialNumber
+	return rand.Int(rand.Reader, serialNumberLimit)
 }
 
-func subjectKeyId(privKey *rsa.PrivateKey) []byte {
+func subjectKeyId(privKey *rsa.PrivateKey) ([]byte, error) {
 	pub := privKey.Public()
 	// Subject Key Identifier support for end entity certificate.
 	// https://tools.ietf.org/html/rfc3280#section-4.2.1.2
 	pkixPub, err := x509.MarshalPKIXPublicKey(pub)
 	if err != nil {
-		log.Panicln(err)
+		return nil, err
 	}
 	h := sha1.New()
 	_, err = h.Write(pkixPub)
 	if err != nil {
-		log.Panicln(err)
+		return nil, err
 	}
 	keyID := h.Sum(nil)
-	return keyID
+	return keyID, nil
 }
@@ -0,0 +1,47 @@
+package capture
+
+import (
+	"goproxy/api"
+	"goproxy/global"
+	"log"
+	"time"
+)
+
+const expireInterval = time.Minute
+
+var DefaultLimits = Limits{
+	MaxAge:  7 * 24 * time.Hour,
+	MaxSize: 1 << 30,
+}
+
+// Open the store in dir, and append every message the dashboard emits to
+// it.  Sequence numbers continue after those already stored.  The
+// caller closes the store once the dashboard is stopped.
+func Start(dashboard *api.Dashboard, dir string, limits Limits) (*Store, error) {
+	store, err := Open(dir, limits)
+	if err != nil {
+		return nil, err
+	}
+	global.SetSeqFloor(store.MaxSeq())
+
+	dashboard.AddMessageListener(func(message *api.Message, requestBody []byte, responseBody []byte) {
+		if err := store.Append(message, requestBody, responseBody); err != nil {
+			log.Println("Capture Append()", err)
+		}
+	})
+	dashboard.SetHistorySource(store.History)
+
+	go func() {
+		ticker := time.NewTicker(expireInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-dashboard.Done():
+				return
+			case <-ticker.C:
+				store.Expire()
+			}
+		}
+	}()
+	return store, nil
+}
@@ -0,0 +1,242 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	segmentExt  = ".seg"
+	indexExt    = ".idx"
+	headerSize  = 8  // record length and CRC-32
+	entrySize   = 24 // index entry: seq, offset and stored time
+	maxRecordSz = 256 << 20
+)
+
+// Append-only file of records.  Each record is its length and the CRC-32 of
+// its JSON, then the JSON.  A sealed segment has an index file listing the
+// sequence number, offset and stored time of each record; the active
+// segment's index is rebuilt by scanning it.
+type segment struct {
+	id      int
+	file    *os.File
+	size    int64
+	entries []entry
+}
+
+type entry struct {
+	seq    int
+	offset int64
+	stored int64 // milliseconds since the epoch
+}
+
+var errCorrupt = errors.New("corrupt record")
+
+func segmentPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d%s", id, segmentExt))
+}
+
+func indexPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d%s", id, indexExt))
+}
+
+// Ids of the segment files in dir, in order
+func segmentIds(dir string) ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(names))
+	for _, name := range names {
+		var id int
+		if _, err := fmt.Sscanf(strings.TrimSuffix(filepath.Base(name), segmentExt), "%d", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Open a segment.  The index file of a sealed segment is used when it is
+// intact; otherwise the segment is scanned, and anything after the last
+// complete record, e.g. from a crash mid-write, is truncated.  A read-only
+// segment is never changed.
+func openSegment(dir string, id int, sealed bool, readOnly bool) (*segment, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(segmentPath(dir, id), flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s := &segment{id: id, file: file, size: info.Size()}
+	if sealed {
+		if entries, err := readIndex(indexPath(dir, id), s.size); err == nil {
+			s.entries = entries
+			return s, nil
+		}
+	}
+	end, err := s.scan()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if readOnly {
+		s.size = end
+		return s, nil
+	}
+	if end < s.size {
+		log.Printf("Segment openSegment() %s: truncating %d bytes after the last complete record\n", file.Name(), s.size-end)
+		if err := file.Truncate(end); err != nil {
+			file.Close()
+			return nil, err
+		}
+		s.size = end
+	}
+	if sealed {
+		s.writeIndex(dir)
+	}
+	return s, nil
+}
+
+// Rebuild the entries from the records.  Returns the offset after the last
+// complete record.
+func (s *segment) scan() (int64, error) {
+	s.entries = s.entries[:0]
+	var offset int64
+	for offset < s.size {
+		record, n, err := s.read(offset)
+		if err == errCorrupt || err == io.ErrUnexpectedEOF || err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		s.entries = append(s.entries, entry{seq: record.Message.SequenceNumber, offset: offset, stored: record.Stored})
+		offset += n
+	}
+	return offset, nil
+}
+
+// Record at offset, and its size including the header
+func (s *segment) read(offset int64) (*Record, int64, error) {
+	var header [headerSize]byte
+	if _, err := s.file.ReadAt(header[:], offset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length == 0 || length > maxRecordSz {
+		return nil, 0, errCorrupt
+	}
+	data := make([]byte, length)
+	if _, err := s.file.ReadAt(data, offset+headerSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorrupt
+	}
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil || record.Message == nil {
+		return nil, 0, errCorrupt
+	}
+	return &record, headerSize + int64(length), nil
+}
+
+func (s *segment) append(record *Record, data []byte) error {
+	buf := make([]byte, headerSize+len(data))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[headerSize:], data)
+	if _, err := s.file.WriteAt(buf, s.size); err != nil {
+		return err
+	}
+	s.entries = append(s.entries, entry{seq: record.Message.SequenceNumber, offset: s.size, stored: record.Stored})
+	s.size += int64(len(buf))
+	return nil
+}
+
+// Sync the segment and write its index file
+func (s *segment) seal(dir string) {
+	if err := s.file.Sync(); err != nil {
+		log.Println("Segment seal()", err)
+	}
+	s.writeIndex(dir)
+}
+
+func (s *segment) writeIndex(dir string) {
+	var buf bytes.Buffer
+	for _, e := range s.entries {
+		var b [entrySize]byte
+		binary.LittleEndian.PutUint64(b[0:8], uint64(e.seq))
+		binary.LittleEndian.PutUint64(b[8:16], uint64(e.offset))
+		binary.LittleEndian.PutUint64(b[16:24], uint64(e.stored))
+		buf.Write(b[:])
+	}
+	// Written to a temporary file and renamed, so a crash never leaves a
+	// partial index
+	path := indexPath(dir, s.id)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		log.Println("Segment writeIndex()", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Println("Segment writeIndex()", err)
+	}
+}
+
+func readIndex(path string, segmentSize int64) ([]entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%entrySize != 0 {
+		return nil, errCorrupt
+	}
+	entries := make([]entry, 0, len(data)/entrySize)
+	for i := 0; i < len(data); i += entrySize {
+		e := entry{
+			seq:    int(binary.LittleEndian.Uint64(data[i : i+8])),
+			offset: int64(binary.LittleEndian.Uint64(data[i+8 : i+16])),
+			stored: int64(binary.LittleEndian.Uint64(data[i+16 : i+24])),
+		}
+		if e.offset >= segmentSize {
+			return nil, errCorrupt
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Newest stored time, 0 for an empty segment
+func (s *segment) newest() int64 {
+	if len(s.entries) == 0 {
+		return 0
+	}
+	return s.entries[len(s.entries)-1].stored
+}
+
+func (s *segment) remove(dir string) {
+	s.file.Close()
+	os.Remove(segmentPath(dir, s.id))
+	os.Remove(indexPath(dir, s.id))
+}
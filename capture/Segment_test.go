@@ -0,0 +1,164 @@
+package capture
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"goproxy/api"
+	"hash/crc32"
+	"os"
+	"testing"
+)
+
+// Header and data of a record
+func recordBytes(data []byte) []byte {
+	buf := make([]byte, headerSize, headerSize+len(data))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	return append(buf, data...)
+}
+
+// Segment 1 in a new directory holding records 1 and 2, then tail
+func writeSegment(t *testing.T, tail []byte) (dir string, size int64) {
+	t.Helper()
+	dir = t.TempDir()
+	s, err := openSegment(dir, 1, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := 1; seq <= 2; seq++ {
+		record := &Record{Message: &api.Message{SequenceNumber: seq}, Stored: int64(seq)}
+		data, _ := json.Marshal(record)
+		if err := s.append(record, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size = s.size
+	if _, err := s.file.WriteAt(tail, s.size); err != nil {
+		t.Fatal(err)
+	}
+	s.file.Close()
+	return dir, size
+}
+
+func TestOpenSegmentTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"clean end", nil},
+		{"partial header", []byte{10, 0, 0}},
+		{"header only", recordBytes([]byte(`{"message":{}}`))[:headerSize]},
+		{"partial record", recordBytes([]byte(`{"message":{"sequenceNumber":3}}`))[:headerSize+5]},
+		{"zero length", make([]byte, headerSize+4)},
+		{"length too large", []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}},
+		{"bad checksum", append([]byte{2, 0, 0, 0, 0, 0, 0, 0}, "{}"...)},
+		{"invalid json", recordBytes([]byte(`{"message":`))},
+		{"no message", recordBytes([]byte(`{"stored":3}`))},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, size := writeSegment(t, test.tail)
+			s, err := openSegment(dir, 1, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.file.Close()
+			if len(s.entries) != 2 || s.entries[0].seq != 1 || s.entries[1].seq != 2 || s.entries[1].stored != 2 {
+				t.Errorf("openSegment() entries %v, want records 1 and 2", s.entries)
+			}
+			info, err := os.Stat(segmentPath(dir, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.size != size || info.Size() != size {
+				t.Errorf("openSegment() size %d, file size %d, want %d", s.size, info.Size(), size)
+			}
+		})
+	}
+}
+
+func TestOpenSegmentReadOnly(t *testing.T) {
+	tail := []byte{10, 0, 0}
+	dir, size := writeSegment(t, tail)
+	s, err := openSegment(dir, 1, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.file.Close()
+	if len(s.entries) != 2 || s.size != size {
+		t.Errorf("openSegment() %d entries, size %d, want 2, %d", len(s.entries), s.size, size)
+	}
+	if info, _ := os.Stat(segmentPath(dir, 1)); info.Size() != size+int64(len(tail)) {
+		t.Errorf("read-only openSegment() changed the file size to %d", info.Size())
+	}
+}
+
+func TestOpenSegmentIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		index func(entries []byte) []byte
+	}{
+		{"intact", func(entries []byte) []byte { return entries }},
+		{"missing", nil},
+		{"partial entry", func(entries []byte) []byte { return entries[:entrySize+3] }},
+		{"offset past the end", func(entries []byte) []byte {
+			binary.LittleEndian.PutUint64(entries[entrySize+8:], 1<<20)
+			return entries
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, _ := writeSegment(t, nil)
+			s, err := openSegment(dir, 1, true, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.file.Close()
+			entries, err := os.ReadFile(indexPath(dir, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.index == nil {
+				os.Remove(indexPath(dir, 1))
+			} else if err := os.WriteFile(indexPath(dir, 1), test.index(append([]byte{}, entries...)), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = openSegment(dir, 1, true, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.file.Close()
+			if len(s.entries) != 2 || s.entries[0].offset != 0 || s.entries[1].seq != 2 {
+				t.Errorf("openSegment() entries %v, want records 1 and 2", s.entries)
+			}
+			if rewritten, _ := os.ReadFile(indexPath(dir, 1)); string(rewritten) != string(entries) {
+				t.Error("openSegment() did not rewrite the index")
+			}
+		})
+	}
+}
+
+func TestStoreAppendAfterTornTail(t *testing.T) {
+	dir, _ := writeSegment(t, recordBytes([]byte(`{"message":{"sequenceNumber":3}}`))[:headerSize+5])
+	store, err := Open(dir, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(&api.Message{SequenceNumber: 3}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if seqs := store.Seqs(); len(seqs) != 3 || seqs[2] != 3 {
+		t.Errorf("Seqs() = %v, want [1 2 3]", seqs)
+	}
+	if record := store.Get(3); record == nil || record.Message.SequenceNumber != 3 {
+		t.Errorf("Get(3) = %v, want the record appended after the torn tail", record)
+	}
+}
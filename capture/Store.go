@@ -0,0 +1,254 @@
+package capture
+
+import (
+	"encoding/json"
+	"errors"
+	"goproxy/api"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const segmentMaxSize = 8 << 20 // bytes, a new segment is started after this
+
+var errClosed = errors.New("capture store is closed")
+var errReadOnly = errors.New("capture store is read-only")
+
+// Retention limits.  The oldest segments are deleted while any limit is
+// exceeded; 0 means no limit.
+type Limits struct {
+	MaxAge   time.Duration
+	MaxCount int   // messages, a request and its response are one
+	MaxSize  int64 // bytes
+}
+
+// Message and its raw bodies, as stored
+type Record struct {
+	Message      *api.Message `json:"message"`
+	RequestBody  []byte       `json:"requestBody,omitempty"`
+	ResponseBody []byte       `json:"responseBody,omitempty"`
+	Stored       int64        `json:"stored"` // milliseconds since the epoch
+}
+
+// Segmented message store.  The latest record of each sequence number is
+// indexed, so a request emitted before its response is replaced by the
+// exchange.
+type Store struct {
+	mutex    sync.Mutex
+	dir      string
+	limits   Limits
+	segments []*segment // oldest first, the last one is active
+	index    map[int]location
+	size     int64 // bytes in all segments
+	readOnly bool
+}
+
+type location struct {
+	segment *segment
+	offset  int64
+}
+
+func Open(dir string, limits Limits) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store, err := open(dir, limits, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(store.segments) == 0 {
+		if err := store.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	store.enforce()
+	log.Printf("Store Open() %s: %d messages, %d bytes in %d segments\n", dir, len(store.index), store.size, len(store.segments))
+	return store, nil
+}
+
+// Open a store for reading, e.g. while goproxy is writing to it.  Messages
+// cannot be appended.
+func OpenReadOnly(dir string) (*Store, error) {
+	return open(dir, Limits{}, true)
+}
+
+func open(dir string, limits Limits, readOnly bool) (*Store, error) {
+	ids, err := segmentIds(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(ids)
+	store := &Store{dir: dir, limits: limits, index: make(map[int]location), readOnly: readOnly}
+	for i, id := range ids {
+		s, err := openSegment(dir, id, i < len(ids)-1, readOnly)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		store.add(s)
+	}
+	return store, nil
+}
+
+func (store *Store) add(s *segment) {
+	store.segments = append(store.segments, s)
+	store.size += s.size
+	for _, e := range s.entries {
+		store.index[e.seq] = location{segment: s, offset: e.offset}
+	}
+}
+
+// Largest stored sequence number
+func (store *Store) MaxSeq() int {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	max := 0
+	for seq := range store.index {
+		if seq > max {
+			max = seq
+		}
+	}
+	return max
+}
+
+func (store *Store) Append(message *api.Message, requestBody []byte, responseBody []byte) error {
+	record := &Record{Message: message, RequestBody: requestBody, ResponseBody: responseBody, Stored: time.Now().UnixMilli()}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.readOnly {
+		return errReadOnly
+	}
+	if len(store.segments) == 0 {
+		return errClosed
+	}
+	active := store.segments[len(store.segments)-1]
+	if active.size > 0 && active.size+int64(len(data)) > segmentMaxSize {
+		if err := store.rotate(); err != nil {
+			return err
+		}
+		active = store.segments[len(store.segments)-1]
+	}
+	before := active.size
+	if err := active.append(record, data); err != nil {
+		return err
+	}
+	store.index[message.SequenceNumber] = location{segment: active, offset: before}
+	store.size += active.size - before
+	return nil
+}
+
+// Seal the active segment and start a new one
+func (store *Store) rotate() error {
+	id := 1
+	if len(store.segments) > 0 {
+		active := store.segments[len(store.segments)-1]
+		active.seal(store.dir)
+		id = active.id + 1
+	}
+	s, err := openSegment(store.dir, id, false, false)
+	if err != nil {
+		return err
+	}
+	store.add(s)
+	store.enforce()
+	return nil
+}
+
+// Delete the oldest sealed segments while a limit is exceeded
+func (store *Store) enforce() {
+	for len(store.segments) > 1 {
+		oldest := store.segments[0]
+		expired := store.limits.MaxAge > 0 &&
+			time.Since(time.UnixMilli(oldest.newest())) > store.limits.MaxAge
+		tooMany := store.limits.MaxCount > 0 && len(store.index) > store.limits.MaxCount
+		tooBig := store.limits.MaxSize > 0 && store.size > store.limits.MaxSize
+		if !expired && !tooMany && !tooBig {
+			return
+		}
+		for _, e := range oldest.entries {
+			if store.index[e.seq].segment == oldest {
+				delete(store.index, e.seq)
+			}
+		}
+		store.size -= oldest.size
+		store.segments = store.segments[1:]
+		oldest.remove(store.dir)
+	}
+}
+
+// Apply MaxAge to segments that stopped receiving messages
+func (store *Store) Expire() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.enforce()
+}
+
+// Stored record of a sequence number, or nil
+func (store *Store) Get(seq int) *Record {
+	store.mutex.Lock()
+	loc, ok := store.index[seq]
+	store.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	record, _, err := loc.segment.read(loc.offset)
+	if err != nil {
+		log.Println("Store Get()", seq, err)
+		return nil
+	}
+	return record
+}
+
+// Sequence numbers of the stored messages, in order
+func (store *Store) Seqs() []int {
+	store.mutex.Lock()
+	seqs := make([]int, 0, len(store.index))
+	for seq := range store.index {
+		seqs = append(seqs, seq)
+	}
+	store.mutex.Unlock()
+	sort.Ints(seqs)
+	return seqs
+}
+
+// Up to limit messages with sequence numbers below before (0 for the
+// latest), oldest first
+func (store *Store) History(before int, limit int) []*api.Message {
+	seqs := store.Seqs()
+	end := len(seqs)
+	if before > 0 {
+		end = sort.SearchInts(seqs, before)
+	}
+	start := 0
+	if limit > 0 && end-limit > start {
+		start = end - limit
+	}
+	messages := make([]*api.Message, 0, end-start)
+	for _, seq := range seqs[start:end] {
+		if record := store.Get(seq); record != nil {
+			messages = append(messages, record.Message)
+		}
+	}
+	return messages
+}
+
+// Sync the active segment and write its index, so the next start does not
+// have to scan it
+func (store *Store) Close() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for i, s := range store.segments {
+		if i == len(store.segments)-1 && !store.readOnly {
+			s.seal(store.dir)
+		}
+		s.file.Close()
+	}
+	store.segments = nil
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"goproxy"
+	"goproxy/capture"
+	"goproxy/config"
+	"goproxy/global"
+	"goproxy/har"
+	"goproxy/paths"
+	"io"
+	"log"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func usage() {
+	fmt.Println("\nUsage: goproxy [--listen [host:]port] [--debug] [--noCapture]")
+	fmt.Println("               [--captureMaxAge duration] [--captureMaxCount n] [--captureMaxSize megabytes]")
+	fmt.Println("       goproxy config validate <file> [--listen [host:]port]...")
+	fmt.Println("       goproxy har export [--since duration|time] [--filter regexp] [--output file]")
+	fmt.Println("       goproxy har import <file> [--proxy [host:]port]")
+	fmt.Println("\nOptions:")
+	fmt.Println("\t--listen - listen for incoming http connections.  Default is 8888.")
+	fmt.Println("\t          May be repeated to listen on several addresses, e.g. --listen 8888 --listen [::1]:8889")
+	fmt.Println("\t--noCapture - do not store messages in the data dir.")
+	fmt.Println("\t--captureMaxAge - delete stored messages older than this, e.g. 24h.  Default is 168h, 0 keeps them.")
+	fmt.Println("\t--captureMaxCount - keep about this many stored messages.  Default is no limit.")
+	fmt.Println("\t--captureMaxSize - keep about this many megabytes of stored messages.  Default is 1024.")
+	fmt.Println("\nCommands:")
+	fmt.Println("\tconfig validate - check a config.json file, and its ports against the --listen addresses.  Exits with status 1 if it is invalid.")
+	fmt.Println("\thar export - write the stored messages as a HAR file, e.g. --since 1h --filter /api/")
+	fmt.Println("\thar import - load a HAR file into the dashboard of the goproxy listening on --proxy.  Default is 8888.")
+	fmt.Println("\nExample: goproxy --listen 8888")
+}
+
+// goproxy config validate <file> [--listen [host:]port]...
+func configCommand(args []string) {
+	if len(args) < 2 || args[0] != "validate" {
+		usage()
+		os.Exit(1)
+	}
+	var listen []string
+	for i := 2; i < len(args); i += 2 {
+		if args[i] != "--listen" || i+1 >= len(args) {
+			usage()
+			os.Exit(1)
+		}
+		listen = append(listen, args[i+1])
+	}
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if _, errs := config.ValidateJson(data, listen); len(errs) > 0 {
+		for _, e := range errs {
+			// file:line: message, as printed by compilers and linters
+			line := e.Line
+			e.Line = 0
+			fmt.Printf("%s:%d: %v\n", args[1], line, e)
+		}
+		os.Exit(1)
+	}
+	fmt.Println(args[1] + ": OK")
+}
+
+// goproxy har export|import ...
+func harCommand(args []string) {
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+	options := make(map[string]string)
+	files := make([]string, 0)
+	for i := 1; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "--") {
+			if i+1 >= len(args) {
+				usage()
+				fmt.Println("\nMissing value for " + args[i])
+				os.Exit(1)
+			}
+			options[args[i]] = args[i+1]
+			i++
+		} else {
+			files = append(files, args[i])
+		}
+	}
+
+	switch {
+	case args[0] == "export" && len(files) == 0:
+		if err := harExport(options["--since"], options["--filter"], options["--output"]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case args[0] == "import" && len(files) == 1:
+		proxy := options["--proxy"]
+		if len(proxy) == 0 {
+			proxy = "8888"
+		}
+		if err := harImport(files[0], proxy); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
+
+// Export from the data dir, which works whether or not goproxy is running
+func harExport(since string, filter string, output string) error {
+	f, err := har.ParseFilter(since, filter)
+	if err != nil {
+		return err
+	}
+	store, err := capture.OpenReadOnly(paths.CaptureDir())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	data, err := json.MarshalIndent(har.Export(store, f), "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(output) == 0 {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	return os.WriteFile(output, data, 0644)
+}
+
+// Post the HAR file to a running goproxy
+func harImport(file string, proxy string) error {
+	host, port, err := parseAddress(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid --proxy %q", proxy)
+	}
+	if len(host) == 0 {
+		host = "localhost"
+	}
+	data, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	importUrl := "http://" + net.JoinHostPort(host, port) + har.Path + "?name=" + url.QueryEscape(filepath.Base(file))
+	client := &nethttp.Client{}
+	res, err := client.Post(importUrl, "application/json", data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != nethttp.StatusOK {
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Print(string(body))
+	return nil
+}
+
+type Listener struct {
+	host string
+	port string
+}
+
+const shutdownTimeout = 10 * time.Second
+
+var captureEnabled = true
+var captureLimits = capture.DefaultLimits
+
+func parseArgs() []Listener {
+	listeners := make([]Listener, 0)
+	for i := 1; i < len(os.Args); i++ {
+		switch os.Args[i] {
+		case "--help":
+			usage()
+			os.Exit(1)
+		case "--listen":
+			if i+1 >= len(os.Args) {
+				usage()
+				fmt.Println("\nMissing port number for " + os.Args[i])
+				os.Exit(1)
+			}
+			i++
+			host, port, err := parseAddress(os.Args[i])
+			if err != nil {
+				usage()
+				fmt.Println("\nInvalid port: " + os.Args[i])
+				os.Exit(1)
+			}
+			listeners = append(listeners, Listener{host, port})
+		case "--debug":
+			global.Debug = true
+		case "--noCapture":
+			captureEnabled = false
+		case "--captureMaxAge", "--captureMaxCount", "--captureMaxSize":
+			if i+1 >= len(os.Args) {
+				usage()
+				fmt.Println("\nMissing value for " + os.Args[i])
+				os.Exit(1)
+			}
+			if err := parseCaptureLimit(os.Args[i], os.Args[i+1]); err != nil {
+				usage()
+				fmt.Println("\nInvalid value for " + os.Args[i] + ": " + os.Args[i+1])
+				os.Exit(1)
+			}
+			i++
+		default:
+			usage()
+			fmt.Println("\nInvalid option: " + os.Args[i])
+			os.Exit(1)
+		}
+	}
+	return listeners
+}
+
+func parseCaptureLimit(option string, value string) error {
+	if option == "--captureMaxAge" {
+		age, err := time.ParseDuration(value)
+		if err != nil || age < 0 {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		captureLimits.MaxAge = age
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid number %q", value)
+	}
+	if option == "--captureMaxCount" {
+		captureLimits.MaxCount = n
+	} else {
+		captureLimits.MaxSize = int64(n) << 20
+	}
+	return nil
+}
+
+// Parse "port", "host:port" or "[ipv6]:port"
+func parseAddress(address string) (host string, port string, err error) {
+	port = address
+	if _, err := strconv.Atoi(address); err != nil {
+		host, port, err = net.SplitHostPort(address)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", "", err
+	}
+	return host, port, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		configCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "har" {
+		harCommand(os.Args[2:])
+		return
+	}
+
+	listeners := parseArgs()
+	if len(listeners) == 0 {
+		listeners = append(listeners, Listener{port: "8888"})
+	}
+
+	options := goproxy.Options{ConfigFile: paths.ConfigJson(), HealthChecks: true}
+	for _, entry := range listeners {
+		fmt.Printf("Listening on http %s %s\n", entry.host, entry.port)
+		options.Listen = append(options.Listen, net.JoinHostPort(entry.host, entry.port))
+	}
+	if captureEnabled {
+		options.Capture = &captureLimits
+	}
+
+	proxy, err := goproxy.New(options)
+	if err != nil {
+		log.Fatalln("New()", err)
+	}
+	if err := proxy.Start(); err != nil {
+		log.Fatalln("Start()", err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case <-proxy.Done():
+			log.Println("No listeners are running")
+			os.Exit(1)
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGHUP:
+				reload(proxy)
+			default:
+				shutdown(proxy, sig)
+				return
+			}
+		}
+	}
+}
+
+// SIGHUP: reload config.json and the CA without dropping connections
+func reload(proxy *goproxy.Proxy) {
+	log.Println("SIGHUP reloading config and CA")
+	if err := proxy.Reload(); err != nil {
+		log.Println("Reload()", err)
+	}
+}
+
+// SIGINT/SIGTERM: stop accepting connections, let in-flight exchanges finish,
+// then flush the dashboard.
+func shutdown(proxy *goproxy.Proxy, sig os.Signal) {
+	log.Printf("%v received, shutting down (deadline %v)\n", sig, shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// A second signal forces an immediate exit
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		os.Exit(1)
+	}()
+
+	proxy.Stop(ctx)
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Conditions a request must meet, in addition to the config's Path, for the
+// config to be used.  Empty lists match anything.  Negate inverts the
+// result of the whole match.
+type Match struct {
+	Schemes     []string      `json:"schemes,omitempty"`     // "http", "https"
+	Hosts       []string      `json:"hosts,omitempty"`       // Host header: "api.example.com", "*.example.com" or a regex containing ".*"
+	Methods     []string      `json:"methods,omitempty"`     // "GET", "POST", ...
+	Headers     []*ValueMatch `json:"headers,omitempty"`     // all must match
+	Query       []*ValueMatch `json:"query,omitempty"`       // all must match
+	ClientCidrs []string      `json:"clientCidrs,omitempty"` // client IP, e.g. "10.0.0.0/8" or "::1/128"
+	Negate      bool          `json:"negate,omitempty"`
+}
+
+// Header or query parameter condition.  An empty Value only requires the
+// name to be present, otherwise Value is a regular expression matched
+// against each of its values.
+type ValueMatch struct {
+	Name   string `json:"name"`
+	Value  string `json:"value,omitempty"`
+	Negate bool   `json:"negate,omitempty"`
+}
+
+var matchRegexps sync.Map // compiled Match patterns, key=pattern
+
+// Does the request meet every condition?  scheme is the scheme the client
+// used, since server requests do not carry one.
+func (m *Match) Matches(request *http.Request, scheme string) bool {
+	if m == nil {
+		return true
+	}
+	return m.matches(request, scheme) != m.Negate
+}
+
+func (m *Match) matches(request *http.Request, scheme string) bool {
+	if len(m.Schemes) > 0 && !containsFold(m.Schemes, scheme) {
+		return false
+	}
+	if len(m.Methods) > 0 && !containsFold(m.Methods, request.Method) {
+		return false
+	}
+	if len(m.Hosts) > 0 && !matchAnyHost(m.Hosts, request.Host) {
+		return false
+	}
+	for _, header := range m.Headers {
+		if !header.matches(request.Header.Values(header.Name)) {
+			return false
+		}
+	}
+	if len(m.Query) > 0 {
+		query := request.URL.Query()
+		for _, param := range m.Query {
+			if !param.matches(query[param.Name]) {
+				return false
+			}
+		}
+	}
+	if len(m.ClientCidrs) > 0 && !matchAnyCidr(m.ClientCidrs, request.RemoteAddr) {
+		return false
+	}
+	return true
+}
+
+func (v *ValueMatch) matches(values []string) bool {
+	found := len(values) > 0
+	if found && len(v.Value) > 0 {
+		found = false
+		if re := matchRegexp(v.Value); re != nil {
+			for _, value := range values {
+				if re.MatchString(value) {
+					found = true
+					break
+				}
+			}
+		}
+	}
+	return found != v.Negate
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Patterns without a port are compared with the host name only
+func matchAnyHost(patterns []string, host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, pattern := range patterns {
+		name := hostname
+		if strings.Contains(pattern, ":") {
+			name = host
+		}
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(strings.ToLower(name), strings.ToLower(pattern[1:])) {
+				return true
+			}
+		case strings.Contains(pattern, ".*"):
+			if re := matchRegexp(pattern); re != nil && re.MatchString(name) {
+				return true
+			}
+		default:
+			if strings.EqualFold(pattern, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchAnyCidr(cidrs []string, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Invalid patterns are rejected by Validate(), and never match
+func matchRegexp(pattern string) *regexp.Regexp {
+	if re, ok := matchRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil
+	}
+	matchRegexps.Store(pattern, re)
+	return re
+}
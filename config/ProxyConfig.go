@@ -20,16 +20,261 @@ const (
 )
 
 type ProxyConfig struct {
-	IsSecure        bool           `json:"isSecure"`
-	Path            string         `json:"path"`
-	Protocol        ConfigProtocol `json:"protocol"`
-	Hostname        string         `json:"hostname"`
-	Port            int            `json:"port"`
-	Recording       bool           `json:"recording"`
-	HostReachable   bool           `json:"hostReachable"`
-	LogProxyProcess string         `json:"logProxyProcess"`
-	Server          *http.Server   `json:"_server"`
-	Comment         string         `json:"comment"`
+	IsSecure        bool            `json:"isSecure"`
+	Path            string          `json:"path"`
+	Protocol        ConfigProtocol  `json:"protocol"`
+	Hostname        string          `json:"hostname"`
+	Port            int             `json:"port"`
+	Recording       bool            `json:"recording"`
+	HostReachable   bool            `json:"hostReachable"`
+	LogProxyProcess string          `json:"logProxyProcess"` // ignored, log: commands are not run
+	Server          *http.Server    `json:"_server"`
+	Comment         string          `json:"comment"`
+	EndpointRules   []*EndpointRule `json:"endpointRules,omitempty"`
+	ServerTiming    bool            `json:"serverTiming,omitempty"`   // add upstream latency to the Server-Timing response header
+	Match           *Match          `json:"match,omitempty"`          // further conditions on the request
+	Priority        int             `json:"priority,omitempty"`       // the matching config with the highest priority is used
+	StripPrefix     bool            `json:"stripPrefix,omitempty"`    // remove the part of the URL path matched by Path
+	PathRewrite     *PathRewrite    `json:"pathRewrite,omitempty"`    // then rewrite the path with a regular expression
+	TargetBasePath  string          `json:"targetBasePath,omitempty"` // then prefix the path with this base path
+	Targets         []string        `json:"targets,omitempty"`        // upstream "host[:port]" list, used instead of Hostname
+	Balance         *Balance        `json:"balance,omitempty"`        // how requests are spread across Targets
+	HealthCheck     *HealthCheck    `json:"healthCheck,omitempty"`    // how HostReachable is probed, default TCP connect
+	Shadow          *Shadow         `json:"shadow,omitempty"`         // mirror requests to a second upstream and diff the responses
+	Split           *Split          `json:"split,omitempty"`          // canary or weighted split between upstream variants
+	Shaping         []*Shaping      `json:"shaping,omitempty"`        // simulated network conditions, first matching host wins
+	Faults          []*FaultRule    `json:"faults,omitempty"`         // fault injection, first enabled matching rule wins
+	Rewrites        []*RewriteRule  `json:"rewrites,omitempty"`       // header and body changes, every matching rule is applied
+	Vcr             *Vcr            `json:"vcr,omitempty"`            // record responses to a cassette, or play them back
+}
+
+// Regular expression substitution of the upstream URL path.  Replacement
+// may refer to capture groups ($1, ${name}).
+type PathRewrite struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// User supplied endpoint naming rule.  Pattern is a regular expression
+// matched against the URL path, and Name may refer to its capture groups
+// ($1, ${name}).  An empty Method matches any method.
+type EndpointRule struct {
+	Method  string `json:"method,omitempty"`
+	Pattern string `json:"pattern"`
+	Name    string `json:"name"`
+}
+
+type BalancePolicy string
+
+const (
+	RoundRobin       BalancePolicy = "roundRobin"
+	LeastConnections BalancePolicy = "leastConnections"
+	Random           BalancePolicy = "random"
+	Hash             BalancePolicy = "hash"
+)
+
+// Load balancing across Targets.  Hash sends requests with the same
+// HashHeader or HashCookie value to the same target.  A target failing
+// MaxFailures times in a row is ejected for Cooldown seconds.
+type Balance struct {
+	Policy      BalancePolicy `json:"policy"`
+	HashHeader  string        `json:"hashHeader,omitempty"`
+	HashCookie  string        `json:"hashCookie,omitempty"`
+	MaxFailures int           `json:"maxFailures,omitempty"` // default 3
+	Cooldown    int           `json:"cooldown,omitempty"`    // seconds, default 30
+}
+
+type HealthCheckType string
+
+const (
+	TcpCheck  HealthCheckType = "tcp"  // connect
+	HttpCheck HealthCheckType = "http" // GET Path
+	TlsCheck  HealthCheckType = "tls"  // connect and handshake
+)
+
+// Periodic probe of the config's Hostname or Targets.  An http check passes
+// on ExpectStatus, or on any status below 500 when ExpectStatus is 0.
+type HealthCheck struct {
+	Type         HealthCheckType `json:"type"`
+	Path         string          `json:"path,omitempty"` // default "/"
+	ExpectStatus int             `json:"expectStatus,omitempty"`
+	Interval     int             `json:"interval,omitempty"` // seconds, default 10
+	Timeout      int             `json:"timeout,omitempty"`  // seconds, default 2
+}
+
+// Secondary upstream receiving a copy of each request.  Its responses are
+// compared with the primary's, ignoring the IgnoreHeaders and the JSON body
+// IgnorePaths, e.g. "$.id" or "$.items[*].updatedAt".
+type Shadow struct {
+	Hostname      string   `json:"hostname"` // "host[:port]"
+	IsSecure      bool     `json:"isSecure,omitempty"`
+	IgnoreHeaders []string `json:"ignoreHeaders,omitempty"`
+	IgnorePaths   []string `json:"ignorePaths,omitempty"`
+	Timeout       int      `json:"timeout,omitempty"` // seconds, default 30
+}
+
+type SplitBy string
+
+const (
+	SplitByWeight   SplitBy = "weight"   // random by Weight, sticky by cookie
+	SplitByHeader   SplitBy = "header"   // Header value
+	SplitByCookie   SplitBy = "cookie"   // Cookie value
+	SplitByClientIp SplitBy = "clientIp" // hash of the client IP, by Weight
+)
+
+// Traffic split between upstream variants.  Header and cookie splits send
+// a request to the variant listing its value, and hash other values by
+// Weight.
+type Split struct {
+	By       SplitBy    `json:"by"`
+	Header   string     `json:"header,omitempty"`
+	Cookie   string     `json:"cookie,omitempty"`
+	Variants []*Variant `json:"variants"`
+}
+
+type Variant struct {
+	Name     string   `json:"name"`
+	Hostname string   `json:"hostname"` // "host[:port]"
+	Weight   int      `json:"weight,omitempty"`
+	Values   []string `json:"values,omitempty"` // header or cookie values sent to this variant
+}
+
+// Simulated network conditions for requests to Hosts (patterns as in
+// Match.Hosts, empty for any host).  Rates are bytes per second, and 0 is
+// unlimited.
+type Shaping struct {
+	Hosts           []string `json:"hosts,omitempty"`
+	Latency         int      `json:"latency,omitempty"`         // milliseconds added before the response
+	Jitter          int      `json:"jitter,omitempty"`          // milliseconds, latency varies by +/- jitter
+	UploadRate      int      `json:"uploadRate,omitempty"`      // client to upstream
+	DownloadRate    int      `json:"downloadRate,omitempty"`    // upstream to client
+	StallEvery      int      `json:"stallEvery,omitempty"`      // seconds between stalls
+	StallFor        int      `json:"stallFor,omitempty"`        // milliseconds each stall lasts
+	DropProbability float64  `json:"dropProbability,omitempty"` // 0 to 1, chance the connection is closed mid-response
+}
+
+// Does the rule apply to host ("name" or "name:port")?
+func (s *Shaping) MatchesHost(host string) bool {
+	return len(s.Hosts) == 0 || matchAnyHost(s.Hosts, host)
+}
+
+type FaultType string
+
+const (
+	StatusFault      FaultType = "status"      // respond with Status and Body instead of proxying
+	DelayFault       FaultType = "delay"       // wait Delay milliseconds before proxying
+	TruncateFault    FaultType = "truncate"    // send half the response body
+	ResetFault       FaultType = "reset"       // reset the client connection
+	CorruptJsonFault FaultType = "corruptJson" // make the JSON response body invalid
+	BadChunkedFault  FaultType = "badChunked"  // send the response with malformed chunked encoding
+)
+
+// Fault injected into requests whose URL path matches the Path regular
+// expression (any path when empty) and that meet Match.  Probability is
+// between 0 and 1, and 0 means always.
+type FaultRule struct {
+	Name        string            `json:"name"`
+	Enabled     bool              `json:"enabled"`
+	Type        FaultType         `json:"type"`
+	Path        string            `json:"path,omitempty"`
+	Match       *Match            `json:"match,omitempty"`
+	Probability float64           `json:"probability,omitempty"`
+	Status      int               `json:"status,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"` // response headers of a status fault
+	Delay       int               `json:"delay,omitempty"`
+}
+
+type CorsPreset string
+
+const (
+	PermissiveCors  CorsPreset = "permissive"  // allow any origin, method and header, without credentials
+	CredentialsCors CorsPreset = "credentials" // echo the origin, method and headers asked for, with credentials
+)
+
+// Changes made to requests whose URL path matches the Path regular
+// expression (any path when empty) and that meet Match.  When ContentType is
+// set, each side is only changed if its Content-Type matches that regular
+// expression.
+type RewriteRule struct {
+	Name        string     `json:"name"`
+	Path        string     `json:"path,omitempty"`
+	Match       *Match     `json:"match,omitempty"`
+	ContentType string     `json:"contentType,omitempty"`
+	Request     *Rewrite   `json:"request,omitempty"`
+	Response    *Rewrite   `json:"response,omitempty"`
+	Status      int        `json:"status,omitempty"`  // override the response status
+	Cors        CorsPreset `json:"cors,omitempty"`    // relax CORS, and answer preflight requests
+	NoCache     bool       `json:"noCache,omitempty"` // strip validators and caching headers
+	Inject      *Injection `json:"inject,omitempty"`  // add a snippet to HTML responses
+}
+
+// Header and body changes to one side of the exchange.  JSONPath
+// expressions have the form "$.items[0].name", and "[*]" selects every
+// array element.
+type Rewrite struct {
+	SetHeaders    map[string]string      `json:"setHeaders,omitempty"`
+	AddHeaders    map[string]string      `json:"addHeaders,omitempty"`
+	RemoveHeaders []string               `json:"removeHeaders,omitempty"`
+	Replace       []*BodyReplace         `json:"replace,omitempty"`    // applied to the body in order
+	JsonSet       map[string]interface{} `json:"jsonSet,omitempty"`    // JSONPath to value
+	JsonDelete    []string               `json:"jsonDelete,omitempty"` // JSONPaths
+}
+
+type InjectPosition string
+
+const (
+	HeadEnd InjectPosition = "head" // before </head>
+	BodyEnd InjectPosition = "body" // before </body>, the default
+)
+
+// HTML or JavaScript added to text/html responses.  Either Snippet, or File
+// in the data dir "inject" directory; a .js file is wrapped in a <script>
+// element.  Without a </head>, the snippet goes before </body>, and without
+// either it is appended to the page.
+type Injection struct {
+	Snippet  string         `json:"snippet,omitempty"`
+	File     string         `json:"file,omitempty"`
+	Position InjectPosition `json:"position,omitempty"`
+	RelaxCsp bool           `json:"relaxCsp,omitempty"` // remove the Content-Security-Policy, so injected scripts may run
+}
+
+// Regular expression substitution of a body.  Replacement may refer to
+// capture groups ($1, ${name}).
+type BodyReplace struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+type VcrMode string
+
+const (
+	VcrRecord   VcrMode = "record"   // save each exchange to the cassette
+	VcrPlayback VcrMode = "playback" // answer from the cassette without contacting upstream
+)
+
+type VcrMiss string
+
+const (
+	VcrFail        VcrMiss = "fail"        // respond 502 and flag the message, the default
+	VcrPassthrough VcrMiss = "passthrough" // proxy the request upstream
+)
+
+// Record and playback of exchanges.  Cassette names a file in the data dir
+// "cassettes" directory.  Requests are matched on their method and path,
+// plus what Key selects; Miss says what to do with requests that are not in
+// the cassette during playback.
+type Vcr struct {
+	Mode     VcrMode `json:"mode"`
+	Cassette string  `json:"cassette"`
+	Key      *VcrKey `json:"key,omitempty"`
+	Miss     VcrMiss `json:"miss,omitempty"`
+}
+
+type VcrKey struct {
+	IgnoreQuery bool     `json:"ignoreQuery,omitempty"` // the query string is part of the key unless ignored
+	Headers     []string `json:"headers,omitempty"`     // request headers that are part of the key
+	Body        bool     `json:"body,omitempty"`        // include a hash of the request body
 }
 
 type ProxyConfigJson struct {
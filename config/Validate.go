@@ -0,0 +1,726 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"goproxy/jsonpath"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Problem found in a config.  Line is the line in config.json, or 0 when the
+// config did not come from a file.
+type ValidationError struct {
+	Line    int    `json:"line,omitempty"`
+	Index   int    `json:"index"` // index in configs, -1 for the whole file
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	location := ""
+	if e.Line > 0 {
+		location = "line " + strconv.Itoa(e.Line) + ": "
+	}
+	if e.Index >= 0 {
+		location += "configs[" + strconv.Itoa(e.Index) + "]"
+		if len(e.Field) > 0 {
+			location += "." + e.Field
+		}
+		location += ": "
+	}
+	return location + e.Message
+}
+
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, e := range errs {
+		messages[i] = e.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+var protocols = map[ConfigProtocol]bool{
+	Browser: true, Grpc: true, Http: true, Https: true, Log: true,
+	Mongo: true, Redis: true, MySql: true, Tcp: true,
+}
+
+// Protocols proxied by a server listening on the config's port
+func IsConnectionProtocol(protocol ConfigProtocol) bool {
+	switch protocol {
+	case Grpc, Mongo, Redis, MySql, Tcp:
+		return true
+	}
+	return false
+}
+
+// Check that no two listen addresses accept connections on the same port
+// and address.  ports gets the address of each port listened on.
+func validateListen(listen []string, ports map[int]string) ValidationErrors {
+	errs := make(ValidationErrors, 0)
+	hosts := make(map[int][]string) // port -> hosts listening on it
+	for _, address := range listen {
+		host, port, err := splitListenAddress(address)
+		if err != nil {
+			errs = append(errs, &ValidationError{Index: -1, Message: fmt.Sprintf("listen address %q: %v", address, err)})
+			continue
+		}
+		if port == 0 {
+			// A random port never conflicts
+			continue
+		}
+		for _, other := range hosts[port] {
+			if host == other || isWildcardHost(host) || isWildcardHost(other) {
+				errs = append(errs, &ValidationError{Index: -1, Message: fmt.Sprintf("listen address %q overlaps %q", address, ports[port])})
+				break
+			}
+		}
+		hosts[port] = append(hosts[port], host)
+		if _, ok := ports[port]; !ok {
+			ports[port] = address
+		}
+	}
+	return errs
+}
+
+// Host and port of "port", "host:port" or "[ipv6]:port"
+func splitListenAddress(address string) (string, int, error) {
+	host, portString := "", address
+	if _, err := strconv.Atoi(address); err != nil {
+		if host, portString, err = net.SplitHostPort(address); err != nil {
+			return "", 0, err
+		}
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %q", portString)
+	}
+	return host, port, nil
+}
+
+// Hosts that listen on every address
+func isWildcardHost(host string) bool {
+	return host == "" || host == "0.0.0.0" || host == "::"
+}
+
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9_]([a-zA-Z0-9_-]{0,61}[a-zA-Z0-9_])?$`)
+
+// Parse and validate a config.json file for a goproxy listening on listen.
+// Errors carry the line number of the offending field.
+func ValidateJson(data []byte, listen []string) ([]*ProxyConfig, ValidationErrors) {
+	var proxyConfigJson ProxyConfigJson
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&proxyConfigJson); err != nil {
+		line := 0
+		var syntaxError *json.SyntaxError
+		var typeError *json.UnmarshalTypeError
+		if errors.As(err, &syntaxError) {
+			line = lineOf(data, int(syntaxError.Offset))
+		} else if errors.As(err, &typeError) {
+			line = lineOf(data, int(typeError.Offset))
+		}
+		return nil, ValidationErrors{{Line: line, Index: -1, Message: err.Error()}}
+	}
+
+	errs := Validate(proxyConfigJson.Configs, listen)
+	positions := findPositions(data)
+	for _, e := range errs {
+		if e.Index >= 0 && e.Index < len(positions) {
+			e.Line = lineOf(data, positions[e.Index].offset(e.Field))
+		}
+	}
+	return proxyConfigJson.Configs, errs
+}
+
+// Validate configs received from the browser or read from config.json.
+// listen holds the addresses goproxy listens on, e.g. "localhost:8888",
+// which must not overlap each other or the ports of the configs.
+func Validate(proxyConfigs []*ProxyConfig, listen []string) ValidationErrors {
+	errs := make(ValidationErrors, 0)
+	ports := make(map[int]int) // port -> index of the config listening on it
+	listenPorts := make(map[int]string)
+	listenErrs := validateListen(listen, listenPorts)
+
+	for i, p := range proxyConfigs {
+		add := func(field string, format string, args ...interface{}) {
+			errs = append(errs, &ValidationError{Index: i, Field: field, Message: fmt.Sprintf(format, args...)})
+		}
+		if p == nil {
+			add("", "config is null")
+			continue
+		}
+
+		if !protocols[p.Protocol] {
+			add("protocol", "unknown protocol %q", p.Protocol)
+		}
+		if p.Port < 0 || p.Port > 65535 {
+			add("port", "port %d is out of range", p.Port)
+		}
+
+		switch {
+		case p.Protocol == Log:
+			if len(p.Path) == 0 {
+				add("path", "log name is required")
+			}
+		case IsConnectionProtocol(p.Protocol):
+			if p.Port == 0 {
+				add("port", "port is required for %s", p.Protocol)
+			} else if other, ok := ports[p.Port]; ok {
+				add("port", "port %d is also used by configs[%d]", p.Port, other)
+			} else if address, ok := listenPorts[p.Port]; ok {
+				add("port", "port %d is also used by listen address %s", p.Port, address)
+			} else {
+				ports[p.Port] = i
+			}
+			if len(p.Hostname) == 0 {
+				add("hostname", "hostname is required for %s", p.Protocol)
+			}
+		case p.Protocol == Http || p.Protocol == Https || p.Protocol == Browser:
+			if len(p.Path) == 0 {
+				add("path", "path is required")
+			} else if strings.Contains(p.Path, ".*") {
+				if _, err := regexp.Compile(p.Path); err != nil {
+					add("path", "invalid regular expression: %v", err)
+				}
+			}
+			if p.Protocol != Browser && len(p.Hostname) == 0 && len(p.Targets) == 0 && p.Split == nil {
+				add("hostname", "hostname, targets or split are required for %s", p.Protocol)
+			}
+			for j, target := range p.Targets {
+				if err := validateHostname(target); err != nil {
+					add("targets["+strconv.Itoa(j)+"]", "%v", err)
+				}
+			}
+			if p.Balance != nil {
+				switch p.Balance.Policy {
+				case RoundRobin, LeastConnections, Random, "":
+				case Hash:
+					if len(p.Balance.HashHeader) == 0 && len(p.Balance.HashCookie) == 0 {
+						add("balance.hashHeader", "hashHeader or hashCookie is required for hash")
+					}
+				default:
+					add("balance.policy", "unknown policy %q", p.Balance.Policy)
+				}
+				if p.Balance.MaxFailures < 0 {
+					add("balance.maxFailures", "must not be negative")
+				}
+				if p.Balance.Cooldown < 0 {
+					add("balance.cooldown", "must not be negative")
+				}
+			}
+			if p.PathRewrite != nil {
+				if _, err := regexp.Compile(p.PathRewrite.Pattern); err != nil {
+					add("pathRewrite.pattern", "invalid regular expression: %v", err)
+				}
+			}
+			if len(p.TargetBasePath) > 0 && !strings.HasPrefix(p.TargetBasePath, "/") {
+				add("targetBasePath", "base path must start with /")
+			}
+		}
+
+		if len(p.Hostname) > 0 {
+			if err := validateHostname(p.Hostname); err != nil {
+				add("hostname", "%v", err)
+			}
+		}
+
+		if h := p.HealthCheck; h != nil {
+			switch h.Type {
+			case TcpCheck, HttpCheck, TlsCheck, "":
+			default:
+				add("healthCheck.type", "unknown type %q", h.Type)
+			}
+			if len(h.Path) > 0 && !strings.HasPrefix(h.Path, "/") {
+				add("healthCheck.path", "path must start with /")
+			}
+			if h.ExpectStatus != 0 && (h.ExpectStatus < 100 || h.ExpectStatus > 599) {
+				add("healthCheck.expectStatus", "invalid status %d", h.ExpectStatus)
+			}
+			if h.Interval < 0 {
+				add("healthCheck.interval", "must not be negative")
+			}
+			if h.Timeout < 0 {
+				add("healthCheck.timeout", "must not be negative")
+			}
+		}
+
+		if p.Shadow != nil {
+			if len(p.Shadow.Hostname) == 0 {
+				add("shadow.hostname", "hostname is required")
+			} else if err := validateHostname(p.Shadow.Hostname); err != nil {
+				add("shadow.hostname", "%v", err)
+			}
+			for j, path := range p.Shadow.IgnorePaths {
+				if !strings.HasPrefix(path, "$") {
+					add("shadow.ignorePaths["+strconv.Itoa(j)+"]", "JSON path must start with $")
+				}
+			}
+			if p.Shadow.Timeout < 0 {
+				add("shadow.timeout", "must not be negative")
+			}
+		}
+
+		if p.Split != nil {
+			switch p.Split.By {
+			case SplitByWeight, SplitByClientIp, "":
+			case SplitByHeader:
+				if len(p.Split.Header) == 0 {
+					add("split.header", "header is required for a header split")
+				}
+			case SplitByCookie:
+				if len(p.Split.Cookie) == 0 {
+					add("split.cookie", "cookie is required for a cookie split")
+				}
+			default:
+				add("split.by", "unknown split %q", p.Split.By)
+			}
+			if len(p.Split.Variants) < 2 {
+				add("split.variants", "at least two variants are required")
+			}
+			names := make(map[string]bool)
+			for j, variant := range p.Split.Variants {
+				field := "split.variants[" + strconv.Itoa(j) + "]"
+				if variant == nil {
+					add(field, "variant is null")
+					continue
+				}
+				if len(variant.Name) == 0 {
+					add(field+".name", "name is required")
+				} else if names[variant.Name] {
+					add(field+".name", "duplicate variant %q", variant.Name)
+				}
+				names[variant.Name] = true
+				if err := validateHostname(variant.Hostname); err != nil || len(variant.Hostname) == 0 {
+					add(field+".hostname", "invalid hostname %q", variant.Hostname)
+				}
+				if variant.Weight < 0 {
+					add(field+".weight", "must not be negative")
+				}
+			}
+		}
+
+		for j, rule := range p.Shaping {
+			field := "shaping[" + strconv.Itoa(j) + "]"
+			if rule == nil {
+				add(field, "rule is null")
+				continue
+			}
+			for k, host := range rule.Hosts {
+				if strings.Contains(host, ".*") {
+					if _, err := regexp.Compile(host); err != nil {
+						add(field+".hosts["+strconv.Itoa(k)+"]", "invalid regular expression: %v", err)
+					}
+				}
+			}
+			if rule.Latency < 0 || rule.Jitter < 0 || rule.UploadRate < 0 || rule.DownloadRate < 0 ||
+				rule.StallEvery < 0 || rule.StallFor < 0 {
+				add(field, "values must not be negative")
+			}
+			if (rule.StallEvery > 0) != (rule.StallFor > 0) {
+				add(field+".stallFor", "stallEvery and stallFor must be set together")
+			}
+			if rule.DropProbability < 0 || rule.DropProbability > 1 {
+				add(field+".dropProbability", "must be between 0 and 1")
+			}
+		}
+
+		faultNames := make(map[string]bool)
+		for j, rule := range p.Faults {
+			field := "faults[" + strconv.Itoa(j) + "]"
+			if rule == nil {
+				add(field, "rule is null")
+				continue
+			}
+			if len(rule.Name) == 0 {
+				add(field+".name", "name is required")
+			} else if faultNames[rule.Name] {
+				add(field+".name", "duplicate fault %q", rule.Name)
+			}
+			faultNames[rule.Name] = true
+			switch rule.Type {
+			case StatusFault:
+				if rule.Status < 100 || rule.Status > 599 {
+					add(field+".status", "invalid status %d", rule.Status)
+				}
+			case DelayFault:
+				if rule.Delay <= 0 {
+					add(field+".delay", "delay is required")
+				}
+			case TruncateFault, ResetFault, CorruptJsonFault, BadChunkedFault:
+			default:
+				add(field+".type", "unknown fault %q", rule.Type)
+			}
+			if len(rule.Path) > 0 {
+				if _, err := regexp.Compile(rule.Path); err != nil {
+					add(field+".path", "invalid regular expression: %v", err)
+				}
+			}
+			if rule.Probability < 0 || rule.Probability > 1 {
+				add(field+".probability", "must be between 0 and 1")
+			}
+			if rule.Match != nil {
+				for _, e := range validateMatch(rule.Match) {
+					e.Index = i
+					e.Field = field + "." + e.Field
+					errs = append(errs, e)
+				}
+			}
+		}
+
+		rewriteNames := make(map[string]bool)
+		for j, rule := range p.Rewrites {
+			field := "rewrites[" + strconv.Itoa(j) + "]"
+			if rule == nil {
+				add(field, "rule is null")
+				continue
+			}
+			if len(rule.Name) == 0 {
+				add(field+".name", "name is required")
+			} else if rewriteNames[rule.Name] {
+				add(field+".name", "duplicate rewrite %q", rule.Name)
+			}
+			rewriteNames[rule.Name] = true
+			for _, pattern := range []struct{ field, value string }{{"path", rule.Path}, {"contentType", rule.ContentType}} {
+				if len(pattern.value) > 0 {
+					if _, err := regexp.Compile(pattern.value); err != nil {
+						add(field+"."+pattern.field, "invalid regular expression: %v", err)
+					}
+				}
+			}
+			if rule.Status != 0 && (rule.Status < 100 || rule.Status > 599) {
+				add(field+".status", "invalid status %d", rule.Status)
+			}
+			switch rule.Cors {
+			case "", PermissiveCors, CredentialsCors:
+			default:
+				add(field+".cors", "unknown CORS preset %q", rule.Cors)
+			}
+			if inject := rule.Inject; inject != nil {
+				if (len(inject.Snippet) > 0) == (len(inject.File) > 0) {
+					add(field+".inject", "one of snippet or file is required")
+				}
+				if len(inject.File) > 0 && (filepath.IsAbs(inject.File) || strings.HasPrefix(filepath.Clean(inject.File), "..")) {
+					add(field+".inject.file", "file must be relative to the inject directory")
+				}
+				switch inject.Position {
+				case "", HeadEnd, BodyEnd:
+				default:
+					add(field+".inject.position", "unknown position %q", inject.Position)
+				}
+			}
+			if rule.Request != nil {
+				for _, e := range validateRewrite(rule.Request) {
+					add(field+".request."+e.Field, "%s", e.Message)
+				}
+			}
+			if rule.Response != nil {
+				for _, e := range validateRewrite(rule.Response) {
+					add(field+".response."+e.Field, "%s", e.Message)
+				}
+			}
+			if rule.Match != nil {
+				for _, e := range validateMatch(rule.Match) {
+					e.Index = i
+					e.Field = field + "." + e.Field
+					errs = append(errs, e)
+				}
+			}
+		}
+
+		if vcr := p.Vcr; vcr != nil {
+			switch vcr.Mode {
+			case VcrRecord, VcrPlayback:
+			default:
+				add("vcr.mode", "unknown mode %q", vcr.Mode)
+			}
+			if len(vcr.Cassette) == 0 {
+				add("vcr.cassette", "cassette is required")
+			} else if strings.ContainsAny(vcr.Cassette, `/\`) || strings.HasPrefix(vcr.Cassette, ".") {
+				add("vcr.cassette", "cassette must be a file name")
+			}
+			switch vcr.Miss {
+			case "", VcrFail, VcrPassthrough:
+			default:
+				add("vcr.miss", "unknown miss policy %q", vcr.Miss)
+			}
+			if vcr.Key != nil {
+				for j, name := range vcr.Key.Headers {
+					if len(name) == 0 {
+						add("vcr.key.headers["+strconv.Itoa(j)+"]", "header name is empty")
+					}
+				}
+			}
+		}
+
+		if p.Match != nil {
+			for _, e := range validateMatch(p.Match) {
+				e.Index = i
+				errs = append(errs, e)
+			}
+		}
+
+		for j, rule := range p.EndpointRules {
+			field := "endpointRules[" + strconv.Itoa(j) + "]"
+			if rule == nil {
+				add(field, "rule is null")
+				continue
+			}
+			if _, err := regexp.Compile(rule.Pattern); err != nil {
+				add(field+".pattern", "invalid regular expression: %v", err)
+			}
+			if len(rule.Name) == 0 {
+				add(field+".name", "name is required")
+			}
+		}
+	}
+	return append(listenErrs, errs...)
+}
+
+func validateMatch(m *Match) ValidationErrors {
+	errs := make(ValidationErrors, 0)
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{Field: "match." + field, Message: fmt.Sprintf(format, args...)})
+	}
+	for j, scheme := range m.Schemes {
+		if !strings.EqualFold(scheme, "http") && !strings.EqualFold(scheme, "https") {
+			add("schemes["+strconv.Itoa(j)+"]", "unknown scheme %q", scheme)
+		}
+	}
+	for j, host := range m.Hosts {
+		if strings.Contains(host, ".*") {
+			if _, err := regexp.Compile(host); err != nil {
+				add("hosts["+strconv.Itoa(j)+"]", "invalid regular expression: %v", err)
+			}
+		} else if len(host) == 0 {
+			add("hosts["+strconv.Itoa(j)+"]", "host is empty")
+		}
+	}
+	for j, method := range m.Methods {
+		if len(method) == 0 || strings.ContainsAny(method, " \t/") {
+			add("methods["+strconv.Itoa(j)+"]", "invalid method %q", method)
+		}
+	}
+	valueMatches := func(field string, list []*ValueMatch) {
+		for j, v := range list {
+			field := field + "[" + strconv.Itoa(j) + "]"
+			if v == nil {
+				add(field, "condition is null")
+				continue
+			}
+			if len(v.Name) == 0 {
+				add(field+".name", "name is required")
+			}
+			if len(v.Value) > 0 {
+				if _, err := regexp.Compile(v.Value); err != nil {
+					add(field+".value", "invalid regular expression: %v", err)
+				}
+			}
+		}
+	}
+	valueMatches("headers", m.Headers)
+	valueMatches("query", m.Query)
+	for j, cidr := range m.ClientCidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			add("clientCidrs["+strconv.Itoa(j)+"]", "invalid CIDR %q", cidr)
+		}
+	}
+	return errs
+}
+
+func validateRewrite(r *Rewrite) ValidationErrors {
+	errs := make(ValidationErrors, 0)
+	add := func(field string, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	for _, headers := range []struct {
+		field string
+		names map[string]string
+	}{{"setHeaders", r.SetHeaders}, {"addHeaders", r.AddHeaders}} {
+		for name := range headers.names {
+			if len(name) == 0 || strings.ContainsAny(name, " \t\r\n:") {
+				add(headers.field, "invalid header name %q", name)
+			}
+		}
+	}
+	for j, name := range r.RemoveHeaders {
+		if len(name) == 0 {
+			add("removeHeaders["+strconv.Itoa(j)+"]", "header name is empty")
+		}
+	}
+	for j, replace := range r.Replace {
+		field := "replace[" + strconv.Itoa(j) + "]"
+		if replace == nil {
+			add(field, "replace is null")
+			continue
+		}
+		if len(replace.Pattern) == 0 {
+			add(field+".pattern", "pattern is required")
+		} else if _, err := regexp.Compile(replace.Pattern); err != nil {
+			add(field+".pattern", "invalid regular expression: %v", err)
+		}
+	}
+	for path := range r.JsonSet {
+		if _, err := jsonpath.Parse(path); err != nil {
+			add("jsonSet", "invalid JSONPath: %v", err)
+		}
+	}
+	for j, path := range r.JsonDelete {
+		if _, err := jsonpath.Parse(path); err != nil {
+			add("jsonDelete["+strconv.Itoa(j)+"]", "invalid JSONPath: %v", err)
+		}
+	}
+	return errs
+}
+
+// Host name or IP address, optionally followed by ":port"
+func validateHostname(hostname string) error {
+	host := hostname
+	if h, port, err := net.SplitHostPort(hostname); err == nil {
+		host = h
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("invalid port in %q", hostname)
+		}
+	}
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if len(host) > 253 {
+		return fmt.Errorf("hostname %q is too long", hostname)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("invalid hostname %q", hostname)
+		}
+	}
+	return nil
+}
+
+func lineOf(data []byte, offset int) int {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// Offsets of a config object and of the fields inside it.  Field paths look
+// like "path", "match.headers[0].name".
+type configPosition struct {
+	start  int
+	fields map[string]int
+}
+
+// Offset of a field, or of its closest enclosing field that was found
+func (p *configPosition) offset(field string) int {
+	for len(field) > 0 {
+		if offset, ok := p.fields[field]; ok {
+			return offset
+		}
+		cut := strings.LastIndexAny(field, ".[")
+		if cut < 0 {
+			break
+		}
+		field = field[:cut]
+	}
+	return p.start
+}
+
+type jsonContainer struct {
+	isObject  bool
+	expectKey bool
+	key       string // current key, for objects
+	index     int    // current element, for arrays
+}
+
+// Walk the tokens of config.json, recording where each config and each of
+// its fields starts.
+func findPositions(data []byte) []*configPosition {
+	positions := make([]*configPosition, 0)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	stack := make([]*jsonContainer, 0)
+
+	// Path of the current value relative to its config, or "" when outside
+	// the configs array.
+	fieldPath := func() (string, bool) {
+		if len(stack) < 3 || stack[0].key != "configs" || stack[1].isObject {
+			return "", false
+		}
+		path := ""
+		for _, c := range stack[2:] {
+			if c.isObject {
+				if len(path) > 0 {
+					path += "."
+				}
+				path += c.key
+			} else {
+				path += "[" + strconv.Itoa(c.index) + "]"
+			}
+		}
+		return path, true
+	}
+
+	// Called after a complete value, to advance the enclosing container
+	valueDone := func() {
+		if len(stack) == 0 {
+			return
+		}
+		top := stack[len(stack)-1]
+		if top.isObject {
+			top.expectKey = true
+		} else {
+			top.index++
+		}
+	}
+
+	for {
+		offset := int(decoder.InputOffset())
+		token, err := decoder.Token()
+		if err != nil { // io.EOF or a syntax error already reported by Decode()
+			break
+		}
+		if len(stack) > 0 && stack[len(stack)-1].isObject && stack[len(stack)-1].expectKey {
+			if key, ok := token.(string); ok {
+				top := stack[len(stack)-1]
+				top.key = key
+				top.expectKey = false
+				if path, ok := fieldPath(); ok && len(positions) > 0 {
+					positions[len(positions)-1].fields[path] = offset + countSpace(data[offset:])
+				}
+				continue
+			}
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			if token == json.Delim('{') && len(stack) == 2 && stack[0].key == "configs" && !stack[1].isObject {
+				positions = append(positions, &configPosition{
+					start:  offset + countSpace(data[offset:]),
+					fields: make(map[string]int),
+				})
+			}
+			stack = append(stack, &jsonContainer{isObject: token == json.Delim('{'), expectKey: true})
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			valueDone()
+		default:
+			valueDone()
+		}
+	}
+	return positions
+}
+
+// Count leading white space and separators, which InputOffset() includes
+// before the next token.
+func countSpace(data []byte) int {
+	n := 0
+	for n < len(data) && strings.IndexByte(" \t\r\n,:", data[n]) >= 0 {
+		n++
+	}
+	return n
+}
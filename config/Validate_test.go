@@ -0,0 +1,175 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Errors of Validate(), as strings
+func validate(t *testing.T, configs string, listen []string) []string {
+	t.Helper()
+	var proxyConfigs []*ProxyConfig
+	if err := json.Unmarshal([]byte(configs), &proxyConfigs); err != nil {
+		t.Fatalf("invalid configs %s: %v", configs, err)
+	}
+	messages := make([]string, 0)
+	for _, e := range Validate(proxyConfigs, listen) {
+		messages = append(messages, e.Error())
+	}
+	return messages
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs string
+		errs    []string
+	}{
+		{"valid http", `[{"protocol":"http:","path":"/","hostname":"localhost:9000"}]`, nil},
+		{"null config", `[null]`, []string{"configs[0]: config is null"}},
+		{"unknown protocol", `[{"protocol":"ftp:"}]`, []string{`configs[0].protocol: unknown protocol "ftp:"`}},
+		{"port out of range", `[{"protocol":"tcp:","port":70000,"hostname":"db"}]`, []string{"configs[0].port: port 70000 is out of range"}},
+		{"log needs only a path", `[{"protocol":"log:","path":"app.log"}]`, nil},
+		{"log without path", `[{"protocol":"log:"}]`, []string{"configs[0].path: log name is required"}},
+		{"connection without port", `[{"protocol":"redis:","hostname":"cache"}]`, []string{"configs[0].port: port is required for redis:"}},
+		{"connection without hostname", `[{"protocol":"tcp:","port":7000}]`, []string{"configs[0].hostname: hostname is required for tcp:"}},
+		{"duplicate connection port", `[{"protocol":"tcp:","port":7000,"hostname":"a"},{"protocol":"mongo:","port":7000,"hostname":"b"}]`,
+			[]string{"configs[1].port: port 7000 is also used by configs[0]"}},
+		{"http without path", `[{"protocol":"http:","hostname":"a"}]`, []string{"configs[0].path: path is required"}},
+		{"invalid path regexp", `[{"protocol":"http:","path":"(.*","hostname":"a"}]`,
+			[]string{"configs[0].path: invalid regular expression: error parsing regexp: missing closing ): `(.*`"}},
+		{"http without upstream", `[{"protocol":"https:","path":"/"}]`, []string{"configs[0].hostname: hostname, targets or split are required for https:"}},
+		{"browser without upstream", `[{"protocol":"browser:","path":"/"}]`, nil},
+		{"invalid target", `[{"protocol":"http:","path":"/","targets":["a:0"]}]`, []string{`configs[0].targets[0]: invalid port in "a:0"`}},
+		{"invalid fault status", `[{"protocol":"http:","path":"/","hostname":"a","faults":[{"name":"f","type":"status","status":99}]}]`,
+			[]string{"configs[0].faults[0].status: invalid status 99"}},
+		{"duplicate fault", `[{"protocol":"http:","path":"/","hostname":"a","faults":[{"name":"f","type":"reset"},{"name":"f","type":"reset"}]}]`,
+			[]string{`configs[0].faults[1].name: duplicate fault "f"`}},
+		{"fault match", `[{"protocol":"http:","path":"/","hostname":"a","faults":[{"name":"f","type":"reset","match":{"headers":[{"value":"x"}]}}]}]`,
+			[]string{"configs[0].faults[0].match.headers[0].name: name is required"}},
+		{"rewrite cors", `[{"protocol":"http:","path":"/","hostname":"a","rewrites":[{"name":"r","cors":"any"}]}]`,
+			[]string{`configs[0].rewrites[0].cors: unknown CORS preset "any"`}},
+		{"rewrite inject outside directory", `[{"protocol":"http:","path":"/","hostname":"a","rewrites":[{"name":"r","inject":{"file":"../x.js"}}]}]`,
+			[]string{"configs[0].rewrites[0].inject.file: file must be relative to the inject directory"}},
+		{"rewrite json path", `[{"protocol":"http:","path":"/","hostname":"a","rewrites":[{"name":"r","response":{"jsonDelete":["id"]}}]}]`,
+			nil},
+		{"vcr cassette path", `[{"protocol":"http:","path":"/","hostname":"a","vcr":{"mode":"record","cassette":"../c"}}]`,
+			[]string{"configs[0].vcr.cassette: cassette must be a file name"}},
+		{"match scheme", `[{"protocol":"http:","path":"/","hostname":"a","match":{"schemes":["ftp"]}}]`,
+			[]string{`configs[0].match.schemes[0]: unknown scheme "ftp"`}},
+		{"match cidr", `[{"protocol":"http:","path":"/","hostname":"a","match":{"clientCidrs":["10.0.0.0"]}}]`,
+			[]string{`configs[0].match.clientCidrs[0]: invalid CIDR "10.0.0.0"`}},
+		{"endpoint rule", `[{"protocol":"http:","path":"/","hostname":"a","endpointRules":[{"pattern":"[","name":"x"}]}]`,
+			[]string{"configs[0].endpointRules[0].pattern: invalid regular expression: error parsing regexp: missing closing ]: `[`"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := validate(t, test.configs, nil)
+			if len(errs) != len(test.errs) {
+				t.Fatalf("Validate() = %q, want %q", errs, test.errs)
+			}
+			for i := range errs {
+				if errs[i] != test.errs[i] {
+					t.Errorf("Validate() = %q, want %q", errs, test.errs)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestValidateListen(t *testing.T) {
+	tcp := `[{"protocol":"tcp:","port":7000,"hostname":"db"}]`
+	tests := []struct {
+		name    string
+		listen  []string
+		configs string
+		errs    []string
+	}{
+		{"distinct ports", []string{"8888", "localhost:8889"}, `[]`, nil},
+		{"same address twice", []string{"localhost:8888", "localhost:8888"}, `[]`, []string{`listen address "localhost:8888" overlaps "localhost:8888"`}},
+		{"wildcard and specific host", []string{"8888", "127.0.0.1:8888"}, `[]`, []string{`listen address "127.0.0.1:8888" overlaps "8888"`}},
+		{"specific host and wildcard", []string{"127.0.0.1:8888", "0.0.0.0:8888"}, `[]`, []string{`listen address "0.0.0.0:8888" overlaps "127.0.0.1:8888"`}},
+		{"ipv6 wildcard", []string{"[::]:8888", "localhost:8888"}, `[]`, []string{`listen address "localhost:8888" overlaps "[::]:8888"`}},
+		{"different hosts", []string{"127.0.0.1:8888", "127.0.0.2:8888"}, `[]`, nil},
+		{"random ports", []string{"0", "localhost:0"}, `[]`, nil},
+		{"missing port", []string{"localhost"}, `[]`, []string{`listen address "localhost": address localhost: missing port in address`}},
+		{"invalid port", []string{"localhost:http"}, `[]`, []string{`listen address "localhost:http": invalid port "http"`}},
+		{"port out of range", []string{"65536"}, `[]`, []string{`listen address "65536": invalid port "65536"`}},
+		{"config port", []string{"localhost:7000"}, tcp, []string{"configs[0].port: port 7000 is also used by listen address localhost:7000"}},
+		{"other config port", []string{"8888"}, tcp, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			errs := validate(t, test.configs, test.listen)
+			if len(errs) != len(test.errs) {
+				t.Fatalf("Validate() = %q, want %q", errs, test.errs)
+			}
+			for i := range errs {
+				if errs[i] != test.errs[i] {
+					t.Errorf("Validate() = %q, want %q", errs, test.errs)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		ok       bool
+	}{
+		{"localhost", true},
+		{"localhost:8080", true},
+		{"api.example.com.", true},
+		{"my_service", true},
+		{"127.0.0.1:443", true},
+		{"[::1]:443", true},
+		{"::1", true},
+		{"a:0", false},
+		{"a:65536", false},
+		{"a:http", false},
+		{"-a.com", false},
+		{"a..com", false},
+		{"a b", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if err := validateHostname(test.hostname); (err == nil) != test.ok {
+			t.Errorf("validateHostname(%q) = %v, want ok %v", test.hostname, err, test.ok)
+		}
+	}
+}
+
+func TestValidateJsonLines(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		line int
+		err  string
+	}{
+		{"syntax error", "{\n\"configs\": [\n}", 3, "invalid character '}' looking for beginning of value"},
+		{"type error", "{\n\"configs\": [\n{\"port\": \"1\"}]}", 3, "json: cannot unmarshal string"},
+		{"field", "{\"configs\": [\n{\"protocol\": \"tcp:\",\n\"port\": 70000,\n\"hostname\": \"a\"}]}", 3, "configs[0].port: port 70000 is out of range"},
+		{"missing field", "{\"configs\": [\n{\"protocol\": \"log:\"}\n]}", 2, "configs[0].path: log name is required"},
+		{"second config", "{\"configs\": [\n{\"protocol\": \"log:\", \"path\": \"a\"},\n\n{\"protocol\": \"ftp:\"}]}", 4, `configs[1].protocol: unknown protocol "ftp:"`},
+		{"nested field", "{\"configs\": [{\"protocol\": \"http:\", \"path\": \"/\", \"hostname\": \"a\",\n\"match\": {\n\"headers\": [\n{\"name\": \"a\"},\n{\"name\": \"\"}]}}]}", 5,
+			"configs[0].match.headers[1].name: name is required"},
+		{"array element falls back to the array", "{\"configs\": [{\"protocol\": \"http:\", \"path\": \"/\", \"hostname\": \"a\",\n\"match\": {\n\"headers\": [\n{\"value\": \"x\"}]}}]}", 3,
+			"configs[0].match.headers[0].name: name is required"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, errs := ValidateJson([]byte(test.data), nil)
+			if len(errs) != 1 {
+				t.Fatalf("ValidateJson() = %v, want one error", errs)
+			}
+			if errs[0].Line != test.line || !strings.HasPrefix(errs[0].Error(), fmt.Sprintf("line %d: %s", test.line, test.err)) {
+				t.Errorf("ValidateJson() = %q, want line %d: %q", errs[0].Error(), test.line, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"goproxy/config"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var numericSegment = regexp.MustCompile(`^[0-9]+$`)
+var uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+var hashSegment = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+
+var ruleRegexps sync.Map // compiled EndpointRule patterns, key=pattern
+
+// Name the endpoint of an HTTP request.  User rules are tried first, then
+// GraphQL and JSON-RPC bodies are recognized, and anything else is named by
+// its REST path template, e.g. "/users/{id}".
+func Name(method string, rawUrl string, requestBody interface{}, rules []*config.EndpointRule) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	path := strings.ReplaceAll(u.EscapedPath(), "//", "/")
+
+	if name, ok := applyRules(method, path, rules); ok {
+		return name
+	}
+
+	if method != "OPTIONS" {
+		if name, ok := graphQL(path, u.Query(), requestBody); ok {
+			return name
+		}
+		if name, ok := jsonRpc(requestBody); ok {
+			return name
+		}
+	}
+
+	return Template(path)
+}
+
+// Replace id-like path segments (numbers, UUIDs and hex hashes) with "{id}".
+func Template(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if numericSegment.MatchString(segment) ||
+			uuidSegment.MatchString(segment) ||
+			(hashSegment.MatchString(segment) && containsDigit(segment)) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func containsDigit(s string) bool {
+	return strings.IndexAny(s, "0123456789") >= 0
+}
+
+func applyRules(method string, path string, rules []*config.EndpointRule) (string, bool) {
+	for _, rule := range rules {
+		if len(rule.Method) > 0 && !strings.EqualFold(rule.Method, method) {
+			continue
+		}
+		re := ruleRegexp(rule.Pattern)
+		if re == nil {
+			continue
+		}
+		match := re.FindStringSubmatchIndex(path)
+		if match == nil {
+			continue
+		}
+		return string(re.ExpandString(nil, rule.Name, path, match)), true
+	}
+	return "", false
+}
+
+func ruleRegexp(pattern string) *regexp.Regexp {
+	if re, ok := ruleRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("endpoint ruleRegexp() invalid pattern %q: %v\n", pattern, err)
+		return nil
+	}
+	ruleRegexps.Store(pattern, re)
+	return re
+}
+
+// GraphQL requests are POSTed to a /graphql endpoint as a single operation or
+// a batch, or sent as GET query parameters.
+func graphQL(path string, query url.Values, requestBody interface{}) (string, bool) {
+	isGraphQLPath := strings.HasSuffix(path, "/graphql") || strings.HasSuffix(path, "/graphql-public")
+
+	operations := make([]string, 0)
+	switch v := requestBody.(type) {
+	case map[string]interface{}:
+		if op, ok := graphQLOperation(v); ok {
+			operations = append(operations, op)
+		}
+	case []interface{}:
+		for i := range v {
+			if m, ok := v[i].(map[string]interface{}); ok {
+				if op, ok := graphQLOperation(m); ok {
+					operations = append(operations, op)
+				}
+			}
+		}
+	}
+
+	if len(operations) == 0 && (query.Has("query") || query.Has("extensions")) {
+		params := map[string]interface{}{
+			"query":         query.Get("query"),
+			"operationName": query.Get("operationName"),
+		}
+		var extensions interface{}
+		if err := json.Unmarshal([]byte(query.Get("extensions")), &extensions); err == nil {
+			params["extensions"] = extensions
+		}
+		if op, ok := graphQLOperation(params); ok {
+			operations = append(operations, op)
+		}
+	}
+
+	if len(operations) == 0 && !isGraphQLPath {
+		return "", false
+	}
+
+	tag := "GQL"
+	if strings.HasSuffix(path, "/graphql-public") {
+		tag = "GQLP"
+	}
+	if len(operations) == 0 {
+		return tag, true
+	}
+	return tag + " " + strings.Join(operations, ", "), true
+}
+
+// Name one GraphQL request: "query GetUser", "mutation addUser" or
+// "persisted 1a2b3c4d" for an automatic persisted query sent by hash only.
+func graphQLOperation(m map[string]interface{}) (string, bool) {
+	doc, _ := m["query"].(string)
+	operationName, _ := m["operationName"].(string)
+
+	operations := parseOperations(doc)
+	if len(operationName) > 0 {
+		for _, op := range operations {
+			if op.name == operationName {
+				return op.String(), true
+			}
+		}
+		opType := "query"
+		if len(operations) > 0 {
+			opType = operations[0].opType
+		}
+		return opType + " " + operationName, true
+	}
+	if len(operations) > 0 {
+		return operations[0].String(), true
+	}
+
+	if extensions, ok := m["extensions"].(map[string]interface{}); ok {
+		if persistedQuery, ok := extensions["persistedQuery"].(map[string]interface{}); ok {
+			if hash, ok := persistedQuery["sha256Hash"].(string); ok {
+				if len(hash) > 8 {
+					hash = hash[:8]
+				}
+				return "persisted " + hash, true
+			}
+		}
+	}
+	return "", false
+}
+
+// JSON-RPC 2.0 requests, single or batched.
+func jsonRpc(requestBody interface{}) (string, bool) {
+	methods := make([]string, 0)
+	appendMethod := func(v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok {
+			if _, ok := m["jsonrpc"]; !ok {
+				return
+			}
+			if method, ok := m["method"].(string); ok {
+				methods = append(methods, method)
+			}
+		}
+	}
+	switch v := requestBody.(type) {
+	case map[string]interface{}:
+		appendMethod(v)
+	case []interface{}:
+		for i := range v {
+			appendMethod(v[i])
+		}
+	}
+	if len(methods) == 0 {
+		return "", false
+	}
+	return "RPC " + strings.Join(methods, ", "), true
+}
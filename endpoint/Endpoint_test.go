@@ -0,0 +1,108 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"goproxy/config"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", ""},
+		{"/", "/"},
+		{"/users", "/users"},
+		{"/users/42", "/users/{id}"},
+		{"/users/42/orders/7", "/users/{id}/orders/{id}"},
+		{"/users/550e8400-e29b-41d4-a716-446655440000", "/users/{id}"},
+		{"/users/550E8400-E29B-41D4-A716-446655440000/", "/users/{id}/"},
+		{"/blobs/9f86d081884c7d65", "/blobs/{id}"},
+		{"/blobs/9f86d08188", "/blobs/9f86d08188"},             // too short for a hash
+		{"/words/deadbeefdeadbeef", "/words/deadbeefdeadbeef"}, // hex letters only
+		{"/v2/users", "/v2/users"},
+		{"/users/42abc", "/users/42abc"},
+	}
+	for _, test := range tests {
+		if got := Template(test.path); got != test.want {
+			t.Errorf("Template(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+// Request body as parseBody() leaves it
+func jsonBody(t *testing.T, body string) interface{} {
+	t.Helper()
+	if len(body) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatalf("invalid body %s: %v", body, err)
+	}
+	return v
+}
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		want   string
+	}{
+		{"rest", "GET", "http://host/users/42?x=1", "", "/users/{id}"},
+		{"double slash", "GET", "http://host//users//42", "", "/users/{id}"},
+		{"graphql operation name", "POST", "http://host/graphql", `{"query":"query GetUser { user { id } }","operationName":"GetUser"}`, "GQL query GetUser"},
+		{"graphql without operation name", "POST", "http://host/graphql", `{"query":"mutation AddUser { addUser { id } }"}`, "GQL mutation AddUser"},
+		{"graphql operation name picks the operation", "POST", "http://host/graphql", `{"query":"query A { a } mutation B { b }","operationName":"B"}`, "GQL mutation B"},
+		{"graphql operation name not in the document", "POST", "http://host/graphql", `{"query":"","operationName":"Missing"}`, "GQL query Missing"},
+		{"graphql batch", "POST", "http://host/graphql", `[{"query":"query A { a }"},{"query":"{ b }"}]`, "GQL query A, query b"},
+		{"graphql persisted query", "POST", "http://host/graphql", `{"extensions":{"persistedQuery":{"version":1,"sha256Hash":"ecf4edb46db40b5132295c0291d62fb65d6759a9eedfa4d5d612dd5ec54a6b38"}}}`, "GQL persisted ecf4edb4"},
+		{"graphql get", "GET", "http://host/graphql?query=query%20Q%20%7B%20a%20%7D", "", "GQL query Q"},
+		{"graphql get persisted", "GET", "http://host/api?extensions=%7B%22persistedQuery%22%3A%7B%22sha256Hash%22%3A%22abc%22%7D%7D", "", "GQL persisted abc"},
+		{"graphql path without operation", "POST", "http://host/graphql", `{"variables":{}}`, "GQL"},
+		{"graphql public path", "POST", "http://host/graphql-public", `{"query":"{ a }"}`, "GQLP query a"},
+		{"graphql on another path", "POST", "http://host/api", `{"query":"query Q { a }"}`, "GQL query Q"},
+		{"json-rpc", "POST", "http://host/rpc", `{"jsonrpc":"2.0","method":"eth_call","id":1}`, "RPC eth_call"},
+		{"json-rpc batch", "POST", "http://host/rpc", `[{"jsonrpc":"2.0","method":"a"},{"jsonrpc":"2.0","method":"b"}]`, "RPC a, b"},
+		{"method without jsonrpc", "POST", "http://host/rpc", `{"method":"a"}`, "/rpc"},
+		{"options skips bodies", "OPTIONS", "http://host/graphql", "", "/graphql"},
+		{"invalid url", "GET", "http://host/%zz", "", "http://host/%zz"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Name(test.method, test.url, jsonBody(t, test.body), nil); got != test.want {
+				t.Errorf("Name() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNameRules(t *testing.T) {
+	rules := []*config.EndpointRule{
+		{Pattern: "[", Name: "invalid"},
+		{Method: "POST", Pattern: `^/shop/([a-z]+)/\d+$`, Name: "shop $1"},
+		{Pattern: `^/shop/`, Name: "shop"},
+	}
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		want   string
+	}{
+		{"method and expansion", "POST", "http://host/shop/cart/7", "shop cart"},
+		{"method is case insensitive", "post", "http://host/shop/cart/7", "shop cart"},
+		{"other method", "GET", "http://host/shop/cart/7", "shop"},
+		{"no rule matches", "GET", "http://host/users/7", "/users/{id}"},
+		{"rules win over graphql", "POST", "http://host/shop/graphql", "shop"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Name(test.method, test.url, nil, rules); got != test.want {
+				t.Errorf("Name() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
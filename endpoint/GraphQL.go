@@ -0,0 +1,214 @@
+package endpoint
+
+import (
+	"strings"
+)
+
+// GraphQL operation found in a query document.
+type operation struct {
+	opType     string // query, mutation or subscription
+	name       string
+	firstField string // first root field, used to name anonymous operations
+}
+
+func (op *operation) String() string {
+	name := op.name
+	if len(name) == 0 {
+		name = op.firstField
+	}
+	if len(name) == 0 {
+		return op.opType
+	}
+	return op.opType + " " + name
+}
+
+type tokenKind int
+
+const (
+	tokenName tokenKind = iota
+	tokenPunct
+	tokenValue // strings and numbers
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+// Split a GraphQL document into tokens.  Comments, commas and whitespace are
+// dropped, and string contents are not kept.
+func tokenize(doc string) []token {
+	tokens := make([]token, 0)
+	for i := 0; i < len(doc); {
+		c := doc[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(doc) && doc[i] != '\n' && doc[i] != '\r' {
+				i++
+			}
+		case c == '"':
+			if strings.HasPrefix(doc[i:], `"""`) {
+				end := strings.Index(doc[i+3:], `"""`)
+				for end >= 0 && doc[i+3+end-1] == '\\' {
+					next := strings.Index(doc[i+3+end+3:], `"""`)
+					if next < 0 {
+						end = -1
+						break
+					}
+					end += 3 + next
+				}
+				if end < 0 {
+					i = len(doc)
+				} else {
+					i += 3 + end + 3
+				}
+			} else {
+				i++
+				for i < len(doc) && doc[i] != '"' && doc[i] != '\n' {
+					if doc[i] == '\\' {
+						i++
+					}
+					i++
+				}
+				i++
+			}
+			tokens = append(tokens, token{tokenValue, ""})
+		case c == '.' && strings.HasPrefix(doc[i:], "..."):
+			tokens = append(tokens, token{tokenPunct, "..."})
+			i += 3
+		case isNameStart(c):
+			start := i
+			for i < len(doc) && isNameContinue(doc[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenName, doc[start:i]})
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			i++
+			for i < len(doc) && (isNameContinue(doc[i]) || doc[i] == '.' || doc[i] == '+' || doc[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, token{tokenValue, doc[start:i]})
+		default:
+			tokens = append(tokens, token{tokenPunct, string(c)})
+			i++
+		}
+	}
+	return tokens
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isNameContinue(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+// Keywords starting a type system definition or extension
+var typeSystemKeywords = map[string]bool{
+	"schema": true, "scalar": true, "type": true, "interface": true, "union": true,
+	"enum": true, "input": true, "directive": true, "extend": true,
+}
+
+func isDefinitionKeyword(t token) bool {
+	if t.kind != tokenName {
+		return false
+	}
+	switch t.value {
+	case "query", "mutation", "subscription", "fragment":
+		return true
+	}
+	return typeSystemKeywords[t.value]
+}
+
+// Find the operations defined in a GraphQL document.  Fragment definitions
+// are skipped.
+func parseOperations(doc string) []*operation {
+	tokens := tokenize(doc)
+	operations := make([]*operation, 0)
+	for i := 0; i < len(tokens); {
+		t := tokens[i]
+		switch {
+		case t.kind == tokenPunct && t.value == "{":
+			op := &operation{opType: "query"}
+			op.firstField, i = skipSelectionSet(tokens, i)
+			operations = append(operations, op)
+		case t.kind == tokenName && (t.value == "query" || t.value == "mutation" || t.value == "subscription"):
+			op := &operation{opType: t.value}
+			i++
+			if i < len(tokens) && tokens[i].kind == tokenName {
+				op.name = tokens[i].value
+				i++
+			}
+			// Skip variable definitions and directives
+			for i < len(tokens) && !(tokens[i].kind == tokenPunct && tokens[i].value == "{") {
+				i++
+			}
+			op.firstField, i = skipSelectionSet(tokens, i)
+			operations = append(operations, op)
+		case t.kind == tokenName && t.value == "fragment":
+			for i < len(tokens) && !(tokens[i].kind == tokenPunct && tokens[i].value == "{") {
+				i++
+			}
+			_, i = skipSelectionSet(tokens, i)
+		case t.kind == tokenName && typeSystemKeywords[t.value]:
+			// Skip the body, if any, so it is not taken for a shorthand query
+			i++
+			for i < len(tokens) && !(tokens[i].kind == tokenPunct && tokens[i].value == "{") && !isDefinitionKeyword(tokens[i]) {
+				i++
+			}
+			if i < len(tokens) && tokens[i].value == "{" {
+				_, i = skipSelectionSet(tokens, i)
+			}
+		default:
+			// Anything unexpected
+			i++
+		}
+	}
+	return operations
+}
+
+// Skip the selection set starting at tokens[start] ("{"), returning the name
+// of its first field (aliases are resolved) and the index following the
+// closing brace.
+func skipSelectionSet(tokens []token, start int) (string, int) {
+	firstField := ""
+	depth := 0
+	i := start
+	for ; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind == tokenPunct {
+			switch t.value {
+			case "{":
+				depth++
+			case "}":
+				depth--
+				if depth == 0 {
+					return firstField, i + 1
+				}
+			}
+			continue
+		}
+		if depth == 1 && t.kind == tokenName && isAfterSpread(tokens, i) {
+			// Fragment spread or inline fragment "... on Type"
+			if t.value == "on" {
+				i++
+			}
+			continue
+		}
+		if depth == 1 && len(firstField) == 0 && t.kind == tokenName {
+			firstField = t.value
+			if i+2 < len(tokens) && tokens[i+1].value == ":" && tokens[i+2].kind == tokenName {
+				firstField = tokens[i+2].value
+			}
+		}
+	}
+	return firstField, i
+}
+
+func isAfterSpread(tokens []token, i int) bool {
+	return i > 0 && tokens[i-1].kind == tokenPunct && tokens[i-1].value == "..."
+}
@@ -0,0 +1,94 @@
+package endpoint
+
+import (
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		tokens []token
+	}{
+		{"empty", "", []token{}},
+		{"names and punctuation", "query Q { a }", []token{
+			{tokenName, "query"}, {tokenName, "Q"}, {tokenPunct, "{"}, {tokenName, "a"}, {tokenPunct, "}"},
+		}},
+		{"commas and comments", "a, # b\r\nc", []token{{tokenName, "a"}, {tokenName, "c"}}},
+		{"comment at the end", "a # b", []token{{tokenName, "a"}}},
+		{"string", `f(s: "a { b")`, []token{
+			{tokenName, "f"}, {tokenPunct, "("}, {tokenName, "s"}, {tokenPunct, ":"}, {tokenValue, ""}, {tokenPunct, ")"},
+		}},
+		{"escaped quote", `"a \" b" c`, []token{{tokenValue, ""}, {tokenName, "c"}}},
+		{"unterminated string", `"a { b`, []token{{tokenValue, ""}}},
+		{"block string", `"""a " { """ c`, []token{{tokenValue, ""}, {tokenName, "c"}}},
+		{"escaped block quote", `"""a \""" { """ c`, []token{{tokenValue, ""}, {tokenName, "c"}}},
+		{"unterminated block string", `"""a { b`, []token{{tokenValue, ""}}},
+		{"numbers", "-1.5e+3 42", []token{{tokenValue, "-1.5e+3"}, {tokenValue, "42"}}},
+		{"spread", "...F ... on T", []token{
+			{tokenPunct, "..."}, {tokenName, "F"}, {tokenPunct, "..."}, {tokenName, "on"}, {tokenName, "T"},
+		}},
+		{"variable", "$id: ID!", []token{
+			{tokenPunct, "$"}, {tokenName, "id"}, {tokenPunct, ":"}, {tokenName, "ID"}, {tokenPunct, "!"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokens := tokenize(test.doc)
+			if len(tokens) != len(test.tokens) {
+				t.Fatalf("tokenize() = %v, want %v", tokens, test.tokens)
+			}
+			for i := range tokens {
+				if tokens[i] != test.tokens[i] {
+					t.Errorf("tokenize() = %v, want %v", tokens, test.tokens)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestParseOperations(t *testing.T) {
+	tests := []struct {
+		name       string
+		doc        string
+		operations []string
+	}{
+		{"empty", "", []string{}},
+		{"named query", "query GetUser { user { id } }", []string{"query GetUser"}},
+		{"shorthand query", "{ user { id } }", []string{"query user"}},
+		{"anonymous mutation", "mutation { addUser(name: \"a\") { id } }", []string{"mutation addUser"}},
+		{"subscription", "subscription OnMessage { message { text } }", []string{"subscription OnMessage"}},
+		{"variables and directives", "query Q($id: ID! = 1) @cached(ttl: 60) { user(id: $id) { id } }", []string{"query Q"}},
+		{"alias", "{ me: user { id } }", []string{"query user"}},
+		{"fragment skipped", "fragment F on User { name } query Q { ...F }", []string{"query Q"}},
+		{"fragment spread first", "{ ...F user { id } }", []string{"query user"}},
+		{"inline fragment first", "{ ... on Query { user { id } } viewer { id } }", []string{"query viewer"}},
+		{"only fragments", "{ ...F }", []string{"query"}},
+		{"several operations", "query A { a } mutation B { b }", []string{"query A", "mutation B"}},
+		{"brace in string", "query Q { a(s: \"}\") b }", []string{"query Q"}},
+		{"brace in comment", "query Q { # }\n a }", []string{"query Q"}},
+		{"unclosed selection set", "query Q { a {", []string{"query Q"}},
+		{"type definitions ignored", "type User { id: ID }", []string{}},
+		{"schema with operations", "scalar Date union U = A | B extend type Query { a: Int } query Q { a }", []string{"query Q"}},
+		{"field named like a keyword", "query Q { type { enum } }", []string{"query Q"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			operations := parseOperations(test.doc)
+			names := make([]string, 0)
+			for _, op := range operations {
+				names = append(names, op.String())
+			}
+			if len(names) != len(test.operations) {
+				t.Fatalf("parseOperations() = %q, want %q", names, test.operations)
+			}
+			for i := range names {
+				if names[i] != test.operations[i] {
+					t.Errorf("parseOperations() = %q, want %q", names, test.operations)
+					break
+				}
+			}
+		})
+	}
+}
@@ -1,22 +1,23 @@
 package global
 
 import (
-	"net/http"
 	"sync/atomic"
-	"time"
 )
 
 var Debug bool
 var seqNum int64 = 0
 
-// HTTP client
-var transport = &http.Transport{
-	MaxIdleConns:    10,
-	IdleConnTimeout: 30 * time.Second,
-}
-
-var Client = &http.Client{Transport: transport}
-
 func NextSeq() int {
 	return int(atomic.AddInt64(&seqNum, 1))
 }
+
+// Make NextSeq() return numbers above floor, e.g. after the sequence
+// numbers of stored messages
+func SetSeqFloor(floor int) {
+	for {
+		current := atomic.LoadInt64(&seqNum)
+		if current >= int64(floor) || atomic.CompareAndSwapInt64(&seqNum, current, int64(floor)) {
+			return
+		}
+	}
+}
@@ -1,122 +1,304 @@
-package main
+// Package goproxy runs the goproxy forward and reverse proxy, with its
+// dashboard, inside a Go program.  A process may run any number of proxies.
+//
+//	p, err := goproxy.New(goproxy.Options{
+//		Listen:     []string{"localhost:8888"},
+//		MemoryCa:   true,
+//		Middleware: []interface{}{&myHooks{}},
+//	})
+//	if err == nil {
+//		err = p.Start()
+//	}
+//	...
+//	p.Stop(ctx)
+//
+// Middleware implements one or more of RequestHook, ResponseHook,
+// ConnectHook and MessageHook.
+package goproxy
 
 import (
-	"fmt"
+	"context"
+	"crypto/x509"
+	"errors"
+	"goproxy/api"
 	"goproxy/ca"
-	"goproxy/global"
+	"goproxy/capture"
+	"goproxy/config"
+	"goproxy/har"
 	"goproxy/http"
 	"goproxy/paths"
+	"log"
+	"net"
+	"net/url"
 	"os"
-	"strconv"
-	"strings"
+	"sync"
 )
 
-func usage() {
-	fmt.Println("\nUsage: goproxy [--listen [host:]port] [--debug]")
-	fmt.Println("\nOptions:")
-	fmt.Println("\t--listen - listen for incoming http connections.  Default is 8888.")
-	fmt.Println("\nExample: goproxy --listen 8888")
+// Request and response passed to RequestHook and ResponseHook
+type Exchange = http.Exchange
+
+type RequestHook = http.RequestHook
+type ResponseHook = http.ResponseHook
+type ConnectHook = http.ConnectHook
+
+// Called with every message emitted to the dashboard, including those of
+// CONNECT failures and imported HAR files, unless recording is off for its
+// config
+type MessageHook interface {
+	OnMessage(message *api.Message)
 }
 
-type Listener struct {
-	protocol string
-	host     string
-	port     string
+type Options struct {
+	Listen     []string       // addresses to listen on, e.g. "localhost:8888" or ":0"
+	Listeners  []net.Listener // listeners to accept connections on, in addition to Listen
+	ConfigFile string         // config.json loaded, watched and saved, e.g. paths.ConfigJson()
+	// Directory of the CA, cassettes, captured messages and injected files.
+	// Default is $GOPROXY_DATA_DIR.  Proxies running at the same time need
+	// their own.
+	DataDir string
+	// Configs applied at start when there is no ConfigFile.  Default is
+	// config.Default.
+	Configs      []*config.ProxyConfig
+	MemoryCa     bool            // issue certificates from a CA that only exists in memory, not the one in the data dir
+	Capture      *capture.Limits // store messages in the data dir, off when nil
+	HealthChecks bool            // probe the backend of every config
+	// Forward plain HTTP requests with an absolute URL that no http: config
+	// matches to their host, as CONNECT tunnels are
+	ForwardHttp bool
+	Middleware  []interface{} // see Proxy.Use()
 }
 
-const (
-	httpX      = "httpx:"
-	grpc       = "grpc:"
-	secureGrpc = "securegrpc:"
-)
+// One goproxy instance
+type Proxy struct {
+	options   Options
+	dataDir   paths.DataDir
+	dashboard *api.Dashboard
+	authority *ca.Authority
+	proxy     *http.Proxy
+	store     *capture.Store // nil when capture storage is off
 
-func parseArgs() []Listener {
-	listeners := make([]Listener, 0)
-	for i := 1; i < len(os.Args); i++ {
-		switch os.Args[i] {
-		case "--help":
-			usage()
-			os.Exit(1)
-		case "--listen":
-			if i+1 >= len(os.Args) {
-				usage()
-				fmt.Println("\nMissing port number for " + os.Args[i])
-			}
+	mutex     sync.Mutex
+	started   bool
+	serving   bool // listeners are being served
+	listeners []net.Listener
+	done      chan struct{} // closed when every listener has stopped
+	stopOnce  sync.Once
+}
 
-			var protocol string = httpX
-			switch os.Args[i] {
-			case "--listen":
-				protocol = httpX
-			case "--listenGrpc":
-				protocol = grpc
-			case "--listenSecureGrpc":
-				protocol = secureGrpc
-			}
-			var host string
-			var port = os.Args[i]
-			i++
-			tokens := strings.Split(port, ":")
-			if len(tokens) > 1 {
-				host = tokens[0]
-				port = tokens[1]
-			}
+var errStarted = errors.New("goproxy is already started")
+var errNoDataDir = errors.New("goproxy needs Options.DataDir or GOPROXY_DATA_DIR")
 
-			_, err := strconv.Atoi(port)
-			if err != nil {
-				usage()
-				fmt.Println("\nInvalid port: " + os.Args[i])
-				os.Exit(1)
-			}
-			listeners = append(listeners, Listener{protocol, host, port})
-		case "--debug":
-			global.Debug = true
-		default:
-			usage()
-			fmt.Println("\nInvalid option: " + os.Args[i])
-			os.Exit(1)
+// Proxy with options, which is started by Start()
+func New(options Options) (*Proxy, error) {
+	listen := append([]string{}, options.Listen...)
+	for _, listener := range options.Listeners {
+		listen = append(listen, listener.Addr().String())
+	}
+	if errs := config.Validate(options.Configs, listen); len(errs) > 0 {
+		return nil, errs
+	}
+	dataDir := paths.DataDir(options.DataDir)
+	if len(dataDir) == 0 {
+		var ok bool
+		if dataDir, ok = paths.Lookup(); !ok {
+			return nil, errNoDataDir
 		}
 	}
-	return listeners
+	if err := os.MkdirAll(string(dataDir), 0755); err != nil {
+		return nil, err
+	}
+	var authority *ca.Authority
+	var err error
+	if options.MemoryCa {
+		authority, err = ca.NewMemoryAuthority()
+	} else {
+		authority, err = ca.NewAuthority(dataDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dashboard := api.NewDashboard(options.ConfigFile)
+	dashboard.SetListen(listen)
+	p := &Proxy{
+		options:   options,
+		dataDir:   dataDir,
+		dashboard: dashboard,
+		authority: authority,
+		proxy:     http.NewProxy(dashboard, authority, dataDir),
+		done:      make(chan struct{}),
+	}
+	if options.ForwardHttp {
+		p.proxy.ForwardHttp()
+	}
+	for _, middleware := range options.Middleware {
+		p.Use(middleware)
+	}
+	return p, nil
 }
 
-func main() {
-	fmt.Println(os.Args)
+// Add middleware implementing one or more of RequestHook, ResponseHook,
+// ConnectHook and MessageHook.  Must be called before Start().
+func (p *Proxy) Use(middleware interface{}) {
+	p.proxy.Use(middleware)
+	if hook, ok := middleware.(MessageHook); ok {
+		p.dashboard.AddMessageListener(func(message *api.Message, _ []byte, _ []byte) {
+			hook.OnMessage(message)
+		})
+	}
+}
 
-	// defer func() {
-	// 	if r := recover(); r != nil {
-	// 		fmt.Println(r)
-	// 	}
-	// }()
+// Listen on the addresses, activate the configs and accept connections.
+// A proxy is started once.  On error, Stop() releases what was started.
+func (p *Proxy) Start() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.started {
+		return errStarted
+	}
+	p.started = true
 
-	listeners := parseArgs()
-	if len(listeners) == 0 {
-		listeners = append(listeners, Listener{protocol: httpX, port: "8888"})
+	listeners := append([]net.Listener{}, p.options.Listeners...)
+	for _, address := range p.options.Listen {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, l := range listeners[len(p.options.Listeners):] {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	p.listeners = listeners
+	// Random ports are known now
+	listen := make([]string, 0, len(listeners))
+	for _, listener := range listeners {
+		listen = append(listen, listener.Addr().String())
 	}
+	p.dashboard.SetListen(listen)
 
-	paths.MakeCaDir()
+	if limits := p.options.Capture; limits != nil {
+		store, err := capture.Start(p.dashboard, p.dataDir.CaptureDir(), *limits)
+		if err != nil {
+			log.Println("goproxy Start() capture", err)
+		}
+		p.store = store
+	}
+	p.proxy.Handle(har.Path, har.NewServer(p.dashboard, p.store))
+	if err := p.proxy.Start(); err != nil {
+		return err
+	}
 
-	paths.MakeCaPemSymLink()
+	// Activate the configs now, rather than waiting for a browser to send them
+	if len(p.options.ConfigFile) == 0 && len(p.options.Configs) > 0 {
+		if err := p.dashboard.ApplyConfig(p.options.Configs); err != nil {
+			return err
+		}
+	} else if err := p.dashboard.ReloadConfig(); err != nil {
+		log.Println("goproxy Start() ReloadConfig()", err)
+	}
+	p.dashboard.WatchConfig()
+	if p.options.HealthChecks {
+		p.dashboard.StartHealthChecks()
+	}
+	p.dashboard.StartVariantSummaries()
 
-	ca.InitCa()
+	p.serving = true
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		log.Printf("goproxy Start() listening on %s\n", listener.Addr())
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			if err := p.proxy.Serve(listener); err != nil {
+				log.Println("goproxy Serve()", listener.Addr(), err)
+			}
+		}(listener)
+	}
+	go func() {
+		wg.Wait()
+		close(p.done)
+	}()
+	return nil
+}
 
-	for _, entry := range listeners {
-		protocol := entry.protocol
-		host := entry.host
-		port := entry.port
+// Stop accepting connections, let in-flight exchanges finish until ctx is
+// done, then flush the dashboard and close the capture store.
+func (p *Proxy) Stop(ctx context.Context) {
+	p.stopOnce.Do(func() {
+		p.mutex.Lock()
+		if !p.serving {
+			// Start() failed or was not called, and must not serve anything now
+			p.started = true
+			for _, listener := range p.listeners {
+				listener.Close()
+			}
+			close(p.done)
+		}
+		p.mutex.Unlock()
 
-		switch protocol {
-		case httpX:
-			fmt.Printf("Listening on %s %s %s\n", protocol, host, port)
-			http.Listen(host + ":" + port)
-			// case grpc:
-			// 	GrpcProxy.forwardProxy(port, false)
-			// 	console.log(`Listening on gRPC ${host || ''} ${port}`)
-			// 	Global.portConfig.grpcPort = port
-			// case secureGrpc:
-			// 	GrpcProxy.forwardProxy(port, true)
-			// 	console.log(`Listening on secure gRPC ${host || ''} ${port}`)
-			// 	Global.portConfig.grpcSecurePort = port
+		p.proxy.Shutdown(ctx)
+		p.dashboard.Flush(ctx)
+		p.dashboard.Stop()
+		if p.store != nil {
+			p.store.Close()
 		}
+	})
+}
+
+// Closed when every listener has stopped, e.g. after Stop()
+func (p *Proxy) Done() <-chan struct{} {
+	return p.done
+}
+
+// Addresses listened on, once started
+func (p *Proxy) Addrs() []net.Addr {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	addrs := make([]net.Addr, 0, len(p.listeners))
+	for _, listener := range p.listeners {
+		addrs = append(addrs, listener.Addr())
 	}
+	return addrs
+}
+
+// http://host:port of the first listener, e.g. for http.ProxyURL().  Nil
+// before the proxy is started.
+func (p *Proxy) URL() *url.URL {
+	addrs := p.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+	return &url.URL{Scheme: "http", Host: addrs[0].String()}
+}
+
+// CA certificate that clients must trust to proxy https
+func (p *Proxy) Certificate() *x509.Certificate {
+	return p.authority.Certificate()
+}
+
+// Trust cert for https upstreams, in addition to the system roots, e.g. the
+// certificate of an httptest.NewTLSServer()
+func (p *Proxy) TrustUpstream(cert *x509.Certificate) {
+	p.proxy.TrustUpstream(cert)
+}
+
+// Validate the configs and make them active, without saving them to the
+// config file
+func (p *Proxy) ApplyConfig(proxyConfigs []*config.ProxyConfig) error {
+	return p.dashboard.ApplyConfig(proxyConfigs)
+}
+
+// Re-read the config file and the CA files, e.g. on SIGHUP
+func (p *Proxy) Reload() error {
+	configErr := p.dashboard.ReloadConfig()
+	caErr := p.authority.Reload()
+	if configErr != nil {
+		return configErr
+	}
+	return caErr
+}
 
+// Dashboard of the proxy, e.g. to read the health check history
+func (p *Proxy) Dashboard() *api.Dashboard {
+	return p.dashboard
 }
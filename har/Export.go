@@ -0,0 +1,243 @@
+package har
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"goproxy/api"
+	"goproxy/capture"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Which stored messages to export
+type Filter struct {
+	Since time.Time      // zero for any time
+	Url   *regexp.Regexp // nil for any URL
+}
+
+// Since is a duration before now, e.g. "30m", or an RFC 3339 time.  Filter
+// is a regular expression matched against the URL.
+func ParseFilter(since string, filter string) (*Filter, error) {
+	f := &Filter{}
+	if len(since) > 0 {
+		if d, err := time.ParseDuration(since); err == nil {
+			f.Since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			f.Since = t
+		} else {
+			return nil, fmt.Errorf("invalid since %q: a duration, e.g. 1h, or an RFC 3339 time is required", since)
+		}
+	}
+	if len(filter) > 0 {
+		re, err := regexp.Compile(filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %v", err)
+		}
+		f.Url = re
+	}
+	return f, nil
+}
+
+func (f *Filter) matches(message *api.Message) bool {
+	if message.Protocol != api.Http && message.Protocol != api.Https {
+		return false
+	}
+	if !f.Since.IsZero() && time.UnixMilli(int64(message.Timestamp)).Before(f.Since) {
+		return false
+	}
+	return f.Url == nil || f.Url.MatchString(message.Url)
+}
+
+// HAR of the stored messages passing the filter, oldest first
+func Export(store *capture.Store, filter *Filter) *Har {
+	entries := make([]*Entry, 0)
+	for _, seq := range store.Seqs() {
+		record := store.Get(seq)
+		if record == nil || !filter.matches(record.Message) {
+			continue
+		}
+		entries = append(entries, entry(record))
+	}
+	return &Har{Log: &Log{
+		Version: "1.2",
+		Creator: &Creator{Name: "goproxy", Version: "1.0"},
+		Entries: entries,
+	}}
+}
+
+func entry(record *capture.Record) *Entry {
+	message := record.Message
+	reqHeader := header(message.RequestHeaders)
+	resHeader := header(message.ResponseHeaders)
+
+	e := &Entry{
+		StartedDateTime: time.UnixMilli(int64(message.Timestamp)).Format(timeFormat),
+		Time:            float64(message.ElapsedTime),
+		Request: &Request{
+			Method:      message.Method,
+			Url:         message.Url,
+			HttpVersion: "HTTP/1.1",
+			Cookies:     cookies((&http.Request{Header: reqHeader}).Cookies()),
+			Headers:     nameValues(message.RequestHeaders),
+			QueryString: queryString(message.Url),
+			HeadersSize: -1,
+			BodySize:    len(record.RequestBody),
+		},
+		Response: &Response{
+			Status:      message.Status,
+			StatusText:  http.StatusText(message.Status),
+			HttpVersion: "HTTP/1.1",
+			Cookies:     cookies((&http.Response{Header: resHeader}).Cookies()),
+			Headers:     nameValues(message.ResponseHeaders),
+			Content:     content(resHeader, record.ResponseBody, message.ResponseBody),
+			RedirectUrl: resHeader.Get("location"),
+			HeadersSize: -1,
+			BodySize:    len(record.ResponseBody),
+		},
+		Cache:           map[string]interface{}{},
+		Timings:         timings(message),
+		ServerIPAddress: message.ServerHost,
+		SequenceNumber:  message.SequenceNumber,
+	}
+	if len(record.RequestBody) > 0 {
+		text, encoding := bodyText(record.RequestBody)
+		e.Request.PostData = &PostData{MimeType: reqHeader.Get("content-type"), Text: text, Encoding: encoding}
+	}
+	if message.Error != nil {
+		e.Error = message.Error.Message
+	} else if message.Type == api.Request {
+		e.Error = api.NoResponse
+	}
+	return e
+}
+
+func header(headers map[string]string) http.Header {
+	h := make(http.Header)
+	for name, value := range headers {
+		h.Add(name, value)
+	}
+	return h
+}
+
+func nameValues(headers map[string]string) []*NameValue {
+	list := make([]*NameValue, 0, len(headers))
+	for name, value := range headers {
+		list = append(list, &NameValue{Name: name, Value: value})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func cookies(httpCookies []*http.Cookie) []*Cookie {
+	list := make([]*Cookie, 0, len(httpCookies))
+	for _, c := range httpCookies {
+		cookie := &Cookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HttpOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.Format(timeFormat)
+		}
+		list = append(list, cookie)
+	}
+	return list
+}
+
+func queryString(rawUrl string) []*NameValue {
+	list := make([]*NameValue, 0)
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return list
+	}
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range query[name] {
+			list = append(list, &NameValue{Name: name, Value: value})
+		}
+	}
+	return list
+}
+
+// Response content, decoded.  Messages stored without a raw body use the
+// body shown on the dashboard.
+func content(header http.Header, raw []byte, shown interface{}) *Content {
+	c := &Content{MimeType: header.Get("content-type")}
+	if raw == nil {
+		switch v := shown.(type) {
+		case nil:
+			return c
+		case string:
+			if v == api.NoResponse {
+				return c
+			}
+			raw = []byte(v)
+		default:
+			raw, _ = json.Marshal(v)
+		}
+	}
+	body := decode(header.Get("content-encoding"), raw)
+	c.Size = len(body)
+	c.Compression = len(body) - len(raw)
+	c.Text, c.Encoding = bodyText(body)
+	return c
+}
+
+// Text bodies as is, others in base64
+func bodyText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decode(encoding string, body []byte) []byte {
+	var reader io.ReadCloser
+	var err error
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+	if err != nil {
+		return body
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+func timings(message *api.Message) *Timings {
+	t := &Timings{Blocked: -1, Dns: -1, Connect: -1, Ssl: -1, Wait: float64(message.ElapsedTime)}
+	timing := message.Timing
+	if timing == nil {
+		return t
+	}
+	t.Dns = timing.DnsLookup
+	t.Ssl = timing.TlsHandshake
+	t.Connect = timing.TcpConnect + timing.TlsHandshake
+	t.Send = timing.RequestWrite
+	t.Wait = timing.TimeToFirstByte
+	t.Receive = math.Max(0, timing.Total-t.Dns-t.Connect-t.Send-t.Wait)
+	return t
+}
@@ -0,0 +1,147 @@
+package har
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"goproxy/api"
+	"goproxy/endpoint"
+	"goproxy/global"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func Read(reader io.Reader) (*Har, error) {
+	var har Har
+	if err := json.NewDecoder(reader).Decode(&har); err != nil {
+		return nil, err
+	}
+	if har.Log == nil {
+		return nil, fmt.Errorf("not a HAR file: there is no log")
+	}
+	return &har, nil
+}
+
+// Emit each entry as a message, so it shows on the dashboard next to live
+// traffic and is stored.  Name identifies the HAR file on the messages.
+// Returns the number of messages emitted.
+func Import(dashboard *api.Dashboard, har *Har, name string) int {
+	count := 0
+	for _, e := range har.Log.Entries {
+		if e == nil || e.Request == nil {
+			continue
+		}
+		message, requestBody, responseBody := toMessage(e, name)
+		dashboard.EmitMessageWithBodies(message.Type, message, nil, requestBody, responseBody)
+		count++
+	}
+	log.Printf("Import Import() %s: %d messages\n", name, count)
+	return count
+}
+
+func toMessage(e *Entry, name string) (*api.Message, []byte, []byte) {
+	started, err := time.Parse(time.RFC3339Nano, e.StartedDateTime)
+	if err != nil {
+		started = time.Now()
+	}
+	var requestBody []byte
+	if postData := e.Request.PostData; postData != nil {
+		requestBody = decodeText(postData.Text, postData.Encoding)
+	}
+	protocol := api.Http
+	if strings.HasPrefix(e.Request.Url, "https:") {
+		protocol = api.Https
+	}
+
+	message := &api.Message{
+		Type:           api.RequestAndResponse,
+		Timestamp:      int(started.UnixMilli()),
+		SequenceNumber: global.NextSeq(),
+		RequestHeaders: headerMap(e.Request.Headers),
+		Method:         e.Request.Method,
+		Protocol:       protocol,
+		Url:            e.Request.Url,
+		RequestBody:    parse(requestBody),
+		ServerHost:     e.ServerIPAddress,
+		ElapsedTime:    int(e.Time),
+		Imported:       name,
+	}
+	message.Endpoint = endpoint.Name(message.Method, message.Url, message.RequestBody, nil)
+
+	var responseBody []byte
+	if res := e.Response; res != nil && res.Status > 0 {
+		message.Status = res.Status
+		message.ResponseHeaders = headerMap(res.Headers)
+		// The body is decoded, so its encoding no longer applies
+		for name := range message.ResponseHeaders {
+			if strings.EqualFold(name, "content-encoding") {
+				delete(message.ResponseHeaders, name)
+			}
+		}
+		if res.Content != nil {
+			responseBody = decodeText(res.Content.Text, res.Content.Encoding)
+		}
+		message.ResponseBody = parse(responseBody)
+	} else {
+		message.Type = api.Request
+		message.ResponseHeaders = map[string]string{}
+		message.ResponseBody = api.NoResponse
+	}
+	if len(e.Error) > 0 {
+		message.Error = &api.MessageError{Kind: api.OtherError, Message: e.Error}
+	}
+	if t := e.Timings; t != nil {
+		message.Timing = &api.Timing{
+			DnsLookup:       known(t.Dns),
+			TcpConnect:      known(known(t.Connect) - known(t.Ssl)),
+			TlsHandshake:    known(t.Ssl),
+			RequestWrite:    known(t.Send),
+			TimeToFirstByte: known(t.Wait),
+			Total:           e.Time,
+		}
+	}
+	return message, requestBody, responseBody
+}
+
+// Headers as shown on the dashboard: canonical names, first value
+func headerMap(list []*NameValue) map[string]string {
+	headers := make(map[string]string)
+	for _, h := range list {
+		if h == nil || strings.HasPrefix(h.Name, ":") { // HTTP/2 pseudo-headers
+			continue
+		}
+		name := http.CanonicalHeaderKey(h.Name)
+		if _, ok := headers[name]; !ok {
+			headers[name] = h.Value
+		}
+	}
+	return headers
+}
+
+func decodeText(text string, encoding string) []byte {
+	if encoding == "base64" {
+		if data, err := base64.StdEncoding.DecodeString(text); err == nil {
+			return data
+		}
+	}
+	return []byte(text)
+}
+
+// JSON bodies are shown as JSON, others as text
+func parse(body []byte) interface{} {
+	var j interface{}
+	if err := json.Unmarshal(body, &j); err == nil {
+		return j
+	}
+	return string(body)
+}
+
+func known(ms float64) float64 {
+	if ms < 0 {
+		return 0
+	}
+	return ms
+}
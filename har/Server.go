@@ -0,0 +1,94 @@
+package har
+
+import (
+	"encoding/json"
+	"errors"
+	"goproxy/api"
+	"goproxy/capture"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// Dashboard URL path: GET exports the stored messages, POST imports a HAR
+const Path = "/goproxy/har"
+
+var errNoCapture = errors.New("capture storage is off")
+
+// HAR export and import for one dashboard
+type Server struct {
+	dashboard *api.Dashboard
+	store     *capture.Store // nil when capture storage is off
+}
+
+// Handle the "har export" and "har import" socket.io events of the
+// dashboard.  Must be called before the dashboard is started.
+func NewServer(dashboard *api.Dashboard, store *capture.Store) *Server {
+	server := &Server{dashboard: dashboard, store: store}
+	dashboard.OnEvent("har export", func(s socketio.Conn, since string, filter string) {
+		data, err := server.exportJson(since, filter)
+		if err != nil {
+			log.Println("Server \"har export\"", err)
+			s.Emit("har error", err.Error())
+			return
+		}
+		s.Emit("har", string(data))
+	})
+
+	dashboard.OnEvent("har import", func(s socketio.Conn, name string, data string) {
+		har, err := Read(strings.NewReader(data))
+		if err != nil {
+			log.Println("Server \"har import\"", err)
+			s.Emit("har error", err.Error())
+			return
+		}
+		s.Emit("har imported", Import(dashboard, har, name))
+	})
+	return server
+}
+
+// GET ?since=...&filter=... returns a HAR of the stored messages.  POST
+// imports the HAR in the request body, named by ?name=...
+func (server *Server) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		query := request.URL.Query()
+		data, err := server.exportJson(query.Get("since"), query.Get("filter"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("content-disposition", `attachment; filename="goproxy.har"`)
+		w.Write(data)
+	case http.MethodPost:
+		har, err := Read(request.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := request.URL.Query().Get("name")
+		if len(name) == 0 {
+			name = "import.har"
+		}
+		w.Write([]byte(strconv.Itoa(Import(server.dashboard, har, name)) + " messages imported\n"))
+	default:
+		w.Header().Set("allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (server *Server) exportJson(since string, filter string) ([]byte, error) {
+	store := server.store
+	if store == nil {
+		return nil, errNoCapture
+	}
+	f, err := ParseFilter(since, filter)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(Export(store, f), "", "  ")
+}
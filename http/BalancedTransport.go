@@ -0,0 +1,108 @@
+package http
+
+import (
+	"errors"
+	"goproxy/upstream"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// RoundTripper spreading reverse proxy requests over the Targets of their
+// config.  When a target cannot be reached, the request fails over to the
+// next one.  Other errors are only retried for idempotent requests, which
+// may have reached the target already.
+type balancedTransport struct {
+	server *MitmServer
+}
+
+func (t *balancedTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	transport := t.server.proxy.upstreamTransport()
+	seqNum, _ := strconv.Atoi(request.Header.Get(goproxySeqHeader))
+	value, ok := t.server.seqToHttpMessageMap.Load(seqNum)
+	if !ok || t.server.isForwardProxy {
+		return transport.RoundTrip(request)
+	}
+	httpMessage := value.(*HttpMessage)
+	pool := t.server.proxy.upstreamPools.For(httpMessage.ProxyConfig)
+	if pool == nil || len(httpMessage.Variant) > 0 {
+		return transport.RoundTrip(request)
+	}
+
+	tried := make(map[string]bool)
+	var lastErr error
+	for {
+		backend := pool.Pick(request, tried)
+		if backend == nil {
+			return nil, lastErr
+		}
+		tried[backend.Address] = true
+		httpMessage.Backend = backend.Address
+
+		attempt := request
+		if len(tried) > 1 {
+			// The previous attempt consumed the body
+			if attempt, lastErr = retryRequest(request); lastErr != nil {
+				backend.Done(false)
+				return nil, lastErr
+			}
+		}
+		setHost(attempt, backend.Address)
+
+		res, err := transport.RoundTrip(attempt)
+		if err != nil {
+			log.Printf("BalancedTransport RoundTrip() seq=%d %s: %v\n", seqNum, backend.Address, err)
+			backend.Done(true)
+			lastErr = err
+			if request.Context().Err() != nil || !(isDialError(err) || isIdempotent(request)) {
+				return nil, err
+			}
+			continue
+		}
+		failed := upstream.IsFailureStatus(res.StatusCode)
+		res.Body = &backendBody{ReadCloser: res.Body, backend: backend, failed: failed}
+		return res, nil
+	}
+}
+
+// The connection to the target could not be made, so nothing was sent
+func isDialError(err error) bool {
+	var opError *net.OpError
+	return errors.As(err, &opError) && opError.Op == "dial"
+}
+
+// Methods that may be sent twice, and requests with an idempotency key
+func isIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return len(request.Header.Get("idempotency-key")) > 0
+}
+
+func retryRequest(request *http.Request) (*http.Request, error) {
+	retry := request.Clone(request.Context())
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return retry, nil
+}
+
+// Response body that releases its backend when closed, so
+// leastConnections counts requests until the response has been read.
+type backendBody struct {
+	io.ReadCloser
+	backend *upstream.Backend
+	failed  bool
+}
+
+func (b *backendBody) Close() error {
+	b.backend.Done(b.failed)
+	return b.ReadCloser.Close()
+}
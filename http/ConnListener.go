@@ -0,0 +1,82 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// net.Conn that reads through a bufio.Reader, so bytes peeked while
+// detecting the protocol are not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// net.Listener fed with connections accepted elsewhere.  Lets an http.Server
+// serve connections after the main listener has sniffed them.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Hand a connection to the http.Server accepting on this listener
+func (l *connListener) serve(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+type pipelineKey struct{}
+
+// http.Server ConnContext hook giving each connection its own request counter
+func withPipelineCounter(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, pipelineKey{}, new(int32))
+}
+
+// Position of the request on its connection: 1 for the first request, 2 for
+// the next keep-alive or pipelined request, and so on.
+func nextPipelineSeqNum(request *http.Request, fallback *int32) int32 {
+	if counter, ok := request.Context().Value(pipelineKey{}).(*int32); ok {
+		return atomic.AddInt32(counter, 1)
+	}
+	return atomic.AddInt32(fallback, 1)
+}
@@ -1,48 +1,128 @@
 package http
 
 import (
+	"goproxy/api"
 	"goproxy/config"
+	"goproxy/global"
+	"goproxy/shaping"
 	"log"
 	"net"
-	"strings"
-	"sync"
+	"net/http"
+	"time"
 )
 
-var mitmServerPool sync.Map
+// Tunnel a CONNECT request for url (host:port) to the https server for the
+// host and port.  buffered holds any bytes the client already sent through
+// the tunnel.
+func (p *Proxy) connectRequest(clientConn net.Conn, url string, buffered []byte) {
+	log.Printf("ConnectRequest() %s\n", url)
+	key := url
+	if host, port, err := net.SplitHostPort(url); err == nil && port == "443" {
+		key = host
+	}
+	p.hooks.onConnect(url)
+	mitmServer, err := p.pooledMitmServer(key, &MitmServer{
+		proxy:          p,
+		protocol:       config.Https,
+		host:           key,
+		isForwardProxy: true,
+		isSecure:       true,
+		scheme:         "https",
+	})
+	if err != nil {
+		p.connectFailed(clientConn, url, err)
+		return
+	}
 
-func ConnectRequest(clientConn net.Conn, data []byte) {
-	log.Printf("ConnectRequest() %s\n", string(data))
-	url := strings.Split(string(data), " ")[1]
-	hostPort := strings.Split(url, ":")
+	var shaper *shaping.Shaper
+	if rule := p.dashboard.FindShaping(nil, url); rule != nil {
+		shaper = shaping.New(rule)
+	}
 
-	key := hostPort[0]
-	mitmServer, ok := mitmServerPool.Load(key)
+	// Create tunnel from client to Http2HttpsServer
+	if err := p.createPipe(clientConn, mitmServer.Address(), buffered, shaper); err != nil {
+		p.connectFailed(clientConn, url, err)
+		return
+	}
+	sendConnectResponseToClient(clientConn)
+}
+
+// Forward proxy server for key from the pool.  newServer is started and
+// pooled if there is none yet.
+func (p *Proxy) pooledMitmServer(key string, newServer *MitmServer) (*MitmServer, error) {
+	mitmServer, ok := p.mitmServerPool.Load(key)
 	if !ok {
-		mitmServer = &MitmServer{
-			protocol:       config.Https,
-			host:           key,
-			isForwardProxy: true,
-			isSecure:       true,
-			scheme:         "https",
-		}
+		mitmServer = newServer
 		mitmServer.(MitmServerInf).Add(1)
 		loaded := false
-		mitmServer, loaded = mitmServerPool.LoadOrStore(key, mitmServer)
+		mitmServer, loaded = p.mitmServerPool.LoadOrStore(key, mitmServer)
 		if loaded {
 			mitmServer.(MitmServerInf).Wait()
 		} else {
-			log.Println("ConnectRequest() start https server")
-			mitmServer.(MitmServerInf).Listen()
+			log.Printf("ConnectRequest pooledMitmServer() start %s server\n", newServer.scheme)
+			if err := mitmServer.(MitmServerInf).Listen(); err != nil {
+				p.mitmServerPool.Delete(key)
+				mitmServer.(MitmServerInf).Done()
+				return nil, err
+			}
 			mitmServer.(MitmServerInf).Done()
 		}
 	} else {
-		log.Println("ConnectRequest() reuse https server")
+		log.Println("ConnectRequest pooledMitmServer() reuse server")
 		mitmServer.(MitmServerInf).Wait()
 	}
+	return mitmServer.(*MitmServer), nil
+}
 
-	// Create tunnel from client to Http2HttpsServer
-	createPipe(clientConn, mitmServer.(MitmServerInf).Address())
-	sendConnectResponseToClient(clientConn)
+// Proxy a plain HTTP request with an absolute URL to its host, through the
+// forward proxy server for the host.
+func (p *Proxy) forwardRequest(w http.ResponseWriter, request *http.Request) {
+	log.Printf("ConnectRequest forwardRequest() %s\n", request.URL.Host)
+	host := request.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	// Https servers are keyed by host and port too, so the scheme keeps these
+	// apart
+	mitmServer, err := p.pooledMitmServer("http://"+host, &MitmServer{
+		proxy:          p,
+		protocol:       config.Http,
+		host:           host,
+		isForwardProxy: true,
+		isSecure:       false,
+		scheme:         "http",
+		direct:         true,
+	})
+	if err != nil {
+		messageError := newMessageError(err)
+		writeErrorResponse(w, request, errorStatus(messageError), messageError)
+		return
+	}
+	mitmServer.ServeHTTP(w, request)
+}
+
+// Respond to a CONNECT that could not be tunnelled, and emit the error to the dashboard.
+func (p *Proxy) connectFailed(clientConn net.Conn, url string, err error) {
+	log.Printf("ConnectRequest connectFailed() %s: %v\n", url, err)
+	messageError := newMessageError(err)
+	status := errorStatus(messageError)
+	writeConnErrorResponse(clientConn, status, messageError)
+	clientConn.Close()
+
+	message := api.Message{
+		Timestamp:      int(time.Now().UnixNano() / int64(time.Millisecond)),
+		SequenceNumber: global.NextSeq(),
+		Method:         http.MethodConnect,
+		Protocol:       api.Https,
+		Url:            url,
+		Endpoint:       url,
+		ClientIp:       clientConn.RemoteAddr().String(),
+		ServerHost:     url,
+		Status:         status,
+		ResponseBody:   messageError.Message,
+		Error:          messageError,
+	}
+	p.dashboard.EmitMessageToBrowser(api.RequestAndResponse, &message, nil)
 }
 
 func sendConnectResponseToClient(clientConn net.Conn) {
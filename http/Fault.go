@@ -0,0 +1,163 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"goproxy/api"
+	"goproxy/config"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+var faultRegexps sync.Map // compiled FaultRule paths, key=pattern
+
+// First enabled fault rule matching the request that passes its probability
+// roll, or nil.
+func findFault(proxyConfig *config.ProxyConfig, request *http.Request, scheme string) *config.FaultRule {
+	for _, rule := range proxyConfig.Faults {
+		if !rule.Enabled {
+			continue
+		}
+		if len(rule.Path) > 0 {
+			re := faultRegexp(rule.Path)
+			if re == nil || !re.MatchString(request.URL.Path) {
+				continue
+			}
+		}
+		if !rule.Match.Matches(request, scheme) {
+			continue
+		}
+		if rule.Probability > 0 && rand.Float64() >= rule.Probability {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+func faultRegexp(pattern string) *regexp.Regexp {
+	if re, ok := faultRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Println("Fault faultRegexp()", err)
+		return nil
+	}
+	faultRegexps.Store(pattern, re)
+	return re
+}
+
+// Half the body, or the body made invalid JSON, for the faults applied to
+// the upstream response.  Content-Length keeps the full length when
+// truncating, so the client sees a short body.
+func faultBody(rule *config.FaultRule, header http.Header, body []byte) []byte {
+	switch rule.Type {
+	case config.TruncateFault:
+		header.Set("content-length", strconv.Itoa(len(body)))
+		return body[:len(body)/2]
+	case config.CorruptJsonFault:
+		corrupt := append([]byte("{\"goproxy\": "), bytes.TrimRight(body, " \r\n}]")...)
+		header.Set("content-length", strconv.Itoa(len(corrupt)))
+		return corrupt
+	}
+	return body
+}
+
+// Reset the client connection: close it with SO_LINGER 0, so the client
+// gets an RST rather than a FIN.  For a request through a tunnel, the
+// connection reset is the one the client opened the tunnel on.
+func resetConnection(w http.ResponseWriter, tunnel *pipe) error {
+	conn, _, err := hijack(w)
+	if err != nil {
+		return err
+	}
+	if tunnel != nil {
+		if tcpConn, ok := underlyingConn(tunnel.acceptedConn).(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		tunnel.close()
+	} else if tcpConn, ok := underlyingConn(conn).(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	return conn.Close()
+}
+
+// ResponseWriter sending the response with a bad chunk size line and no
+// final chunk.  Call close() once the response has been written.
+type badChunkedWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+func (w *badChunkedWriter) WriteHeader(status int) {
+	conn, rw, err := hijack(w.ResponseWriter)
+	if err != nil {
+		log.Println("Fault badChunkedWriter.WriteHeader()", err)
+		return
+	}
+	w.conn, w.rw = conn, rw
+	header := w.Header().Clone()
+	header.Del("content-length")
+	header.Set("transfer-encoding", "chunked")
+	header.Set("connection", "close")
+	rw.WriteString("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n")
+	header.Write(rw)
+	rw.WriteString("\r\n")
+	rw.WriteString("zz\r\n") // not a hex size
+}
+
+func (w *badChunkedWriter) Write(p []byte) (int, error) {
+	if w.conn == nil {
+		w.WriteHeader(http.StatusOK)
+		if w.conn == nil {
+			return 0, http.ErrNotSupported
+		}
+	}
+	return w.rw.Write(p)
+}
+
+func (w *badChunkedWriter) close() {
+	if w.conn != nil {
+		w.rw.Flush()
+		w.conn.Close()
+	}
+}
+
+// Hijack the connection of a possibly wrapped ResponseWriter
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	for {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			return hijacker.Hijack()
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil, nil, http.ErrNotSupported
+		}
+		w = unwrapper.Unwrap()
+	}
+}
+
+// The TCP connection under a TLS connection, or a buffered connection
+func underlyingConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		case *bufferedConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+func newInjectedFault(rule *config.FaultRule) *api.InjectedFault {
+	return &api.InjectedFault{Name: rule.Name, Type: rule.Type}
+}
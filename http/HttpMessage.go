@@ -5,15 +5,21 @@ import (
 	"goproxy/api"
 	"goproxy/config"
 	"goproxy/dns"
+	"goproxy/endpoint"
+	"goproxy/protobuf"
+	"goproxy/vcr"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
 	"time"
 )
 
 type HttpMessage struct {
+	proxy           *Proxy
+	exchange        *Exchange // passed to the middleware
 	EmitCount       int
-	StartTime       int64
+	StartTime       time.Time
+	trace           exchangeTrace
 	MessageProtocol api.MessageProtocol
 	ProxyConfig     *config.ProxyConfig
 	PipelineSeqNum  int32
@@ -23,6 +29,35 @@ type HttpMessage struct {
 	Url             string
 	ReqHeaders      http.Header
 	ReqBody         interface{}
+	Error           *api.MessageError // set when upstream failed
+	Backend         string            // target chosen by the load balancer
+	shadow          *shadowExchange   // copy sent to ProxyConfig.Shadow
+	Variant         string            // split variant serving the request
+	variantHostname string
+	stickyVariant   bool     // send the client upstream.VariantCookie
+	Shaping         []string // network shaping applied
+	Fault           *config.FaultRule
+	rewriteRules    []*config.RewriteRule // matching rewrite rules
+	Rewrites        []string              // names of the rewrite rules applied
+	cassette        *vcr.Cassette         // set when ProxyConfig.Vcr is
+	vcrKey          string
+	Cassette        string // name of the cassette recorded to or played back from
+}
+
+// Record rewrite rules applied, each name once
+func (hm *HttpMessage) addRewrites(names []string) {
+	for _, name := range names {
+		found := false
+		for _, rewrite := range hm.Rewrites {
+			if rewrite == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			hm.Rewrites = append(hm.Rewrites, name)
+		}
+	}
 }
 
 func (hm *HttpMessage) Deadline() (deadline time.Time, ok bool) {
@@ -33,6 +68,7 @@ func (hm *HttpMessage) Err() error                        { return nil }
 func (hm *HttpMessage) Value(key interface{}) interface{} { return nil }
 
 func NewHttpMessage(
+	proxy *Proxy,
 	messageProtocol api.MessageProtocol,
 	proxyConfig *config.ProxyConfig,
 	pipelineSeqNum int32,
@@ -44,7 +80,8 @@ func NewHttpMessage(
 	reqBody interface{},
 ) *HttpMessage {
 	hm := HttpMessage{
-		StartTime:       time.Now().Unix(),
+		proxy:           proxy,
+		StartTime:       time.Now(),
 		MessageProtocol: messageProtocol,
 		ProxyConfig:     proxyConfig,
 		PipelineSeqNum:  pipelineSeqNum,
@@ -63,15 +100,23 @@ func (hm *HttpMessage) EmitMessageToBrowser(
 	resHeaders http.Header,
 	resBody interface{},
 ) {
-	reqBodyJson := parseBody(hm.ReqBody)
+	urlPath := ""
+	if u, err := url.Parse(hm.Url); err == nil {
+		urlPath = u.Path
+	}
+	reqBodyJson := hm.parseBody(hm.ReqBody, hm.ReqHeaders, urlPath, true)
 	var resBodyJson interface{}
 	if resBody == api.NoResponse {
 		resBodyJson = resBody
 	} else {
-		resBodyJson = parseBody(resBody)
+		resBodyJson = hm.parseBody(resBody, resHeaders, urlPath, false)
 	}
 	host := "Unknown"
-	if hm.ProxyConfig != nil {
+	if len(hm.Backend) > 0 {
+		host = hm.Backend
+	} else if len(hm.variantHostname) > 0 {
+		host = hm.variantHostname
+	} else if hm.ProxyConfig != nil {
 		host = getHostPort(hm.ProxyConfig, hm.ReqHeaders)
 	}
 
@@ -85,28 +130,67 @@ func (hm *HttpMessage) EmitMessageToBrowser(
 	}
 	message := api.Message{
 		Type:            messageType,
-		Timestamp:       int(time.Now().Unix() - hm.StartTime),
+		Timestamp:       int(hm.StartTime.UnixNano() / int64(time.Millisecond)),
 		SequenceNumber:  hm.SequenceNumber,
 		RequestHeaders:  removeDupHeaders(hm.ReqHeaders),
 		ResponseHeaders: removeDupHeaders(resHeaders),
 		Method:          hm.Method,
 		Protocol:        hm.MessageProtocol,
 		Url:             hm.Url,
-		Endpoint:        getHttpEndpoint(hm.Method, hm.Url, reqBodyJson),
+		Endpoint:        endpoint.Name(hm.Method, hm.Url, reqBodyJson, hm.ProxyConfig.EndpointRules),
 		RequestBody:     reqBodyJson,
 		ResponseBody:    resBodyJson,
 		ClientIp:        hm.RemoteAddress,
 		ServerHost:      dns.ResolveIp(host),
 		Path:            hm.ProxyConfig.Path,
-		ElapsedTime:     int(hm.StartTime - time.Now().Unix()),
+		ElapsedTime:     int(time.Since(hm.StartTime).Milliseconds()),
 		Status:          resStatus,
 		ProxyConfig:     hm.ProxyConfig,
+		Error:           hm.Error,
+		Backend:         hm.Backend,
+		Variant:         hm.Variant,
+		Shaping:         hm.Shaping,
+		Rewrites:        hm.Rewrites,
+		Cassette:        hm.Cassette,
+	}
+	if hm.Fault != nil {
+		message.Fault = newInjectedFault(hm.Fault)
+	}
+	if messageType != api.Request {
+		message.Timing = hm.trace.timing(hm.StartTime, time.Now())
+		if len(hm.Variant) > 0 {
+			hm.proxy.dashboard.RecordVariant(hm.ProxyConfig, hm.Variant, hm.Error != nil || resStatus >= 500, time.Since(hm.StartTime))
+		}
 	}
 
-	api.EmitMessageToBrowser(messageType, &message, hm.ProxyConfig)
+	hm.proxy.dashboard.EmitMessageWithBodies(messageType, &message, hm.ProxyConfig, rawBody(hm.ReqBody), rawBody(resBody))
 	hm.EmitCount++
 }
 
+// Body as sent, for capture storage
+func rawBody(body interface{}) []byte {
+	switch v := body.(type) {
+	case []byte:
+		return v
+	case string:
+		if v != api.NoResponse {
+			return []byte(v)
+		}
+	}
+	return nil
+}
+
+// Emit the error response goproxy sent in place of the upstream response
+func (hm *HttpMessage) EmitErrorToBrowser(
+	resStatus int,
+	resHeaders http.Header,
+	resBody []byte,
+	messageError *api.MessageError,
+) {
+	hm.Error = messageError
+	hm.EmitMessageToBrowser(resStatus, resHeaders, string(resBody))
+}
+
 func removeDupHeaders(header http.Header) map[string]string {
 	out := make(map[string]string)
 	for key, values := range header {
@@ -115,10 +199,19 @@ func removeDupHeaders(header http.Header) map[string]string {
 	return out
 }
 
-func parseBody(body interface{}) interface{} {
+func (hm *HttpMessage) parseBody(body interface{}, headers http.Header, urlPath string, isRequest bool) interface{} {
 	switch v := body.(type) {
+	case []byte:
+		if decoded, ok := protobuf.DecodeBody(hm.proxy.descriptors, headers.Get("content-type"), urlPath, isRequest, v); ok {
+			return decoded
+		}
+		var j interface{}
+		if err := json.Unmarshal(v, &j); err == nil {
+			return j
+		}
+		return body
 	case string:
-		var j map[string]interface{}
+		var j interface{}
 		err := json.Unmarshal([]byte(v), &j)
 		if err != nil {
 			return v
@@ -144,49 +237,3 @@ func getHostPort(proxyConfig *config.ProxyConfig, reqHeaders http.Header) string
 		return host
 	}
 }
-
-func getHttpEndpoint(method string, url string, requestBody interface{}) string {
-	endpoint := strings.Split(url, "?")[0]
-	tokens := strings.Split(endpoint, "/")
-	if len(tokens) > 0 {
-		endpoint = tokens[len(tokens)-1]
-	}
-
-	// This is an id?
-	if _, err := strconv.Atoi(endpoint); err == nil {
-		endpoint = tokens[len(tokens)-2] + "/" + tokens[len(tokens)-1]
-	}
-
-	appendOperation := func(v interface{}) {
-		switch m := v.(type) {
-		case map[string]string:
-			if operation, ok := m["operationName"]; ok {
-				if len(endpoint) > 0 {
-					endpoint += ","
-					endpoint += " " + operation
-				}
-			}
-		}
-	}
-
-	// GraphQL?
-	if method != "OPTIONS" &&
-		(strings.HasSuffix(url, "/graphql") || strings.HasSuffix(url, "/graphql-public")) {
-		endpoint = ""
-		switch v := requestBody.(type) {
-		case map[string]interface{}:
-			appendOperation(v)
-		case []interface{}:
-			for i := range v {
-				appendOperation(v[i])
-			}
-		}
-
-		tag := "GQL"
-		if strings.HasSuffix(url, "/graphql-public") {
-			tag = "GQLP"
-		}
-		endpoint = " " + tag + endpoint
-	}
-	return endpoint
-}
@@ -2,123 +2,248 @@ package http
 
 import (
 	"bufio"
+	"crypto/x509"
+	"errors"
 	"goproxy/api"
+	"goproxy/ca"
 	"goproxy/config"
+	"goproxy/dns"
 	"goproxy/paths"
+	"goproxy/protobuf"
+	"goproxy/upstream"
+	"goproxy/vcr"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
+	"time"
 
 	socketio "github.com/googollee/go-socket.io"
 )
 
-var socketioServer *socketio.Server
-var mitmHttpsServer = &MitmServer{
-	protocol:       config.Https,
-	host:           "goproxy",
-	isForwardProxy: false,
-	isSecure:       true,
-	scheme:         "https",
-} // secure reverse proxy
-var mitmHttpServer = &MitmServer{
-	protocol:       config.Http,
-	host:           "goproxy",
-	isForwardProxy: false,
-	isSecure:       false,
-	scheme:         "http",
-} // secure reverse proxy
-
-func Listen(address string) {
+const (
+	readHeaderTimeout = 30 * time.Second
+	idleTimeout       = 120 * time.Second
+)
+
+// Listeners and servers of one goproxy instance.  A process may run any
+// number of them.
+type Proxy struct {
+	dashboard       *api.Dashboard
+	authority       *ca.Authority
+	dataDir         paths.DataDir
+	cassettes       *vcr.Library
+	descriptors     *protobuf.DescriptorFile
+	handlers        map[string]http.Handler // dashboard URL paths, see Handle()
+	hooks           hooks
+	forwardHttp     bool // see ForwardHttp()
+	socketioServer  *socketio.Server
+	mitmHttpsServer *MitmServer // secure reverse proxy
+	mitmHttpServer  *MitmServer // reverse proxy
+	startOnce       sync.Once
+	startErr        error
+	httpListener    *connListener // plain HTTP connections from every listener
+	httpServer      *http.Server
+	listeners       sync.Map       // active net.Listener set
+	mitmServerPool  sync.Map       // forward proxy servers, key=host
+	upstreamPools   upstream.Pools // balanced Targets of the configs
+	pipes           sync.Map       // active *pipe, key=tunnel address seen by the mitm servers
+	transportMutex  sync.Mutex
+	transport       *http.Transport     // nil for http.DefaultTransport, see TrustUpstream()
+	trustedCerts    []*x509.Certificate // see TrustUpstream()
+}
+
+// Proxy emitting its messages to dashboard, intercepting https with the
+// certificates of authority, and keeping its files in dataDir
+func NewProxy(dashboard *api.Dashboard, authority *ca.Authority, dataDir paths.DataDir) *Proxy {
+	p := &Proxy{
+		dashboard:   dashboard,
+		authority:   authority,
+		dataDir:     dataDir,
+		cassettes:   vcr.NewLibrary(dataDir.CassetteDir()),
+		descriptors: protobuf.NewDescriptorFile(dataDir.ProtoDescriptorSet()),
+		handlers:    make(map[string]http.Handler),
+	}
+	p.mitmHttpsServer = &MitmServer{
+		proxy:          p,
+		protocol:       config.Https,
+		host:           "goproxy",
+		isForwardProxy: false,
+		isSecure:       true,
+		scheme:         "https",
+	}
+	p.mitmHttpServer = &MitmServer{
+		proxy:          p,
+		protocol:       config.Http,
+		host:           "goproxy",
+		isForwardProxy: false,
+		isSecure:       false,
+		scheme:         "http",
+		direct:         true,
+	}
+	return p
+}
+
+// Serve a dashboard URL path, e.g. har.Path.  Must be called before Start().
+func (p *Proxy) Handle(path string, handler http.Handler) {
+	p.handlers[path] = handler
+}
+
+// Forward plain HTTP requests with an absolute URL that no http: config
+// matches to their host, as CONNECT tunnels are.  Must be called before
+// Start().
+func (p *Proxy) ForwardHttp() {
+	p.forwardHttp = true
+}
+
+// Start the dashboard socket.io server and the servers shared by all
+// listeners.  Only the first call does anything.
+func (p *Proxy) Start() error {
+	p.startOnce.Do(func() {
+		p.socketioServer = p.dashboard.Start()
+
+		// Setup https and http reverse proxy servers
+		if p.startErr = p.mitmHttpsServer.Listen(); p.startErr != nil {
+			return
+		}
+		if p.startErr = p.mitmHttpServer.Listen(); p.startErr != nil {
+			return
+		}
+
+		// Plain HTTP connections are served by an http.Server, which handles
+		// keep-alive, pipelining, large headers and bodies, and timeouts.
+		p.httpListener = newConnListener(&net.TCPAddr{})
+		p.httpServer = &http.Server{
+			Handler:           http.HandlerFunc(p.serveHttp),
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+			ConnContext:       withPipelineCounter,
+		}
+		go p.httpServer.Serve(p.httpListener)
+	})
+	return p.startErr
+}
+
+// Accept connections on address until the listener is closed.  Any number of
+// listeners may run concurrently.
+func (p *Proxy) Listen(address string) error {
 	log.Printf("Listen(%s)\n", address)
+	if err := p.Start(); err != nil {
+		return err
+	}
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Panicln(err)
+		return err
 	}
+	return p.Serve(listener)
+}
 
-	temp := api.Start()
-	socketioServer = temp
-
-	// This is causing issue with inbound connection handling
-	// http.HandleFunc("/", DashboardAppServer)
-	// go http.Serve(listener, nil)
-
-	// Setup https and http reverse proxy servers
-	mitmHttpsServer.Listen()
-	mitmHttpServer.Listen()
+// Accept connections on listener until it is closed, e.g. a listener on
+// port 0 when embedding goproxy in tests.
+func (p *Proxy) Serve(listener net.Listener) error {
+	if err := p.Start(); err != nil {
+		return err
+	}
+	p.listeners.Store(listener, true)
+	defer p.listeners.Delete(listener)
 
 	// Accept incoming connections
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Panicln(err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Println("Listen Accept()", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
 		}
-		go handleRequest(conn)
+		go p.handleRequest(conn)
 	}
 }
 
-func handleRequest(conn net.Conn) {
-	log.Printf("Listen handleRequest(%v)\n", conn)
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
+// Sniff the first bytes of a connection.  TLS goes to the https reverse
+// proxy, and everything else is HTTP in the clear.
+func (p *Proxy) handleRequest(conn net.Conn) {
+	log.Printf("Listen handleRequest(%v)\n", conn.RemoteAddr())
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	buf, err := reader.Peek(3)
+	conn.SetReadDeadline(time.Time{})
 	if err != nil {
-		log.Printf("Listen handleRequest() error %v\n%s\n", err, string(buf))
+		log.Printf("Listen handleRequest() %v\n", err)
+		conn.Close()
 		return
 	}
+	clientConn := &bufferedConn{Conn: conn, reader: reader}
 
-	if n >= len("CONNECT") && strings.HasPrefix(string(buf), "CONNECT") {
-		log.Printf("Listen handleRequest() CONNECT\n")
-		ConnectRequest(conn, buf)
-	} else {
-		log.Printf("Listen handleRequest() %v\n", string(buf))
-		if isClientHello(buf) {
-			log.Printf("Listen handleRequest() client hello: %s\n", string(buf))
-			conn, err := net.Dial("tcp", mitmHttpsServer.Address())
-			if err != nil {
-				log.Panicln(err)
-			}
-			_, err = conn.Write(buf)
-			if err != nil {
-				log.Panicln(err)
-			}
-			createPipe(conn, mitmHttpsServer.Address())
-		} else { // Assume this is just HTTP in the clear
-			log.Println("Listen handleRequest() http:\n", string(buf))
-
-			rdr := bufio.NewReader(strings.NewReader(string(buf)))
-			request, err := http.ReadRequest(rdr)
-			if err != nil {
-				log.Panicln(err)
-			}
+	if isClientHello(buf) {
+		log.Printf("Listen handleRequest() client hello\n")
+		if err := p.createPipe(clientConn, p.mitmHttpsServer.Address(), nil, nil); err != nil {
+			log.Println("Listen handleRequest()", err)
+			conn.Close()
+		}
+	} else if !p.httpListener.serve(clientConn) {
+		conn.Close()
+	}
+}
 
-			header := http.Header{}
-			headersWritten := false
-			responseWriter := connResponseWriter{conn, header, &headersWritten}
-
-			dir := filepath.Join(paths.ClientDir(), "build")
-			file := filepath.Join(dir, request.URL.Path)
-
-			if request.URL.Path == "/socket.io/" {
-				log.Println("Listen handleRequest() socket.io", request.URL.Host, request.URL.Path)
-				socketioServer.ServeHTTP(responseWriter, request)
-			} else if _, err := os.Stat(file); err == nil {
-				fs := http.FileServer(http.Dir(dir))
-				fs.ServeHTTP(responseWriter, request)
-			} else {
-				conn, err := net.Dial("tcp", mitmHttpServer.Address())
-				if err != nil {
-					log.Panicln(err)
-				}
-				_, err = conn.Write(buf)
-				if err != nil {
-					log.Panicln(err)
-				}
-				createPipe(conn, mitmHttpServer.Address())
-			}
+// Handle one HTTP request received in the clear: CONNECT tunnels, the
+// dashboard, or a request to proxy.
+func (p *Proxy) serveHttp(w http.ResponseWriter, request *http.Request) {
+	log.Printf("Listen serveHttp() %s %s\n", request.Method, request.URL)
+
+	if request.Method == http.MethodConnect {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			log.Println("Listen serveHttp() hijack", err)
+			return
+		}
+		// Anything the client sent after the CONNECT request belongs to the tunnel
+		var buffered []byte
+		if n := rw.Reader.Buffered(); n > 0 {
+			buffered, _ = rw.Reader.Peek(n)
+		}
+		p.connectRequest(conn, request.Host, buffered)
+		return
 	}
+
+	// Requests with an absolute URL are forward proxy requests, and are never
+	// for the dashboard.
+	if !request.URL.IsAbs() {
+		dir := filepath.Join(p.dataDir.ClientDir(), "build")
+		file := filepath.Join(dir, request.URL.Path)
+
+		if handler, ok := p.handlers[request.URL.Path]; ok {
+			handler.ServeHTTP(w, request)
+			return
+		} else if request.URL.Path == "/socket.io/" {
+			log.Println("Listen serveHttp() socket.io", request.URL.Host, request.URL.Path)
+			p.socketioServer.ServeHTTP(w, request)
+			return
+		} else if _, err := os.Stat(file); err == nil {
+			fs := http.FileServer(http.Dir(dir))
+			fs.ServeHTTP(w, request)
+			return
+		}
+	}
+
+	// Absolute URLs that no http: config claims are forwarded to their host,
+	// as CONNECT tunnels are
+	if p.forwardHttp && request.URL.IsAbs() &&
+		p.dashboard.FindProxyConfigMatchingRequest("http", dns.ResolveIp(request.RemoteAddr), request, false) == nil {
+		p.forwardRequest(w, request)
+		return
+	}
+
+	p.mitmHttpServer.ServeHTTP(w, request)
 }
 
 func isClientHello(buf []byte) bool {
@@ -0,0 +1,81 @@
+package http
+
+import (
+	"goproxy/config"
+	"net/http"
+)
+
+// Request and response passed to the middleware
+type Exchange struct {
+	SequenceNumber int
+	ProxyConfig    *config.ProxyConfig // config matching the request
+	Request        *http.Request
+	RequestBody    []byte // as read, nil when there is none
+	Response       *http.Response
+	ResponseBody   []byte
+}
+
+// Called before the request is proxied.  The hook may change the request
+// headers and RequestBody, or answer the request itself by setting Response
+// and ResponseBody.
+type RequestHook interface {
+	OnRequest(exchange *Exchange)
+}
+
+// Called when the upstream response is received, after the rewrite rules.
+// The hook may change the response headers and ResponseBody.
+type ResponseHook interface {
+	OnResponse(exchange *Exchange)
+}
+
+// Called when a client opens a CONNECT tunnel to host:port
+type ConnectHook interface {
+	OnConnect(host string)
+}
+
+type hooks struct {
+	request  []RequestHook
+	response []ResponseHook
+	connect  []ConnectHook
+}
+
+// Add middleware implementing one or more of RequestHook, ResponseHook and
+// ConnectHook.  Hooks run in the order they were added.  Must be called
+// before Start().
+func (p *Proxy) Use(middleware interface{}) {
+	if hook, ok := middleware.(RequestHook); ok {
+		p.hooks.request = append(p.hooks.request, hook)
+	}
+	if hook, ok := middleware.(ResponseHook); ok {
+		p.hooks.response = append(p.hooks.response, hook)
+	}
+	if hook, ok := middleware.(ConnectHook); ok {
+		p.hooks.connect = append(p.hooks.connect, hook)
+	}
+}
+
+// Run the request hooks until one sets the response
+func (h *hooks) onRequest(exchange *Exchange) {
+	for _, hook := range h.request {
+		hook.OnRequest(exchange)
+		if exchange.Response != nil {
+			return
+		}
+	}
+}
+
+func (h *hooks) hasResponseHooks() bool {
+	return len(h.response) > 0
+}
+
+func (h *hooks) onResponse(exchange *Exchange) {
+	for _, hook := range h.response {
+		hook.OnResponse(exchange)
+	}
+}
+
+func (h *hooks) onConnect(host string) {
+	for _, hook := range h.connect {
+		hook.OnConnect(host)
+	}
+}
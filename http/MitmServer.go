@@ -2,87 +2,137 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"goproxy/api"
-	"goproxy/ca"
 	"goproxy/config"
 	"goproxy/dns"
 	"goproxy/global"
+	"goproxy/rewrite"
+	"goproxy/shadow"
+	"goproxy/shaping"
+	"goproxy/upstream"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"strconv"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 const goproxySeqHeader = "goproxy-seq" // add "goproxy-seq" to request header
 
 type MitmServerInf interface {
-	Listen()
+	Listen() error
 	Address() string
 	Add(int)
 	Wait()
 	Done()
+	Shutdown(context.Context) error
 }
 
 type MitmServer struct {
+	proxy               *Proxy
 	protocol            config.ConfigProtocol
 	host                string
 	port                int
 	isForwardProxy      bool
 	isSecure            bool
+	direct              bool // ServeHTTP() is called directly, so there is no listener
 	scheme              string
 	waitGroup           sync.WaitGroup
-	pipelineCount       int32    // Use atomic.AddUint32()
+	pipelineCount       int32    // fallback when the connection has no counter, see nextPipelineSeqNum()
 	seqToHttpMessageMap sync.Map // lookup HttpMessage key=seq num
 	reverseProxy        *httputil.ReverseProxy
+	server              *http.Server
 }
 
-func (s *MitmServer) Listen() {
+// Set up the reverse proxy, and listen unless the server is direct
+func (s *MitmServer) Listen() error {
 	log.Printf("MitmServer Listen() Listen %v\n", s)
 
 	s.seqToHttpMessageMap = sync.Map{}
 
-	addr := "localhost:0"
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Panicln(err)
-	}
-	s.port = listener.Addr().(*net.TCPAddr).Port
-	log.Printf("MitmServer Listen() Listen on port %d %v", s.port, s)
-
 	// Set up reverse proxy
 	proxy := &httputil.ReverseProxy{}
 	proxy.Director = func(request *http.Request) {
 		seqNum, _ := strconv.Atoi(request.Header.Get(goproxySeqHeader))
 		httpMessage, _ := s.seqToHttpMessageMap.Load(seqNum)
-		request.URL.Scheme = s.scheme
-		host := s.host
 		if !s.isForwardProxy {
-			host = httpMessage.(*HttpMessage).ProxyConfig.Hostname
+			rewriteRequest(request, httpMessage.(*HttpMessage).ProxyConfig)
+			if variantHostname := httpMessage.(*HttpMessage).variantHostname; len(variantHostname) > 0 {
+				setHost(request, variantHostname)
+			}
+		} else {
+			request.URL.Scheme = s.scheme
+			request.URL.Host = s.host
+			request.Header.Set("host", s.host)
+		}
+		if rules := httpMessage.(*HttpMessage).rewriteRules; len(rules) > 0 {
+			httpMessage.(*HttpMessage).addRewrites(rewrite.Request(rules, request))
 		}
-		request.URL.Host = host
-		request.Header.Set("host", host)
 	}
 	proxy.ModifyResponse = func(res *http.Response) error {
 		return s.responseHandler(res)
 	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
-		log.Panicln(err)
+		s.errorHandler(w, req, err)
 	}
+	proxy.Transport = &balancedTransport{server: s}
 	s.reverseProxy = proxy
+	if s.direct {
+		return nil
+	}
+
+	addr := "localhost:0"
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.port = listener.Addr().(*net.TCPAddr).Port
+	log.Printf("MitmServer Listen() Listen on port %d %v", s.port, s)
 
 	// Start serving HTTP requests
 	mux := http.NewServeMux()
 	mux.Handle("/", s)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+		ConnContext:       withPipelineCounter,
+	}
+	s.server = server
 	if s.isSecure {
-		certFile, keyFile := ca.NewServerCertKey(s.host)
-		go http.ServeTLS(listener, mux, certFile, keyFile)
+		certHost := s.host
+		if host, _, err := net.SplitHostPort(s.host); err == nil {
+			certHost = host
+		}
+		// Fail now rather than in the TLS handshake if no certificate can be issued
+		if _, err := s.proxy.authority.ServerCertificate(certHost); err != nil {
+			listener.Close()
+			return err
+		}
+		server.TLSConfig = &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return s.proxy.authority.ServerCertificate(certHost)
+			},
+		}
+		go server.ServeTLS(listener, "", "")
 	} else {
-		go http.Serve(listener, mux)
+		go server.Serve(listener)
 	}
+	return nil
+}
+
+// Stop accepting connections and wait for active requests to complete
+func (s *MitmServer) Shutdown(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Shutdown(ctx)
 }
 
 func (s *MitmServer) Add(delta int) {
@@ -105,13 +155,19 @@ func (s *MitmServer) Address() string {
 
 // HTTP request handler
 func (s *MitmServer) ServeHTTP(w http.ResponseWriter, request *http.Request) {
-	pipelineCount := atomic.AddInt32(&s.pipelineCount, 1)
+	pipelineCount := nextPipelineSeqNum(request, &s.pipelineCount)
 	globalSeqNum := global.NextSeq()
 	log.Printf("MitmServer ServeHTTP() seq=%d pipeline=%d %s %s\n", globalSeqNum, pipelineCount, s.host, request.URL.Path)
 
+	// Requests through a tunnel are matched against the client that opened it
+	tunnel := s.proxy.tunnel(request.RemoteAddr)
+	if tunnel != nil {
+		request.RemoteAddr = tunnel.clientAddr
+	}
+
 	// Find matching proxy configuration
 	clientHostName := dns.ResolveIp(request.RemoteAddr)
-	proxyConfig := api.FindProxyConfigMatchingURL(s.isSecure, clientHostName, request.URL, s.isForwardProxy)
+	proxyConfig := s.proxy.dashboard.FindProxyConfigMatchingRequest(s.scheme, clientHostName, request, s.isForwardProxy)
 	// Always proxy forward proxy requests
 	if proxyConfig == nil && s.isForwardProxy {
 		proxyConfig = &config.ProxyConfig{
@@ -131,15 +187,35 @@ func (s *MitmServer) ServeHTTP(w http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Requests through a shaped tunnel are already rate limited, but each
+	// exchange is still delayed
+	var shapingRule *config.Shaping
+	tunneled := tunnel != nil && tunnel.shaping != nil
+	if tunneled {
+		shapingRule = tunnel.shaping
+	} else {
+		shapingRule = s.proxy.dashboard.FindShaping(proxyConfig, request.Host)
+	}
+	var shaper *shaping.Shaper
+	if shapingRule != nil {
+		shaper = shaping.New(shapingRule)
+		w = &shapedResponseWriter{ResponseWriter: w, shaper: shaper, tunneled: tunneled}
+		if !tunneled && request.Body != nil {
+			request.Body = shaper.Reader(request.Body)
+		}
+	}
+
 	// read all bytes from content body and create new stream using it.
 	var reqBody []byte
 	var err error
 	if request.Body != nil {
 		reqBody, err = io.ReadAll(request.Body)
 		if err != nil {
-			log.Panicln(err)
+			log.Printf("MitmServer ServeHTTP() seq=%d read request body: %v\n", globalSeqNum, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-		request.Body = io.NopCloser(bytes.NewBuffer(reqBody))
+		setRequestBody(request, reqBody)
 	}
 
 	messageProtocol := api.Https
@@ -147,7 +223,22 @@ func (s *MitmServer) ServeHTTP(w http.ResponseWriter, request *http.Request) {
 		messageProtocol = api.Http
 	}
 
+	exchange := &Exchange{
+		SequenceNumber: globalSeqNum,
+		ProxyConfig:    proxyConfig,
+		Request:        request,
+		RequestBody:    reqBody,
+	}
+	s.proxy.hooks.onRequest(exchange)
+	if !bytes.Equal(exchange.RequestBody, reqBody) {
+		reqBody = exchange.RequestBody
+		request.Header.Set("content-length", strconv.Itoa(len(reqBody)))
+		request.ContentLength = int64(len(reqBody))
+		setRequestBody(request, reqBody)
+	}
+
 	httpMessage := NewHttpMessage(
+		s.proxy,
 		messageProtocol,
 		proxyConfig,
 		pipelineCount,
@@ -159,13 +250,93 @@ func (s *MitmServer) ServeHTTP(w http.ResponseWriter, request *http.Request) {
 		reqBody,
 	)
 
+	if shaper != nil {
+		httpMessage.Shaping = shaper.Applied()
+	}
+	httpMessage.Fault = findFault(proxyConfig, request, s.scheme)
+	httpMessage.rewriteRules = rewrite.Matching(proxyConfig.Rewrites, request, s.scheme)
+	if proxyConfig.Vcr != nil {
+		httpMessage.startVcr(request, reqBody)
+	}
+
+	httpMessage.exchange = exchange
 	httpMessage.EmitMessageToBrowser(
 		0,
 		nil,
 		api.NoResponse,
 	)
+
+	if res := exchange.Response; res != nil {
+		log.Printf("MitmServer ServeHTTP() seq=%d answered by middleware\n", globalSeqNum)
+		for key, values := range res.Header {
+			w.Header()[key] = values
+		}
+		w.Header().Set("content-length", strconv.Itoa(len(exchange.ResponseBody)))
+		w.WriteHeader(res.StatusCode)
+		w.Write(exchange.ResponseBody)
+		httpMessage.EmitMessageToBrowser(res.StatusCode, w.Header(), exchange.ResponseBody)
+		return
+	}
+
+	if fault := httpMessage.Fault; fault != nil {
+		log.Printf("MitmServer ServeHTTP() seq=%d fault %s (%s)\n", globalSeqNum, fault.Name, fault.Type)
+		switch fault.Type {
+		case config.StatusFault:
+			for key, value := range fault.Headers {
+				w.Header().Set(key, value)
+			}
+			w.Header().Set("content-length", strconv.Itoa(len(fault.Body)))
+			w.WriteHeader(fault.Status)
+			w.Write([]byte(fault.Body))
+			httpMessage.EmitMessageToBrowser(fault.Status, w.Header(), []byte(fault.Body))
+			return
+		case config.ResetFault:
+			if err := resetConnection(w, tunnel); err != nil {
+				log.Printf("MitmServer ServeHTTP() seq=%d reset: %v\n", globalSeqNum, err)
+			}
+			messageError := &api.MessageError{Kind: api.ConnectionReset, Message: "reset by fault " + fault.Name}
+			httpMessage.EmitErrorToBrowser(0, nil, nil, messageError)
+			return
+		case config.DelayFault:
+			select {
+			case <-time.After(time.Duration(fault.Delay) * time.Millisecond):
+			case <-request.Context().Done():
+				// The client gave up waiting
+				httpMessage.EmitErrorToBrowser(0, nil, nil, newMessageError(request.Context().Err()))
+				return
+			}
+		case config.BadChunkedFault:
+			badChunked := &badChunkedWriter{ResponseWriter: w}
+			defer badChunked.close()
+			w = badChunked
+		}
+	}
+	if rule := rewrite.PreflightRule(httpMessage.rewriteRules, request); rule != nil {
+		rewrite.Cors(rule.Cors, request, w.Header())
+		w.WriteHeader(http.StatusNoContent)
+		httpMessage.addRewrites([]string{rule.Name})
+		httpMessage.EmitMessageToBrowser(http.StatusNoContent, w.Header(), []byte{})
+		return
+	}
+	if httpMessage.playback(w, request) {
+		return
+	}
+	if proxyConfig.Split != nil && !s.isForwardProxy {
+		if variant, sticky := upstream.ChooseVariant(proxyConfig.Split, request); variant != nil {
+			httpMessage.Variant = variant.Name
+			httpMessage.variantHostname = variant.Hostname
+			httpMessage.stickyVariant = sticky
+		}
+	}
+	if proxyConfig.Shadow != nil && !s.isForwardProxy {
+		httpMessage.shadow = startShadow(request, reqBody, httpMessage)
+	}
 	s.seqToHttpMessageMap.Store(globalSeqNum, httpMessage)
 	request.Header.Set(goproxySeqHeader, strconv.Itoa(int(globalSeqNum)))
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), httpMessage.trace.clientTrace()))
+	if shaper != nil {
+		shaper.Delay()
+	}
 	s.reverseProxy.ServeHTTP(w, request)
 }
 
@@ -178,15 +349,85 @@ func (s *MitmServer) responseHandler(res *http.Response) error {
 	if res.Body != nil {
 		var err error
 		resBody, err = io.ReadAll(res.Body)
+		res.Body.Close()
 		if err != nil {
-			log.Panicln(err)
+			// Reported by errorHandler
+			s.seqToHttpMessageMap.Store(seqNum, httpMessage)
+			return err
 		}
 		res.Body = io.NopCloser(bytes.NewBuffer(resBody))
 	}
+	// Upstream response as received, for the shadow comparison
+	upstreamHeader, upstreamBody := res.Header.Clone(), resBody
+	if rules := httpMessage.(*HttpMessage).rewriteRules; len(rules) > 0 {
+		var applied []string
+		resBody, applied = rewrite.Response(rules, res, resBody, s.proxy.dataDir.InjectDir())
+		httpMessage.(*HttpMessage).addRewrites(applied)
+		res.Body = io.NopCloser(bytes.NewBuffer(resBody))
+	}
+	if s.proxy.hooks.hasResponseHooks() {
+		exchange := httpMessage.(*HttpMessage).exchange
+		exchange.Response = res
+		exchange.ResponseBody = resBody
+		s.proxy.hooks.onResponse(exchange)
+		if !bytes.Equal(exchange.ResponseBody, resBody) {
+			resBody = exchange.ResponseBody
+			res.Header.Set("content-length", strconv.Itoa(len(resBody)))
+			res.ContentLength = int64(len(resBody))
+			res.Body = io.NopCloser(bytes.NewBuffer(resBody))
+		}
+	}
+	httpMessage.(*HttpMessage).record(res, resBody)
+	if fault := httpMessage.(*HttpMessage).Fault; fault != nil {
+		resBody = faultBody(fault, res.Header, resBody)
+		res.Body = io.NopCloser(bytes.NewBuffer(resBody))
+	}
+	if httpMessage.(*HttpMessage).stickyVariant {
+		res.Header.Add("set-cookie", (&http.Cookie{
+			Name:     upstream.VariantCookie,
+			Value:    httpMessage.(*HttpMessage).Variant,
+			Path:     "/",
+			HttpOnly: true,
+		}).String())
+	}
+	if httpMessage.(*HttpMessage).ProxyConfig.ServerTiming {
+		addServerTiming(res.Header, httpMessage.(*HttpMessage), time.Now())
+	}
 	httpMessage.(*HttpMessage).EmitMessageToBrowser(
 		res.StatusCode,
 		res.Header,
 		resBody,
 	)
+	if httpMessage.(*HttpMessage).shadow != nil {
+		primary := &shadow.Response{Status: res.StatusCode, Header: upstreamHeader, Body: upstreamBody}
+		go httpMessage.(*HttpMessage).compareShadow(primary, time.Since(httpMessage.(*HttpMessage).StartTime))
+	}
 	return nil
 }
+
+// Upstream error handler.  The client gets a 502 or 504, and the error is
+// emitted to the dashboard.
+func (s *MitmServer) errorHandler(w http.ResponseWriter, request *http.Request, err error) {
+	seqNum, _ := strconv.Atoi(request.Header.Get(goproxySeqHeader))
+	messageError := newMessageError(err)
+	status := errorStatus(messageError)
+	log.Printf("MitmServer errorHandler() seq=%d %s %s: %v\n", seqNum, messageError.Kind, request.URL, err)
+
+	body := writeErrorResponse(w, request, status, messageError)
+	if httpMessage, ok := s.seqToHttpMessageMap.LoadAndDelete(seqNum); ok {
+		httpMessage.(*HttpMessage).EmitErrorToBrowser(status, w.Header(), body, messageError)
+		if httpMessage.(*HttpMessage).shadow != nil {
+			primary := &shadow.Response{Status: status, Header: w.Header().Clone(), Body: body}
+			go httpMessage.(*HttpMessage).compareShadow(primary, time.Since(httpMessage.(*HttpMessage).StartTime))
+		}
+	}
+}
+
+// Replace the body of a request that was read
+func setRequestBody(request *http.Request, body []byte) {
+	request.Body = io.NopCloser(bytes.NewBuffer(body))
+	// Lets the request be retried on another backend
+	request.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
@@ -1,35 +1,117 @@
 package http
 
 import (
+	"context"
+	"goproxy/config"
+	"goproxy/shaping"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 // Create tunnel from client to goproxy https server.  The goproxy https server decrypts and captures
-// the HTTP messages, and forwards it to the origin server.
-func createPipe(clientConn net.Conn, address string) {
+// the HTTP messages, and forwards it to the origin server.  Any data already read from the client
+// is sent first.  A non-nil shaper shapes the client side of the tunnel.
+func (p *Proxy) createPipe(clientConn net.Conn, address string, data []byte, shaper *shaping.Shaper) error {
 	log.Printf("Pipe createPipe(%s)\n", address)
 	serverConn, err := net.Dial("tcp", address)
 	if err != nil {
-		log.Panicln(err)
+		return err
 	}
+	tunnel := &pipe{
+		clientConn:   clientConn,
+		acceptedConn: clientConn,
+		clientAddr:   clientConn.RemoteAddr().String(),
+		serverConn:   serverConn,
+	}
+	if shaper != nil {
+		tunnel.clientConn = shaper.Conn(clientConn)
+		tunnel.shaping = shaper.Rule()
+	}
+	// The mitm server sees the tunnel as a connection from this address
+	key := serverConn.LocalAddr().String()
+	p.pipes.Store(key, tunnel)
+	if len(data) > 0 {
+		if _, err := serverConn.Write(data); err != nil {
+			p.pipes.Delete(key)
+			serverConn.Close()
+			return err
+		}
+	}
+	clientConn = tunnel.clientConn
+	var wg sync.WaitGroup
+	wg.Add(2)
 
 	go func() {
+		defer wg.Done()
 		_, err := io.Copy(serverConn, clientConn)
 		if err != nil {
 			log.Println(err)
 		}
-		clientConn.Close()
-		serverConn.Close()
+		tunnel.close()
 	}()
 
 	go func() {
+		defer wg.Done()
 		_, err := io.Copy(clientConn, serverConn)
 		if err != nil {
 			log.Println(err)
 		}
-		clientConn.Close()
-		serverConn.Close()
+		tunnel.close()
+	}()
+
+	go func() {
+		wg.Wait()
+		p.pipes.Delete(key)
 	}()
+	return nil
+}
+
+type pipe struct {
+	clientConn   net.Conn
+	acceptedConn net.Conn        // clientConn before shaping
+	clientAddr   string          // address of the client, rather than of the pipe
+	shaping      *config.Shaping // set when the client side is shaped
+	serverConn   net.Conn
+}
+
+// Tunnel a request received by a mitm server arrived through, or nil
+func (p *Proxy) tunnel(remoteAddr string) *pipe {
+	if tunnel, ok := p.pipes.Load(remoteAddr); ok {
+		return tunnel.(*pipe)
+	}
+	return nil
+}
+
+func (p *pipe) close() {
+	p.clientConn.Close()
+	p.serverConn.Close()
+}
+
+// Wait for the active pipes to close, and close any still open when ctx is done.
+func (p *Proxy) closePipes(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		count := 0
+		p.pipes.Range(func(_ interface{}, _ interface{}) bool {
+			count++
+			return true
+		})
+		if count == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("Pipe closePipes() closing", count)
+			p.pipes.Range(func(_ interface{}, value interface{}) bool {
+				value.(*pipe).close()
+				return true
+			})
+			return
+		case <-ticker.C:
+		}
+	}
 }
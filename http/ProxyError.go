@@ -0,0 +1,107 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"goproxy/api"
+	"html"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Classify an upstream error for the dashboard
+func classifyError(err error) api.ErrorKind {
+	var dnsError *net.DNSError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var certificateInvalidError x509.CertificateInvalidError
+	var recordHeaderError tls.RecordHeaderError
+	var netError net.Error
+
+	switch {
+	case errors.As(err, &dnsError):
+		if dnsError.IsTimeout {
+			return api.Timeout
+		}
+		return api.DnsError
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return api.ConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		return api.ConnectionReset
+	case errors.As(err, &unknownAuthorityError) ||
+		errors.As(err, &hostnameError) ||
+		errors.As(err, &certificateInvalidError) ||
+		errors.As(err, &recordHeaderError) ||
+		strings.Contains(err.Error(), "tls: ") ||
+		strings.Contains(err.Error(), "x509: "):
+		return api.TlsError
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netError) && netError.Timeout()):
+		return api.Timeout
+	case errors.Is(err, context.Canceled):
+		return api.Canceled
+	}
+	return api.OtherError
+}
+
+func newMessageError(err error) *api.MessageError {
+	return &api.MessageError{Kind: classifyError(err), Message: err.Error()}
+}
+
+// Timeouts are reported as 504 Gateway Timeout, everything else as 502 Bad Gateway
+func errorStatus(messageError *api.MessageError) int {
+	if messageError.Kind == api.Timeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// Clients asking for JSON get a JSON error body, everyone else gets HTML.
+func wantsJson(header http.Header) bool {
+	accept := header.Get("accept")
+	if strings.Contains(accept, "json") && !strings.Contains(accept, "text/html") {
+		return true
+	}
+	return strings.Contains(header.Get("content-type"), "json")
+}
+
+func errorBody(status int, messageError *api.MessageError, asJson bool) (contentType string, body []byte) {
+	if asJson {
+		body, _ = json.Marshal(map[string]interface{}{
+			"status":  status,
+			"error":   messageError.Kind,
+			"message": messageError.Message,
+		})
+		return "application/json", body
+	}
+	body = []byte("<h1>" + strconv.Itoa(status) + " " + http.StatusText(status) + "</h1>" +
+		"<p>goproxy " + string(messageError.Kind) + ": " + html.EscapeString(messageError.Message) + "</p>")
+	return "text/html; charset=utf-8", body
+}
+
+// Write an error response, returning the body written
+func writeErrorResponse(w http.ResponseWriter, request *http.Request, status int, messageError *api.MessageError) []byte {
+	contentType, body := errorBody(status, messageError, wantsJson(request.Header))
+	w.Header().Set("content-type", contentType)
+	w.Header().Set("content-length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+	return body
+}
+
+// Write an error response directly to a client connection that has not been
+// handed to an http.Server, e.g. a failed CONNECT.
+func writeConnErrorResponse(conn net.Conn, status int, messageError *api.MessageError) {
+	contentType, body := errorBody(status, messageError, false)
+	conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n" +
+		"\r\n"))
+	conn.Write(body)
+}
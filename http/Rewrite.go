@@ -0,0 +1,97 @@
+package http
+
+import (
+	"goproxy/config"
+	"goproxy/upstream"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var rewriteRegexps sync.Map // compiled Path and PathRewrite patterns, key=pattern
+
+// Point a reverse proxy request at the config's upstream: scheme, host and
+// port, and the path after StripPrefix, PathRewrite and TargetBasePath.
+func rewriteRequest(request *http.Request, proxyConfig *config.ProxyConfig) {
+	request.URL.Scheme = upstreamScheme(proxyConfig)
+	setHost(request, upstreamHost(proxyConfig))
+
+	path := upstreamPath(proxyConfig, request.URL.Path)
+	if path != request.URL.Path {
+		request.URL.Path = path
+		request.URL.RawPath = ""
+	}
+}
+
+// "https" for secure and https: configs, otherwise "http"
+func upstreamScheme(proxyConfig *config.ProxyConfig) string {
+	if proxyConfig.IsSecure || proxyConfig.Protocol == config.Https {
+		return "https"
+	}
+	return "http"
+}
+
+// Hostname, with Port appended when the hostname has no port of its own.
+// Configs with Targets get their host from the load balancer instead, see
+// balancedTransport.
+func upstreamHost(proxyConfig *config.ProxyConfig) string {
+	if len(proxyConfig.Targets) > 0 {
+		return upstream.Address(proxyConfig.Targets[0], proxyConfig.Port)
+	}
+	return upstream.Address(proxyConfig.Hostname, proxyConfig.Port)
+}
+
+func setHost(request *http.Request, host string) {
+	request.URL.Host = host
+	request.Host = host
+	request.Header.Set("host", host)
+}
+
+func upstreamPath(proxyConfig *config.ProxyConfig, path string) string {
+	if proxyConfig.StripPrefix {
+		path = stripPrefix(proxyConfig.Path, path)
+	}
+	if proxyConfig.PathRewrite != nil {
+		if re := rewriteRegexp(proxyConfig.PathRewrite.Pattern); re != nil {
+			path = re.ReplaceAllString(path, proxyConfig.PathRewrite.Replacement)
+		}
+	}
+	if len(proxyConfig.TargetBasePath) > 0 {
+		path = strings.TrimSuffix(proxyConfig.TargetBasePath, "/") + "/" + strings.TrimPrefix(path, "/")
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// Remove the part of path matched by the config Path.  Regular expressions
+// (paths containing ".*") must match at the start of the path.
+func stripPrefix(configPath string, path string) string {
+	if strings.Contains(configPath, ".*") {
+		re := rewriteRegexp(configPath)
+		if re == nil {
+			return path
+		}
+		if loc := re.FindStringIndex(path); loc != nil && loc[0] == 0 {
+			return path[loc[1]:]
+		}
+		return path
+	}
+	return strings.TrimPrefix(path, configPath)
+}
+
+func rewriteRegexp(pattern string) *regexp.Regexp {
+	if re, ok := rewriteRegexps.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Println("Rewrite rewriteRegexp()", err)
+		return nil
+	}
+	rewriteRegexps.Store(pattern, re)
+	return re
+}
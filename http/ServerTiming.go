@@ -0,0 +1,31 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const serverTimingHeader = "Server-Timing"
+
+// Add upstream time to first byte, upstream total time and the time spent in
+// goproxy to the Server-Timing header.  Metrics sent by the origin are kept.
+func addServerTiming(header http.Header, hm *HttpMessage, end time.Time) {
+	upstreamStart := hm.trace.upstreamStart()
+
+	upstreamTotal := milliseconds(upstreamStart, end)
+	overhead := milliseconds(hm.StartTime, end) - upstreamTotal
+	if overhead < 0 {
+		overhead = 0
+	}
+	metrics := fmt.Sprintf(
+		`goproxy-upstream-ttfb;dur=%.1f;desc="Upstream TTFB", goproxy-upstream-total;dur=%.1f;desc="Upstream total", goproxy;dur=%.1f;desc="goproxy overhead"`,
+		milliseconds(upstreamStart, hm.trace.firstByteTime()),
+		upstreamTotal,
+		overhead,
+	)
+
+	values := append(header.Values(serverTimingHeader), metrics)
+	header.Set(serverTimingHeader, strings.Join(values, ", "))
+}
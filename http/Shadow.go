@@ -0,0 +1,128 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"goproxy/api"
+	"goproxy/endpoint"
+	"goproxy/shadow"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultShadowTimeout = 30 * time.Second
+
+// Headers not copied to the shadow request
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", goproxySeqHeader,
+}
+
+var shadowClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Copy of a request sent to the shadow upstream
+type shadowExchange struct {
+	done     chan struct{}
+	address  string
+	response *shadow.Response
+	err      error
+	elapsed  time.Duration
+}
+
+// Send a copy of the request to the config's shadow upstream.  The client
+// never waits for it.
+func startShadow(request *http.Request, reqBody []byte, httpMessage *HttpMessage) *shadowExchange {
+	settings := httpMessage.ProxyConfig.Shadow
+	exchange := &shadowExchange{done: make(chan struct{}), address: settings.Hostname}
+
+	shadowUrl := *request.URL
+	shadowUrl.Scheme = "http"
+	if settings.IsSecure {
+		shadowUrl.Scheme = "https"
+	}
+	shadowUrl.Host = settings.Hostname
+	shadowUrl.Path = upstreamPath(httpMessage.ProxyConfig, request.URL.Path)
+	shadowUrl.RawPath = ""
+
+	timeout := defaultShadowTimeout
+	if settings.Timeout > 0 {
+		timeout = time.Duration(settings.Timeout) * time.Second
+	}
+	header := request.Header.Clone()
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+
+	go func() {
+		defer close(exchange.done)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		shadowRequest, err := http.NewRequestWithContext(ctx, request.Method, shadowUrl.String(), bytes.NewReader(reqBody))
+		if err != nil {
+			exchange.err = err
+			return
+		}
+		shadowRequest.Header = header
+		shadowRequest.Host = settings.Hostname
+
+		start := time.Now()
+		res, err := shadowClient.Do(shadowRequest)
+		if err != nil {
+			exchange.err = err
+			exchange.elapsed = time.Since(start)
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		exchange.elapsed = time.Since(start)
+		if err != nil {
+			exchange.err = err
+			return
+		}
+		exchange.response = &shadow.Response{Status: res.StatusCode, Header: res.Header, Body: body}
+	}()
+	return exchange
+}
+
+// Wait for the shadow response, and emit a "shadow diff" if it differs from
+// the primary response.
+func (hm *HttpMessage) compareShadow(primary *shadow.Response, primaryElapsed time.Duration) {
+	exchange := hm.shadow
+	<-exchange.done
+
+	urlPath := ""
+	if u, err := url.Parse(hm.Url); err == nil {
+		urlPath = u.Path
+	}
+	diff := &api.ShadowDiff{
+		SequenceNumber: hm.SequenceNumber,
+		Timestamp:      int(hm.StartTime.UnixNano() / int64(time.Millisecond)),
+		Method:         hm.Method,
+		Url:            hm.Url,
+		Endpoint:       endpoint.Name(hm.Method, hm.Url, hm.parseBody(hm.ReqBody, hm.ReqHeaders, urlPath, true), hm.ProxyConfig.EndpointRules),
+		Shadow:         exchange.address,
+		PrimaryStatus:  primary.Status,
+		PrimaryElapsed: int(primaryElapsed.Milliseconds()),
+		ShadowElapsed:  int(exchange.elapsed.Milliseconds()),
+		Differences:    make([]*api.Difference, 0),
+	}
+	if exchange.err != nil {
+		diff.Error = newMessageError(exchange.err)
+	} else {
+		diff.ShadowStatus = exchange.response.Status
+		diff.Differences = shadow.Compare(primary, exchange.response, hm.ProxyConfig.Shadow)
+		if len(diff.Differences) == 0 {
+			return
+		}
+	}
+	log.Printf("Shadow compareShadow() seq=%d %s %s: %d differences, error=%v\n",
+		hm.SequenceNumber, hm.Method, hm.Url, len(diff.Differences), exchange.err)
+	hm.proxy.dashboard.EmitShadowDiff(diff, hm.ProxyConfig)
+}
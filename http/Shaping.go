@@ -0,0 +1,63 @@
+package http
+
+import (
+	"goproxy/shaping"
+	"net/http"
+)
+
+// http.ResponseWriter that may drop the connection part way through the
+// body.  Unless the exchange is in a tunnel that is already shaped, it is
+// also limited to the download rate.
+type shapedResponseWriter struct {
+	http.ResponseWriter
+	shaper   *shaping.Shaper
+	tunneled bool
+	dropped  bool
+}
+
+func (w *shapedResponseWriter) Write(p []byte) (int, error) {
+	if w.shaper.Drop() && !w.dropped {
+		// Send half the body, then abort the connection
+		w.dropped = true
+		w.write(p[:len(p)/2])
+		if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+	return w.write(p)
+}
+
+func (w *shapedResponseWriter) write(p []byte) (int, error) {
+	if w.tunneled {
+		return w.ResponseWriter.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := len(p)
+		if max := w.shaper.DownloadChunk(); chunk > max {
+			chunk = max
+		}
+		w.shaper.Download(chunk)
+		n, err := w.ResponseWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+func (w *shapedResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *shapedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,47 @@
+package http
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+)
+
+// Stop accepting connections, and let in-flight exchanges finish until ctx
+// is done.  Tunnels still open after that are closed.
+func (p *Proxy) Shutdown(ctx context.Context) {
+	log.Println("Shutdown()")
+	p.listeners.Range(func(key interface{}, _ interface{}) bool {
+		key.(net.Listener).Close()
+		return true
+	})
+
+	var wg sync.WaitGroup
+	shutdown := func(name string, f func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(ctx); err != nil {
+				log.Println("Shutdown()", name, err)
+			}
+		}()
+	}
+	if p.httpServer != nil {
+		shutdown("http", p.httpServer.Shutdown)
+	}
+	shutdown("https reverse proxy", p.mitmHttpsServer.Shutdown)
+	shutdown("http reverse proxy", p.mitmHttpServer.Shutdown)
+	p.mitmServerPool.Range(func(key interface{}, value interface{}) bool {
+		shutdown(key.(string), value.(MitmServerInf).Shutdown)
+		return true
+	})
+	wg.Wait()
+
+	p.closePipes(ctx)
+
+	p.transportMutex.Lock()
+	if p.transport != nil {
+		p.transport.CloseIdleConnections()
+	}
+	p.transportMutex.Unlock()
+}
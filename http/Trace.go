@@ -0,0 +1,89 @@
+package http
+
+import (
+	"crypto/tls"
+	"goproxy/api"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Upstream connection and request timestamps captured with net/http/httptrace
+type exchangeTrace struct {
+	mutex        sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+}
+
+func (t *exchangeTrace) clientTrace() *httptrace.ClientTrace {
+	set := func(field *time.Time) {
+		t.mutex.Lock()
+		*field = time.Now()
+		t.mutex.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { set(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { set(&t.dnsDone) },
+		ConnectStart: func(network, addr string) {
+			t.mutex.Lock()
+			if t.connectStart.IsZero() { // dual stack dialing may connect more than once
+				t.connectStart = time.Now()
+			}
+			t.mutex.Unlock()
+		},
+		ConnectDone:          func(network, addr string, err error) { set(&t.connectDone) },
+		TLSHandshakeStart:    func() { set(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&t.tlsDone) },
+		GotConn:              func(httptrace.GotConnInfo) { set(&t.gotConn) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { set(&t.wroteRequest) },
+		GotFirstResponseByte: func() { set(&t.firstByte) },
+	}
+}
+
+// Phase durations in milliseconds.  Phases that did not happen, such as DNS
+// and connect on a reused connection, are zero.
+func (t *exchangeTrace) timing(start time.Time, end time.Time) *api.Timing {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return &api.Timing{
+		DnsLookup:       milliseconds(t.dnsStart, t.dnsDone),
+		TcpConnect:      milliseconds(t.connectStart, t.connectDone),
+		TlsHandshake:    milliseconds(t.tlsStart, t.tlsDone),
+		RequestWrite:    milliseconds(t.gotConn, t.wroteRequest),
+		TimeToFirstByte: milliseconds(t.wroteRequest, t.firstByte),
+		Total:           milliseconds(start, end),
+	}
+}
+
+func milliseconds(start time.Time, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() || end.Before(start) {
+		return 0
+	}
+	return float64(end.Sub(start).Microseconds()) / 1000
+}
+
+// Earliest upstream event: DNS lookup, dialing, or getting a pooled connection
+func (t *exchangeTrace) upstreamStart() time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	start := t.gotConn
+	for _, tm := range []time.Time{t.dnsStart, t.connectStart} {
+		if !tm.IsZero() && (start.IsZero() || tm.Before(start)) {
+			start = tm
+		}
+	}
+	return start
+}
+
+func (t *exchangeTrace) firstByteTime() time.Time {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.firstByte
+}
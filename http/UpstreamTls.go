@@ -0,0 +1,38 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+)
+
+// Trust cert, e.g. the self-signed certificate of a test server, for https
+// upstreams, in addition to the system roots
+func (p *Proxy) TrustUpstream(cert *x509.Certificate) {
+	p.transportMutex.Lock()
+	defer p.transportMutex.Unlock()
+	p.trustedCerts = append(p.trustedCerts, cert)
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	for _, trusted := range p.trustedCerts {
+		roots.AddCert(trusted)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	if previous := p.transport; previous != nil {
+		previous.CloseIdleConnections()
+	}
+	p.transport = transport
+}
+
+// Transport of the requests sent upstream
+func (p *Proxy) upstreamTransport() http.RoundTripper {
+	p.transportMutex.Lock()
+	defer p.transportMutex.Unlock()
+	if p.transport == nil {
+		return http.DefaultTransport
+	}
+	return p.transport
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"goproxy/api"
+	"goproxy/config"
+	"goproxy/vcr"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Headers that describe the recorded connection rather than the response
+var vcrSkipHeaders = []string{"content-length", "transfer-encoding", "connection", "keep-alive"}
+
+// Set up record or playback for a config with a Vcr
+func (hm *HttpMessage) startVcr(request *http.Request, body []byte) {
+	settings := hm.ProxyConfig.Vcr
+	hm.cassette = hm.proxy.cassettes.Load(settings.Cassette)
+	hm.vcrKey = vcr.Key(settings.Key, request, body)
+}
+
+// Answer a playback request from the cassette.  False if the request should
+// go upstream: not playback, or a miss with the passthrough policy.
+func (hm *HttpMessage) playback(w http.ResponseWriter, request *http.Request) bool {
+	settings := hm.ProxyConfig.Vcr
+	if hm.cassette == nil || settings.Mode != config.VcrPlayback {
+		return false
+	}
+	recorded := hm.cassette.Play(hm.vcrKey)
+	if recorded == nil {
+		log.Printf("Vcr playback() seq=%d %s: no recorded response for %q\n", hm.SequenceNumber, hm.cassette.Name(), hm.vcrKey)
+		if settings.Miss == config.VcrPassthrough {
+			return false
+		}
+		messageError := &api.MessageError{
+			Kind:    api.CassetteMiss,
+			Message: "no response recorded in cassette " + hm.cassette.Name() + " for " + hm.vcrKey,
+		}
+		hm.Cassette = hm.cassette.Name()
+		body := writeErrorResponse(w, request, http.StatusBadGateway, messageError)
+		hm.EmitErrorToBrowser(http.StatusBadGateway, w.Header(), body, messageError)
+		return true
+	}
+
+	body := recorded.BodyBytes()
+	for name, values := range recorded.Headers {
+		w.Header()[name] = values
+	}
+	for _, name := range vcrSkipHeaders {
+		w.Header().Del(name)
+	}
+	w.Header().Set("content-length", strconv.Itoa(len(body)))
+	w.WriteHeader(recorded.Status)
+	w.Write(body)
+	hm.Cassette = hm.cassette.Name()
+	hm.EmitMessageToBrowser(recorded.Status, w.Header(), body)
+	return true
+}
+
+// Save the exchange to the cassette in record mode
+func (hm *HttpMessage) record(res *http.Response, body []byte) {
+	if hm.cassette == nil || hm.ProxyConfig.Vcr.Mode != config.VcrRecord {
+		return
+	}
+	request := &vcr.Exchange{Method: hm.Method, Url: hm.Url, Headers: hm.ReqHeaders.Clone()}
+	request.Headers.Del(goproxySeqHeader)
+	if reqBody, ok := hm.ReqBody.([]byte); ok && len(reqBody) > 0 {
+		vcr.SetBody(request, reqBody)
+	}
+	response := &vcr.Exchange{Status: res.StatusCode, Headers: res.Header.Clone()}
+	for _, name := range vcrSkipHeaders {
+		response.Headers.Del(name)
+	}
+	vcr.SetBody(response, body)
+	hm.cassette.Record(hm.vcrKey, request, response)
+	hm.Cassette = hm.cassette.Name()
+}
@@ -0,0 +1,190 @@
+package jsonpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Minimal JSONPath: "$", ".name", "['name']", "[index]" and "[*]".  The
+// leading "$" is optional.
+type Path []segment
+
+type segment struct {
+	key   string
+	index int  // array index, when isIdx
+	isIdx bool // index or wildcard
+	all   bool // [*]
+}
+
+func Parse(expr string) (Path, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(expr), "$")
+	path := make(Path, 0)
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%q: empty name", expr)
+			}
+			path = append(path, segment{key: s[:end]})
+			s = s[end:]
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%q: missing ]", expr)
+			}
+			inside := s[1:end]
+			s = s[end+1:]
+			switch {
+			case inside == "*":
+				path = append(path, segment{isIdx: true, all: true})
+			case len(inside) >= 2 && (inside[0] == '\'' || inside[0] == '"') && inside[len(inside)-1] == inside[0]:
+				path = append(path, segment{key: inside[1 : len(inside)-1]})
+			default:
+				index, err := strconv.Atoi(inside)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("%q: invalid index %q", expr, inside)
+				}
+				path = append(path, segment{isIdx: true, index: index})
+			}
+		default:
+			if len(path) > 0 {
+				return nil, fmt.Errorf("%q: unexpected %q", expr, s[0])
+			}
+			s = "." + s // "name.x" is read as "$.name.x"
+		}
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%q: path selects the whole document", expr)
+	}
+	return path, nil
+}
+
+// Set the value at the path, creating missing object members along the
+// way.  Array elements are never created.  Returns the number of values set.
+func (p Path) Set(doc interface{}, value interface{}) int {
+	return p.walk(doc, func(parent interface{}, seg segment) int {
+		switch v := parent.(type) {
+		case map[string]interface{}:
+			if seg.isIdx {
+				return 0
+			}
+			v[seg.key] = value
+			return 1
+		case []interface{}:
+			if !seg.isIdx {
+				return 0
+			}
+			if seg.all {
+				for i := range v {
+					v[i] = value
+				}
+				return len(v)
+			}
+			if seg.index < len(v) {
+				v[seg.index] = value
+				return 1
+			}
+		}
+		return 0
+	}, true)
+}
+
+// Delete the value at the path.  Array elements are removed, so the parent
+// array gets shorter.  Returns the new document and the number of values
+// deleted.
+func (p Path) Delete(doc interface{}) (interface{}, int) {
+	if len(p) == 1 {
+		return deleteFrom(doc, p[0])
+	}
+	parentPath := p[:len(p)-1]
+	last := p[len(p)-1]
+	count := 0
+	parentPath.walk(doc, func(grandparent interface{}, seg segment) int {
+		// Replace the parent in the grandparent, as deleting an array
+		// element makes a new slice
+		each(grandparent, seg, func(parent interface{}, store func(interface{})) {
+			updated, n := deleteFrom(parent, last)
+			if n > 0 {
+				store(updated)
+				count += n
+			}
+		})
+		return 0
+	}, false)
+	return doc, count
+}
+
+func deleteFrom(parent interface{}, seg segment) (interface{}, int) {
+	switch v := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := v[seg.key]; ok && !seg.isIdx {
+			delete(v, seg.key)
+			return v, 1
+		}
+	case []interface{}:
+		if seg.all {
+			return []interface{}{}, len(v)
+		}
+		if seg.isIdx && seg.index < len(v) {
+			return append(v[:seg.index:seg.index], v[seg.index+1:]...), 1
+		}
+	}
+	return parent, 0
+}
+
+// Call fn with each parent of the final segment.  With create, missing
+// object members along the way become empty objects.
+func (p Path) walk(doc interface{}, fn func(parent interface{}, seg segment) int, create bool) int {
+	if len(p) == 0 {
+		return 0
+	}
+	if len(p) == 1 {
+		return fn(doc, p[0])
+	}
+	count := 0
+	next := p[1:]
+	seg := p[0]
+	if create && !seg.isIdx {
+		if object, ok := doc.(map[string]interface{}); ok {
+			if _, exists := object[seg.key]; !exists {
+				if next[0].isIdx {
+					return 0
+				}
+				object[seg.key] = make(map[string]interface{})
+			}
+		}
+	}
+	each(doc, seg, func(child interface{}, _ func(interface{})) {
+		count += next.walk(child, fn, create)
+	})
+	return count
+}
+
+// Call fn with each child of doc selected by seg, and a function replacing it
+func each(doc interface{}, seg segment, fn func(child interface{}, store func(interface{}))) {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		if seg.isIdx {
+			return
+		}
+		if child, ok := v[seg.key]; ok {
+			fn(child, func(value interface{}) { v[seg.key] = value })
+		}
+	case []interface{}:
+		if !seg.isIdx {
+			return
+		}
+		for i := range v {
+			if seg.all || i == seg.index {
+				i := i
+				fn(v[i], func(value interface{}) { v[i] = value })
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func decode(t *testing.T, doc string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(doc), &v); err != nil {
+		t.Fatalf("invalid document %s: %v", doc, err)
+	}
+	return v
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr string
+		path Path
+		err  string
+	}{
+		{"$.a", Path{{key: "a"}}, ""},
+		{"a.b", Path{{key: "a"}, {key: "b"}}, ""},
+		{" $.a ", Path{{key: "a"}}, ""},
+		{"$['a.b']", Path{{key: "a.b"}}, ""},
+		{`$["a"]`, Path{{key: "a"}}, ""},
+		{"$[2]", Path{{isIdx: true, index: 2}}, ""},
+		{"$.a[*].b", Path{{key: "a"}, {isIdx: true, all: true}, {key: "b"}}, ""},
+		{"$", nil, `"$": path selects the whole document`},
+		{"", nil, `"": path selects the whole document`},
+		{"$..a", nil, `"$..a": empty name`},
+		{"$.a.", nil, `"$.a.": empty name`},
+		{"$.a[0", nil, `"$.a[0": missing ]`},
+		{"$[-1]", nil, `"$[-1]": invalid index "-1"`},
+		{"$[a]", nil, `"$[a]": invalid index "a"`},
+		{"$['a]", nil, `"$['a]": invalid index "'a"`},
+		{"$[0]a", nil, `"$[0]a": unexpected 'a'`},
+	}
+	for _, test := range tests {
+		path, err := Parse(test.expr)
+		if err != nil {
+			if err.Error() != test.err {
+				t.Errorf("Parse(%q) error %q, want %q", test.expr, err, test.err)
+			}
+			continue
+		}
+		if len(test.err) > 0 {
+			t.Errorf("Parse(%q) = %v, want error %q", test.expr, path, test.err)
+			continue
+		}
+		if len(path) != len(test.path) {
+			t.Errorf("Parse(%q) = %v, want %v", test.expr, path, test.path)
+			continue
+		}
+		for i := range path {
+			if path[i] != test.path[i] {
+				t.Errorf("Parse(%q) = %v, want %v", test.expr, path, test.path)
+				break
+			}
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		expr  string
+		doc   string
+		value interface{}
+		want  string
+		count int
+	}{
+		{"replace member", "$.a", `{"a":1}`, 2.0, `{"a":2}`, 1},
+		{"add member", "$.b", `{"a":1}`, 2.0, `{"a":1,"b":2}`, 1},
+		{"create objects", "$.a.b.c", `{}`, true, `{"a":{"b":{"c":true}}}`, 1},
+		{"array element", "$.a[1]", `{"a":[1,2,3]}`, nil, `{"a":[1,null,3]}`, 1},
+		{"array element out of range", "$.a[3]", `{"a":[1]}`, 2.0, `{"a":[1]}`, 0},
+		{"no array created", "$.a[0]", `{}`, 1.0, `{}`, 0},
+		{"no array created for a wildcard", "$.a[*].b", `{}`, 1.0, `{}`, 0},
+		{"wildcard", "$.a[*].b", `{"a":[{"b":1},{},2]}`, 0.0, `{"a":[{"b":0},{"b":0},2]}`, 2},
+		{"wildcard elements", "$[*]", `[1,2]`, "x", `["x","x"]`, 2},
+		{"index into object", "$.a[0]", `{"a":{"0":1}}`, 2.0, `{"a":{"0":1}}`, 0},
+		{"key into array", "$.a.b", `{"a":[1]}`, 2.0, `{"a":[1]}`, 0},
+		{"through a scalar", "$.a.b", `{"a":1}`, 2.0, `{"a":1}`, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := Parse(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc := decode(t, test.doc)
+			count := path.Set(doc, test.value)
+			got, _ := json.Marshal(doc)
+			if string(got) != test.want || count != test.count {
+				t.Errorf("Set() = %s, %d, want %s, %d", got, count, test.want, test.count)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name  string
+		expr  string
+		doc   string
+		want  string
+		count int
+	}{
+		{"member", "$.a", `{"a":1,"b":2}`, `{"b":2}`, 1},
+		{"missing member", "$.c", `{"a":1}`, `{"a":1}`, 0},
+		{"nested member", "$.a.b", `{"a":{"b":1,"c":2}}`, `{"a":{"c":2}}`, 1},
+		{"top level element", "$[0]", `[1,2]`, `[2]`, 1},
+		{"top level wildcard", "$[*]", `[1,2]`, `[]`, 2},
+		{"array element shortens the array", "$.a[1]", `{"a":[1,2,3]}`, `{"a":[1,3]}`, 1},
+		{"array element out of range", "$.a[3]", `{"a":[1]}`, `{"a":[1]}`, 0},
+		{"all elements", "$.a[*]", `{"a":[1,2]}`, `{"a":[]}`, 2},
+		{"member of each element", "$.a[*].id", `{"a":[{"id":1,"x":1},{"x":2},{"id":3}]}`, `{"a":[{"x":1},{"x":2},{}]}`, 2},
+		{"element of each element", "$[*][0]", `[[1,2],[3],[]]`, `[[2],[],[]]`, 2},
+		{"key of an array", "$.a.b", `{"a":[{"b":1}]}`, `{"a":[{"b":1}]}`, 0},
+		{"missing parent", "$.a.b", `{}`, `{}`, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := Parse(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, count := path.Delete(decode(t, test.doc))
+			got, _ := json.Marshal(doc)
+			if string(got) != test.want || count != test.count {
+				t.Errorf("Delete() = %s, %d, want %s, %d", got, count, test.want, test.count)
+			}
+		})
+	}
+}
@@ -10,6 +10,10 @@ const (
 	goproxyDataDir = "GOPROXY_DATA_DIR"
 )
 
+// Directory where a goproxy instance keeps its config, CA, cassettes and
+// captured messages
+type DataDir string
+
 func dataDir() string {
 	dir := os.Getenv(goproxyDataDir)
 	if len(dir) == 0 {
@@ -18,50 +22,96 @@ func dataDir() string {
 	return filepath.Clean(dir)
 }
 
+// Data dir named by the GOPROXY_DATA_DIR environment variable
+func Default() DataDir {
+	return DataDir(dataDir())
+}
+
+// Data dir named by the GOPROXY_DATA_DIR environment variable.  False if it
+// is not set.
+func Lookup() (DataDir, bool) {
+	dir := os.Getenv(goproxyDataDir)
+	if len(dir) == 0 {
+		return "", false
+	}
+	return DataDir(filepath.Clean(dir)), true
+}
+
 func ConfigJson() string {
-	return filepath.Join(dataDir(), "config.json")
+	return Default().ConfigJson()
+}
+
+func (dir DataDir) ConfigJson() string {
+	return filepath.Join(string(dir), "config.json")
 }
 
 func ReplaceResponsesDir() string {
 	return filepath.Join(dataDir(), "replace-responses")
 }
 
-func MakeCaDir() {
-	if _, err := os.Stat(sslCaDir()); os.IsNotExist(err) {
-		err := os.Mkdir(sslCaDir(), 0755)
+// Compiled .proto FileDescriptorSet used to name protobuf fields
+func (dir DataDir) ProtoDescriptorSet() string {
+	return filepath.Join(string(dir), "descriptor_set.pb")
+}
+
+func (dir DataDir) MakeCaDir() {
+	if _, err := os.Stat(dir.sslCaDir()); os.IsNotExist(err) {
+		err := os.Mkdir(dir.sslCaDir(), 0755)
 		if err != nil {
 			log.Panicln(err)
 		}
-		err = os.Mkdir(filepath.Join(sslCaDir(), "certs"), 0755)
+		err = os.Mkdir(filepath.Join(dir.sslCaDir(), "certs"), 0755)
 		if err != nil {
 			log.Panicln(err)
 		}
-		err = os.Mkdir(filepath.Join(sslCaDir(), "keys"), 0755)
+		err = os.Mkdir(filepath.Join(dir.sslCaDir(), "keys"), 0755)
 		if err != nil {
 			log.Panicln(err)
 		}
 	}
 }
 
-func sslCaDir() string {
-	dir := filepath.Join(dataDir(), ".http-mitm-proxy")
-	return dir
+func (dir DataDir) sslCaDir() string {
+	return filepath.Join(string(dir), ".http-mitm-proxy")
 }
 
-func SslCertsDir() string {
-	return filepath.Join(sslCaDir(), "certs")
+func (dir DataDir) SslCertsDir() string {
+	return filepath.Join(dir.sslCaDir(), "certs")
 }
 
-func SslKeysDir() string {
-	return filepath.Join(sslCaDir(), "keys")
+func (dir DataDir) SslKeysDir() string {
+	return filepath.Join(dir.sslCaDir(), "keys")
 }
 
-func MakeCaPemSymLink() {
-	oldName := filepath.Join(sslCaDir(), "certs/ca.pem")
-	newName := filepath.Join(dataDir(), "ca.pem")
+func (dir DataDir) MakeCaPemSymLink() {
+	oldName := filepath.Join(dir.sslCaDir(), "certs/ca.pem")
+	newName := filepath.Join(string(dir), "ca.pem")
 	os.Symlink(oldName, newName)
 }
 
+// Recorded exchanges, see package vcr
+func (dir DataDir) CassetteDir() string {
+	return filepath.Join(string(dir), "cassettes")
+}
+
+// Stored messages, see package capture
+func CaptureDir() string {
+	return Default().CaptureDir()
+}
+
+func (dir DataDir) CaptureDir() string {
+	return filepath.Join(string(dir), "capture")
+}
+
+// Files injected into HTML pages by rewrite rules
+func (dir DataDir) InjectDir() string {
+	return filepath.Join(string(dir), "inject")
+}
+
 func ClientDir() string {
-	return filepath.Join(dataDir(), "client")
+	return Default().ClientDir()
+}
+
+func (dir DataDir) ClientDir() string {
+	return filepath.Join(string(dir), "client")
 }
@@ -0,0 +1,65 @@
+package protobuf
+
+import (
+	"encoding/base64"
+	"mime"
+	"strings"
+)
+
+// Decode an HTTP body if its content type is protobuf, gRPC or gRPC-Web.
+// The bool result is false when the content type is not handled here.
+// urlPath selects the gRPC method, and isRequest selects its input or
+// output message type, when descriptorFile holds a descriptor set.
+func DecodeBody(descriptorFile *DescriptorFile, contentType string, urlPath string, isRequest bool, body []byte) (interface{}, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	descriptors := descriptorFile.Load()
+	switch mediaType {
+	case "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf", "application/x-google-protobuf":
+		typeName := params["proto"]
+		if len(typeName) == 0 {
+			typeName = params["messagetype"]
+		}
+		return decodeMessage(descriptors, typeName, body), true
+	case "application/grpc", "application/grpc+proto",
+		"application/grpc-web", "application/grpc-web+proto",
+		"application/grpc-web-text", "application/grpc-web-text+proto":
+		if strings.HasPrefix(mediaType, "application/grpc-web-text") {
+			decoded, err := decodeGrpcWebText(body)
+			if err != nil {
+				return &GrpcBody{Messages: []interface{}{}, Error: "invalid grpc-web-text: " + err.Error()}, true
+			}
+			body = decoded
+		}
+		typeName := ""
+		if descriptors != nil {
+			typeName = descriptors.MethodType(urlPath, isRequest)
+		}
+		return decodeGrpcFrames(body, func(payload []byte) interface{} {
+			return decodeMessage(descriptors, typeName, payload)
+		}), true
+	}
+	return nil, false
+}
+
+// Decode with the descriptor when the message type is known, otherwise fall
+// back to the schema-less decoder.
+func decodeMessage(descriptors *Descriptors, typeName string, data []byte) interface{} {
+	typeName = strings.TrimPrefix(typeName, ".")
+	if descriptors != nil && len(typeName) > 0 {
+		if message, err := descriptors.DecodeMessage(typeName, data); err == nil {
+			return message
+		}
+	}
+	fields, err := Decode(data)
+	if err != nil {
+		return map[string]interface{}{
+			"error": err.Error(),
+			"data":  base64.StdEncoding.EncodeToString(data),
+		}
+	}
+	return fields
+}
@@ -0,0 +1,37 @@
+package protobuf
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		want        string // JSON, "" when the content type is not handled
+	}{
+		{"json", "application/json", []byte(`{}`), ""},
+		{"invalid content type", "application/x-protobuf; =", []byte{0x08, 0x01}, ""},
+		{"protobuf", "application/x-protobuf", []byte{0x08, 0x01}, `[{"field":1,"type":"varint","value":1}]`},
+		{"bad protobuf", "application/protobuf", []byte{0x08}, `{"data":"CA==","error":"protobuf: truncated message"}`},
+		{"grpc", "application/grpc", frame(0, []byte{0x08, 0x01}), `{"messages":[[{"field":1,"type":"varint","value":1}]]}`},
+		{"grpc-web-text", "application/grpc-web-text+proto", []byte("AAAAAAIIAQ=="), `{"messages":[[{"field":1,"type":"varint","value":1}]]}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, ok := DecodeBody(nil, test.contentType, "/test.Shop/Get", true, test.body)
+			if !ok {
+				if len(test.want) > 0 {
+					t.Errorf("DecodeBody() not handled, want %s", test.want)
+				}
+				return
+			}
+			got, _ := json.Marshal(decoded)
+			if string(got) != test.want {
+				t.Errorf("DecodeBody() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package protobuf
+
+import (
+	"encoding/base64"
+	"math"
+	"unicode/utf8"
+)
+
+// Schema-less representation of a protobuf field.  Type is the wire type,
+// or "message"/"string" when a length delimited field could be decoded as one.
+type Field struct {
+	Field    int         `json:"field"`
+	Type     string      `json:"type"`
+	Value    interface{} `json:"value"`
+	Float    *float64    `json:"float,omitempty"`    // fixed32/fixed64 reinterpreted as float/double
+	Expected string      `json:"expected,omitempty"` // wire type of the descriptor, when the field arrived as another
+}
+
+const maxDepth = 32
+
+// Decode a protobuf message without a schema.
+func Decode(data []byte) ([]*Field, error) {
+	return decode(data, 0)
+}
+
+func decode(data []byte, depth int) ([]*Field, error) {
+	rawFields, err := readFields(data)
+	if err != nil {
+		return nil, err
+	}
+	fields := make([]*Field, 0, len(rawFields))
+	for _, raw := range rawFields {
+		fields = append(fields, renderField(raw, depth))
+	}
+	return fields, nil
+}
+
+func renderField(raw rawField, depth int) *Field {
+	field := &Field{Field: raw.Number, Type: raw.Type.String()}
+	switch raw.Type {
+	case Varint:
+		field.Value = varintValue(raw.Value)
+	case Fixed64:
+		field.Value = varintValue(raw.Value)
+		f := math.Float64frombits(raw.Value)
+		field.Float = &f
+	case Fixed32:
+		field.Value = raw.Value
+		f := float64(math.Float32frombits(uint32(raw.Value)))
+		field.Float = &f
+	case Bytes, StartGroup:
+		field.Type, field.Value = guessBytes(raw.Data, depth)
+		if raw.Type == StartGroup {
+			field.Type = "group"
+		}
+	}
+	return field
+}
+
+// Guess whether a length delimited payload is a string, a nested message or
+// opaque bytes.  Printable strings win over messages, since short strings
+// frequently happen to be well formed messages too.
+func guessBytes(data []byte, depth int) (string, interface{}) {
+	if len(data) == 0 {
+		return "string", ""
+	}
+	if isPrintable(data) {
+		return "string", string(data)
+	}
+	if depth < maxDepth {
+		if nested, err := decode(data, depth+1); err == nil {
+			return "message", nested
+		}
+	}
+	return "bytes", base64.StdEncoding.EncodeToString(data)
+}
+
+// Negative int32/int64 fields are encoded as ten byte varints, so values with
+// the top bit set are rendered as int64.
+func varintValue(v uint64) interface{} {
+	if v >= 1<<63 {
+		return int64(v)
+	}
+	return v
+}
+
+func isPrintable(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+		if r == 0x7f || r == utf8.RuneError {
+			return false
+		}
+	}
+	return true
+}
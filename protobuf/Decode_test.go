@@ -0,0 +1,64 @@
+package protobuf
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string // JSON
+	}{
+		{"varint", []byte{0x08, 0x96, 0x01}, `[{"field":1,"type":"varint","value":150}]`},
+		{"negative varint", []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, `[{"field":1,"type":"varint","value":-1}]`},
+		{"fixed32 float", []byte{0x0d, 0x00, 0x00, 0x80, 0x3f}, `[{"field":1,"type":"fixed32","value":1065353216,"float":1}]`},
+		{"fixed64 double", []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}, `[{"field":1,"type":"fixed64","value":4607182418800017408,"float":1}]`},
+		{"string", []byte{0x12, 0x02, 'h', 'i'}, `[{"field":2,"type":"string","value":"hi"}]`},
+		{"empty string", []byte{0x12, 0x00}, `[{"field":2,"type":"string","value":""}]`},
+		{"multi-byte string", []byte{0x12, 0x03, 0xe2, 0x82, 0xac}, `[{"field":2,"type":"string","value":"€"}]`},
+		{"nested message", []byte{0x12, 0x02, 0x08, 0x01}, `[{"field":2,"type":"message","value":[{"field":1,"type":"varint","value":1}]}]`},
+		{"bad utf-8", []byte{0x12, 0x02, 0xff, 0xfe}, `[{"field":2,"type":"bytes","value":"//4="}]`},
+		{"control characters", []byte{0x12, 0x02, 0x01, 0x02}, `[{"field":2,"type":"bytes","value":"AQI="}]`},
+		{"group", []byte{0x1b, 0x08, 0x01, 0x1c}, `[{"field":3,"type":"group","value":[{"field":1,"type":"varint","value":1}]}]`},
+		{"repeated field", []byte{0x08, 0x01, 0x08, 0x02}, `[{"field":1,"type":"varint","value":1},{"field":1,"type":"varint","value":2}]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields, err := Decode(test.data)
+			if err != nil {
+				t.Fatalf("Decode() %v", err)
+			}
+			got, _ := json.Marshal(fields)
+			if string(got) != test.want {
+				t.Errorf("Decode() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	if _, err := Decode([]byte{0x08}); err == nil {
+		t.Error("Decode() of a truncated varint succeeded")
+	}
+}
+
+func TestDecodeNestedTooDeeply(t *testing.T) {
+	// Each level is a one byte message holding the next one
+	data := []byte{0x08, 0x01}
+	for i := 0; i < maxDepth+2; i++ {
+		data = append([]byte{0x0a, byte(len(data))}, data...)
+	}
+	fields, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode() %v", err)
+	}
+	depth := 0
+	for field := fields[0]; field.Type == "message"; field = field.Value.([]*Field)[0] {
+		depth++
+	}
+	if depth > maxDepth+1 {
+		t.Errorf("Decode() nested %d messages, want at most %d", depth, maxDepth+1)
+	}
+}
@@ -0,0 +1,299 @@
+package protobuf
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// google.protobuf.FieldDescriptorProto.Type
+const (
+	typeDouble   = 1
+	typeFloat    = 2
+	typeInt64    = 3
+	typeUint64   = 4
+	typeInt32    = 5
+	typeFixed64  = 6
+	typeFixed32  = 7
+	typeBool     = 8
+	typeString   = 9
+	typeGroup    = 10
+	typeMessage  = 11
+	typeBytes    = 12
+	typeUint32   = 13
+	typeEnum     = 14
+	typeSfixed32 = 15
+	typeSfixed64 = 16
+	typeSint32   = 17
+	typeSint64   = 18
+
+	labelRepeated = 3
+)
+
+type fieldDescriptor struct {
+	name     string
+	number   int
+	label    int
+	kind     int
+	typeName string
+}
+
+type messageDescriptor struct {
+	name   string
+	fields map[int]*fieldDescriptor
+}
+
+type methodDescriptor struct {
+	inputType  string
+	outputType string
+}
+
+// Message, enum and method definitions read from a FileDescriptorSet, as
+// produced by "protoc --include_imports --descriptor_set_out".
+type Descriptors struct {
+	messages map[string]*messageDescriptor
+	enums    map[string]map[int]string
+	methods  map[string]*methodDescriptor // key is the gRPC path "/package.Service/Method"
+}
+
+// Parse a serialized google.protobuf.FileDescriptorSet.
+func ParseDescriptors(data []byte) (*Descriptors, error) {
+	d := &Descriptors{
+		messages: make(map[string]*messageDescriptor),
+		enums:    make(map[string]map[int]string),
+		methods:  make(map[string]*methodDescriptor),
+	}
+	files, err := readFields(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.Number != 1 || file.Type != Bytes {
+			continue
+		}
+		if err := d.parseFile(file.Data); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *Descriptors) parseFile(data []byte) error {
+	fields, err := readFields(data)
+	if err != nil {
+		return err
+	}
+	pkg := ""
+	for _, f := range fields {
+		if f.Number == 2 && f.Type == Bytes {
+			pkg = string(f.Data)
+		}
+	}
+	for _, f := range fields {
+		if f.Type != Bytes {
+			continue
+		}
+		switch f.Number {
+		case 4: // message_type
+			err = d.parseMessage(pkg, f.Data)
+		case 5: // enum_type
+			err = d.parseEnum(pkg, f.Data)
+		case 6: // service
+			err = d.parseService(pkg, f.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Descriptors) parseMessage(scope string, data []byte) error {
+	fields, err := readFields(data)
+	if err != nil {
+		return err
+	}
+	md := &messageDescriptor{fields: make(map[int]*fieldDescriptor)}
+	for _, f := range fields {
+		if f.Number == 1 && f.Type == Bytes {
+			md.name = qualify(scope, string(f.Data))
+		}
+	}
+	d.messages[md.name] = md
+	for _, f := range fields {
+		if f.Type != Bytes {
+			continue
+		}
+		switch f.Number {
+		case 2: // field
+			fd, err := parseField(f.Data)
+			if err != nil {
+				return err
+			}
+			md.fields[fd.number] = fd
+		case 3: // nested_type
+			err = d.parseMessage(md.name, f.Data)
+		case 4: // enum_type
+			err = d.parseEnum(md.name, f.Data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseField(data []byte) (*fieldDescriptor, error) {
+	fields, err := readFields(data)
+	if err != nil {
+		return nil, err
+	}
+	fd := &fieldDescriptor{}
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			fd.name = string(f.Data)
+		case 3:
+			fd.number = int(f.Value)
+		case 4:
+			fd.label = int(f.Value)
+		case 5:
+			fd.kind = int(f.Value)
+		case 6:
+			fd.typeName = strings.TrimPrefix(string(f.Data), ".")
+		}
+	}
+	return fd, nil
+}
+
+func (d *Descriptors) parseEnum(scope string, data []byte) error {
+	fields, err := readFields(data)
+	if err != nil {
+		return err
+	}
+	name := ""
+	values := make(map[int]string)
+	for _, f := range fields {
+		switch {
+		case f.Number == 1 && f.Type == Bytes:
+			name = qualify(scope, string(f.Data))
+		case f.Number == 2 && f.Type == Bytes:
+			valueFields, err := readFields(f.Data)
+			if err != nil {
+				return err
+			}
+			valueName, number := "", 0
+			for _, vf := range valueFields {
+				switch vf.Number {
+				case 1:
+					valueName = string(vf.Data)
+				case 2:
+					number = int(int32(vf.Value))
+				}
+			}
+			values[number] = valueName
+		}
+	}
+	d.enums[name] = values
+	return nil
+}
+
+func (d *Descriptors) parseService(pkg string, data []byte) error {
+	fields, err := readFields(data)
+	if err != nil {
+		return err
+	}
+	service := ""
+	for _, f := range fields {
+		if f.Number == 1 && f.Type == Bytes {
+			service = qualify(pkg, string(f.Data))
+		}
+	}
+	for _, f := range fields {
+		if f.Number != 2 || f.Type != Bytes {
+			continue
+		}
+		methodFields, err := readFields(f.Data)
+		if err != nil {
+			return err
+		}
+		method := ""
+		md := &methodDescriptor{}
+		for _, mf := range methodFields {
+			switch mf.Number {
+			case 1:
+				method = string(mf.Data)
+			case 2:
+				md.inputType = strings.TrimPrefix(string(mf.Data), ".")
+			case 3:
+				md.outputType = strings.TrimPrefix(string(mf.Data), ".")
+			}
+		}
+		d.methods["/"+service+"/"+method] = md
+	}
+	return nil
+}
+
+func qualify(scope string, name string) string {
+	if len(scope) == 0 {
+		return name
+	}
+	return scope + "." + name
+}
+
+// Message type for a gRPC method path, or "" if the method is unknown.
+func (d *Descriptors) MethodType(path string, isRequest bool) string {
+	md, ok := d.methods[path]
+	if !ok {
+		return ""
+	}
+	if isRequest {
+		return md.inputType
+	}
+	return md.outputType
+}
+
+// Descriptor set file, re-read whenever it changes
+type DescriptorFile struct {
+	path        string
+	mutex       sync.Mutex
+	descriptors *Descriptors
+	modTime     time.Time
+}
+
+func NewDescriptorFile(path string) *DescriptorFile {
+	return &DescriptorFile{path: path}
+}
+
+// Descriptors in the file, or nil if there is none.
+func (f *DescriptorFile) Load() *Descriptors {
+	if f == nil {
+		return nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		f.descriptors = nil
+		return nil
+	}
+	if f.descriptors != nil && stat.ModTime().Equal(f.modTime) {
+		return f.descriptors
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		log.Println("protobuf DescriptorFile Load()", err)
+		return nil
+	}
+	d, err := ParseDescriptors(data)
+	if err != nil {
+		log.Println("protobuf DescriptorFile Load()", f.path, err)
+		return nil
+	}
+	f.descriptors = d
+	f.modTime = stat.ModTime()
+	return f.descriptors
+}
@@ -0,0 +1,43 @@
+package protobuf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDescriptorFileLoad(t *testing.T) {
+	var none *DescriptorFile
+	if none.Load() != nil {
+		t.Error("Load() of a nil file returned descriptors")
+	}
+
+	path := filepath.Join(t.TempDir(), "descriptor_set.pb")
+	f := NewDescriptorFile(path)
+	if f.Load() != nil {
+		t.Error("Load() of a missing file returned descriptors")
+	}
+
+	if err := os.WriteFile(path, []byte{0x08}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if f.Load() != nil {
+		t.Error("Load() of an invalid file returned descriptors")
+	}
+
+	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := f.Load()
+	if d == nil {
+		t.Fatal("Load() of an empty descriptor set returned none")
+	}
+	if f.Load() != d {
+		t.Error("Load() of an unchanged file parsed it again")
+	}
+
+	os.Remove(path)
+	if f.Load() != nil {
+		t.Error("Load() of a removed file returned descriptors")
+	}
+}
@@ -0,0 +1,103 @@
+package protobuf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+const (
+	frameCompressed = 0x01
+	frameTrailer    = 0x80
+)
+
+// Decoded gRPC / gRPC-Web body.  Each length prefixed data frame is one
+// message, and gRPC-Web sends the trailers in a final frame.
+type GrpcBody struct {
+	Messages []interface{}     `json:"messages"`
+	Trailers map[string]string `json:"trailers,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// Split a gRPC length prefixed body into messages and trailers.  decodeMessage
+// renders each data frame.
+func decodeGrpcFrames(body []byte, decodeMessage func([]byte) interface{}) *GrpcBody {
+	out := &GrpcBody{Messages: make([]interface{}, 0)}
+	for len(body) > 0 {
+		if len(body) < 5 {
+			out.Error = "truncated gRPC frame header"
+			break
+		}
+		flags := body[0]
+		length := binary.BigEndian.Uint32(body[1:5])
+		body = body[5:]
+		if uint64(length) > uint64(len(body)) {
+			out.Error = "truncated gRPC frame"
+			break
+		}
+		payload := body[:length]
+		body = body[length:]
+
+		if flags&frameCompressed != 0 {
+			uncompressed, err := gunzip(payload)
+			if err != nil {
+				out.Error = "compressed gRPC frame: " + err.Error()
+				continue
+			}
+			payload = uncompressed
+		}
+		if flags&frameTrailer != 0 {
+			out.Trailers = parseTrailers(payload)
+		} else {
+			out.Messages = append(out.Messages, decodeMessage(payload))
+		}
+	}
+	return out
+}
+
+// gRPC-Web trailers are encoded as HTTP/1 header lines.
+func parseTrailers(payload []byte) map[string]string {
+	trailers := make(map[string]string)
+	for _, line := range strings.Split(string(payload), "\r\n") {
+		tokens := strings.SplitN(line, ":", 2)
+		if len(tokens) == 2 {
+			trailers[strings.ToLower(strings.TrimSpace(tokens[0]))] = strings.TrimSpace(tokens[1])
+		}
+	}
+	return trailers
+}
+
+// grpc-web-text bodies are base64, possibly as several concatenated padded chunks.
+func decodeGrpcWebText(body []byte) ([]byte, error) {
+	out := make([]byte, 0, len(body))
+	text := strings.TrimSpace(string(body))
+	for len(text) > 0 {
+		end := strings.Index(text, "=")
+		chunk := text
+		if end >= 0 {
+			for end < len(text) && text[end] == '=' {
+				end++
+			}
+			chunk = text[:end]
+		}
+		decoded, err := base64.StdEncoding.DecodeString(chunk)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, decoded...)
+		text = text[len(chunk):]
+	}
+	return out, nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,73 @@
+package protobuf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+)
+
+func frame(flags byte, payload []byte) []byte {
+	length := len(payload)
+	return append([]byte{flags, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}, payload...)
+}
+
+func gzipped(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeGrpcFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want string // JSON
+	}{
+		{"empty", []byte{}, `{"messages":[]}`},
+		{"one message", frame(0, []byte("a")), `{"messages":["a"]}`},
+		{"two messages", append(frame(0, []byte("a")), frame(0, []byte("b"))...), `{"messages":["a","b"]}`},
+		{"empty message", frame(0, []byte{}), `{"messages":[""]}`},
+		{"compressed", frame(frameCompressed, gzipped([]byte("a"))), `{"messages":["a"]}`},
+		{"bad compression", frame(frameCompressed, []byte("a")), `{"messages":[],"error":"compressed gRPC frame: unexpected EOF"}`},
+		{"trailers", append(frame(0, []byte("a")), frame(frameTrailer, []byte("Grpc-Status: 0\r\ngrpc-message: ok\r\n"))...),
+			`{"messages":["a"],"trailers":{"grpc-message":"ok","grpc-status":"0"}}`},
+		{"truncated header", []byte{0, 0, 0}, `{"messages":[],"error":"truncated gRPC frame header"}`},
+		{"truncated frame", append(frame(0, []byte("a")), 0, 0, 0, 0, 9, 'b'), `{"messages":["a"],"error":"truncated gRPC frame"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := decodeGrpcFrames(test.body, func(payload []byte) interface{} { return string(payload) })
+			got, _ := json.Marshal(body)
+			if string(got) != test.want {
+				t.Errorf("decodeGrpcFrames() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeGrpcWebText(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+		ok   bool
+	}{
+		{"one chunk", "aGk=", "hi", true},
+		{"unpadded", "aGkh", "hi!", true},
+		{"padded chunks", "aGk=aGk=", "hihi", true},
+		{"double padding", "YQ==Yg==", "ab", true},
+		{"surrounding space", " aGk=\r\n", "hi", true},
+		{"invalid", "a*k=", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeGrpcWebText([]byte(test.body))
+			if (err == nil) != test.ok || string(got) != test.want {
+				t.Errorf("decodeGrpcWebText() = %q, %v, want %q", got, err, test.want)
+			}
+		})
+	}
+}
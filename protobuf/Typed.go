@@ -0,0 +1,153 @@
+package protobuf
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Decode a message using its descriptor, keyed by field name.  Fields missing
+// from the descriptor are rendered schema-less and keyed by field number.
+// Fields whose wire type does not match the descriptor are rendered
+// schema-less too, with the wire type expected.
+func (d *Descriptors) DecodeMessage(typeName string, data []byte) (map[string]interface{}, error) {
+	return d.decodeMessage(typeName, data, 0)
+}
+
+func (d *Descriptors) decodeMessage(typeName string, data []byte, depth int) (map[string]interface{}, error) {
+	md, ok := d.messages[typeName]
+	if !ok {
+		return nil, errors.New("protobuf: unknown message type " + typeName)
+	}
+	if depth > maxDepth {
+		return nil, errors.New("protobuf: message nested too deeply")
+	}
+	rawFields, err := readFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]interface{})
+	for _, raw := range rawFields {
+		fd, ok := md.fields[raw.Number]
+		if !ok {
+			out[strconv.Itoa(raw.Number)] = renderField(raw, depth+1)
+			continue
+		}
+
+		if fd.label == labelRepeated && raw.Type == Bytes && isPackable(fd.kind) {
+			values, err := d.unpack(fd, raw.Data)
+			if err != nil {
+				return nil, err
+			}
+			list, _ := out[fd.name].([]interface{})
+			out[fd.name] = append(list, values...)
+			continue
+		}
+
+		var value interface{}
+		if expected := wireTypeOf(fd.kind); raw.Type != expected {
+			// Not what the descriptor says, so it cannot be trusted
+			field := renderField(raw, depth+1)
+			field.Expected = expected.String()
+			value = field
+		} else if value, err = d.fieldValue(fd, raw, depth); err != nil {
+			return nil, err
+		}
+		if fd.label == labelRepeated {
+			list, _ := out[fd.name].([]interface{})
+			out[fd.name] = append(list, value)
+		} else {
+			out[fd.name] = value
+		}
+	}
+	return out, nil
+}
+
+func (d *Descriptors) fieldValue(fd *fieldDescriptor, raw rawField, depth int) (interface{}, error) {
+	switch fd.kind {
+	case typeString:
+		return string(raw.Data), nil
+	case typeBytes:
+		return base64.StdEncoding.EncodeToString(raw.Data), nil
+	case typeMessage, typeGroup:
+		return d.decodeMessage(fd.typeName, raw.Data, depth+1)
+	}
+	return d.scalarValue(fd, raw.Value), nil
+}
+
+func (d *Descriptors) scalarValue(fd *fieldDescriptor, v uint64) interface{} {
+	switch fd.kind {
+	case typeDouble:
+		return math.Float64frombits(v)
+	case typeFloat:
+		return float64(math.Float32frombits(uint32(v)))
+	case typeInt64, typeSfixed64:
+		return int64(v)
+	case typeInt32, typeSfixed32:
+		return int32(v)
+	case typeUint32, typeFixed32:
+		return uint32(v)
+	case typeBool:
+		return v != 0
+	case typeSint32, typeSint64:
+		return decodeZigZag(v)
+	case typeEnum:
+		if name, ok := d.enums[fd.typeName][int(int32(v))]; ok {
+			return name
+		}
+		return int32(v)
+	}
+	return v
+}
+
+// Wire type of a field of kind, when it is not packed
+func wireTypeOf(kind int) WireType {
+	switch kind {
+	case typeDouble, typeFixed64, typeSfixed64:
+		return Fixed64
+	case typeFloat, typeFixed32, typeSfixed32:
+		return Fixed32
+	case typeString, typeBytes, typeMessage:
+		return Bytes
+	case typeGroup:
+		return StartGroup
+	}
+	return Varint
+}
+
+func isPackable(kind int) bool {
+	return kind != typeString && kind != typeBytes && kind != typeMessage && kind != typeGroup
+}
+
+func (d *Descriptors) unpack(fd *fieldDescriptor, data []byte) ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	for len(data) > 0 {
+		var v uint64
+		switch fd.kind {
+		case typeDouble, typeFixed64, typeSfixed64:
+			if len(data) < 8 {
+				return nil, errTruncated
+			}
+			v = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case typeFloat, typeFixed32, typeSfixed32:
+			if len(data) < 4 {
+				return nil, errTruncated
+			}
+			v = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			var n int
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errTruncated
+			}
+			data = data[n:]
+		}
+		values = append(values, d.scalarValue(fd, v))
+	}
+	return values, nil
+}
@@ -0,0 +1,149 @@
+package protobuf
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	return append(buf, varint[:binary.PutUvarint(varint[:], v)]...)
+}
+
+func appendVarint(buf []byte, number int, v uint64) []byte {
+	buf = appendUvarint(buf, uint64(number<<3)|uint64(Varint))
+	return appendUvarint(buf, v)
+}
+
+func appendBytes(buf []byte, number int, data []byte) []byte {
+	buf = appendUvarint(buf, uint64(number<<3)|uint64(Bytes))
+	buf = appendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func fieldProto(name string, number int, label int, kind int, typeName string) []byte {
+	var buf []byte
+	buf = appendBytes(buf, 1, []byte(name))
+	buf = appendVarint(buf, 3, uint64(number))
+	buf = appendVarint(buf, 4, uint64(label))
+	buf = appendVarint(buf, 5, uint64(kind))
+	if len(typeName) > 0 {
+		buf = appendBytes(buf, 6, []byte(typeName))
+	}
+	return buf
+}
+
+// test.proto:
+//
+//	package test;
+//	enum Status { PENDING = 0; SHIPPED = 1; }
+//	message Order {
+//		int32 id = 1; string name = 2; Status status = 3;
+//		repeated int32 items = 4; Order child = 5; double price = 6;
+//	}
+//	service Shop { rpc Get(Order) returns (Order); }
+func testDescriptors(t *testing.T) *Descriptors {
+	t.Helper()
+	var order []byte
+	order = appendBytes(order, 1, []byte("Order"))
+	order = appendBytes(order, 2, fieldProto("id", 1, 1, typeInt32, ""))
+	order = appendBytes(order, 2, fieldProto("name", 2, 1, typeString, ""))
+	order = appendBytes(order, 2, fieldProto("status", 3, 1, typeEnum, ".test.Status"))
+	order = appendBytes(order, 2, fieldProto("items", 4, labelRepeated, typeInt32, ""))
+	order = appendBytes(order, 2, fieldProto("child", 5, 1, typeMessage, ".test.Order"))
+	order = appendBytes(order, 2, fieldProto("price", 6, 1, typeDouble, ""))
+
+	var shipped []byte
+	shipped = appendBytes(shipped, 1, []byte("SHIPPED"))
+	shipped = appendVarint(shipped, 2, 1)
+	var status []byte
+	status = appendBytes(status, 1, []byte("Status"))
+	status = appendBytes(status, 2, appendBytes(nil, 1, []byte("PENDING")))
+	status = appendBytes(status, 2, shipped)
+
+	var method []byte
+	method = appendBytes(method, 1, []byte("Get"))
+	method = appendBytes(method, 2, []byte(".test.Order"))
+	method = appendBytes(method, 3, []byte(".test.Order"))
+	var service []byte
+	service = appendBytes(service, 1, []byte("Shop"))
+	service = appendBytes(service, 2, method)
+
+	var file []byte
+	file = appendBytes(file, 2, []byte("test"))
+	file = appendBytes(file, 4, order)
+	file = appendBytes(file, 5, status)
+	file = appendBytes(file, 6, service)
+
+	d, err := ParseDescriptors(appendBytes(nil, 1, file))
+	if err != nil {
+		t.Fatalf("ParseDescriptors() %v", err)
+	}
+	return d
+}
+
+func TestDecodeMessage(t *testing.T) {
+	d := testDescriptors(t)
+	tests := []struct {
+		name string
+		data []byte
+		want string // JSON
+	}{
+		{"scalars", []byte{0x08, 0x2a, 0x12, 0x02, 'h', 'i'}, `{"id":42,"name":"hi"}`},
+		{"negative int32", []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, `{"id":-1}`},
+		{"enum name", []byte{0x18, 0x01}, `{"status":"SHIPPED"}`},
+		{"unknown enum value", []byte{0x18, 0x07}, `{"status":7}`},
+		{"packed repeated", []byte{0x22, 0x03, 0x01, 0x02, 0x03}, `{"items":[1,2,3]}`},
+		{"unpacked repeated", []byte{0x20, 0x01, 0x20, 0x02}, `{"items":[1,2]}`},
+		{"nested message", []byte{0x2a, 0x02, 0x08, 0x07}, `{"child":{"id":7}}`},
+		{"double", []byte{0x31, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}, `{"price":1.5}`},
+		{"unknown field", []byte{0x38, 0x05}, `{"7":{"field":7,"type":"varint","value":5}}`},
+		{"string sent as varint", []byte{0x10, 0x05}, `{"name":{"field":2,"type":"varint","value":5,"expected":"bytes"}}`},
+		{"message sent as fixed64", []byte{0x29, 1, 0, 0, 0, 0, 0, 0, 0}, `{"child":{"field":5,"type":"fixed64","value":1,"float":5e-324,"expected":"bytes"}}`},
+		{"int32 sent as bytes", []byte{0x0a, 0x02, 'h', 'i'}, `{"id":{"field":1,"type":"string","value":"hi","expected":"varint"}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := d.DecodeMessage("test.Order", test.data)
+			if err != nil {
+				t.Fatalf("DecodeMessage() %v", err)
+			}
+			got, _ := json.Marshal(message)
+			if string(got) != test.want {
+				t.Errorf("DecodeMessage() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	d := testDescriptors(t)
+	tests := []struct {
+		name     string
+		typeName string
+		data     []byte
+	}{
+		{"unknown type", "test.Missing", []byte{}},
+		{"truncated", "test.Order", []byte{0x08}},
+		{"truncated packed", "test.Order", []byte{0x22, 0x01, 0x80}},
+		{"bad nested message", "test.Order", []byte{0x2a, 0x01, 0x08}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := d.DecodeMessage(test.typeName, test.data); err == nil {
+				t.Error("DecodeMessage() succeeded")
+			}
+		})
+	}
+}
+
+func TestMethodType(t *testing.T) {
+	d := testDescriptors(t)
+	if got := d.MethodType("/test.Shop/Get", true); got != "test.Order" {
+		t.Errorf("MethodType() request = %q, want test.Order", got)
+	}
+	if got := d.MethodType("/test.Shop/Missing", false); got != "" {
+		t.Errorf("MethodType() unknown method = %q, want none", got)
+	}
+}
@@ -0,0 +1,166 @@
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+type WireType int
+
+const (
+	Varint     WireType = 0
+	Fixed64    WireType = 1
+	Bytes      WireType = 2
+	StartGroup WireType = 3
+	EndGroup   WireType = 4
+	Fixed32    WireType = 5
+)
+
+var errTruncated = errors.New("protobuf: truncated message")
+var errInvalidWireType = errors.New("protobuf: invalid wire type")
+var errTooDeep = errors.New("protobuf: groups nested too deeply")
+
+// Nesting limit of groups, as in the protobuf libraries
+const maxGroupDepth = 100
+
+func (w WireType) String() string {
+	switch w {
+	case Varint:
+		return "varint"
+	case Fixed64:
+		return "fixed64"
+	case Bytes:
+		return "bytes"
+	case StartGroup:
+		return "group"
+	case EndGroup:
+		return "endgroup"
+	case Fixed32:
+		return "fixed32"
+	}
+	return "unknown"
+}
+
+// Raw field as read off the wire.  For Bytes fields Data holds the payload,
+// for every other wire type Value holds the number.
+type rawField struct {
+	Number int
+	Type   WireType
+	Value  uint64
+	Data   []byte
+}
+
+// Read every field of a message.  An error is returned if the buffer is not a
+// well formed protobuf message.
+func readFields(buf []byte) ([]rawField, error) {
+	fields := make([]rawField, 0)
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errTruncated
+		}
+		buf = buf[n:]
+		number := int(key >> 3)
+		wireType := WireType(key & 0x7)
+		if number <= 0 || number > 536870911 {
+			return nil, errors.New("protobuf: invalid field number")
+		}
+
+		field := rawField{Number: number, Type: wireType}
+		switch wireType {
+		case Varint:
+			field.Value, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, errTruncated
+			}
+			buf = buf[n:]
+		case Fixed64:
+			if len(buf) < 8 {
+				return nil, errTruncated
+			}
+			field.Value = binary.LittleEndian.Uint64(buf)
+			buf = buf[8:]
+		case Fixed32:
+			if len(buf) < 4 {
+				return nil, errTruncated
+			}
+			field.Value = uint64(binary.LittleEndian.Uint32(buf))
+			buf = buf[4:]
+		case Bytes:
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || length > uint64(len(buf)-n) {
+				return nil, errTruncated
+			}
+			buf = buf[n:]
+			field.Data = buf[:length]
+			buf = buf[length:]
+		case StartGroup:
+			// Groups are deprecated, skip to the matching end group.
+			body, end, err := skipGroup(buf, number, 1)
+			if err != nil {
+				return nil, err
+			}
+			field.Data = buf[:body]
+			buf = buf[end:]
+		default:
+			return nil, errInvalidWireType
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// Return the length of the group body, without and with its end group tag
+func skipGroup(buf []byte, number int, depth int) (body int, end int, err error) {
+	if depth > maxGroupDepth {
+		return 0, 0, errTooDeep
+	}
+	offset := 0
+	for offset < len(buf) {
+		tag := offset
+		key, n := binary.Uvarint(buf[offset:])
+		if n <= 0 {
+			return 0, 0, errTruncated
+		}
+		offset += n
+		switch WireType(key & 0x7) {
+		case Varint:
+			_, n = binary.Uvarint(buf[offset:])
+			if n <= 0 {
+				return 0, 0, errTruncated
+			}
+			offset += n
+		case Fixed64:
+			offset += 8
+		case Fixed32:
+			offset += 4
+		case Bytes:
+			length, n := binary.Uvarint(buf[offset:])
+			if n <= 0 || length > uint64(len(buf)) {
+				return 0, 0, errTruncated
+			}
+			offset += n + int(length)
+		case StartGroup:
+			_, end, err := skipGroup(buf[offset:], int(key>>3), depth+1)
+			if err != nil {
+				return 0, 0, err
+			}
+			offset += end
+		case EndGroup:
+			if int(key>>3) != number {
+				return 0, 0, errors.New("protobuf: mismatched end group")
+			}
+			return tag, offset, nil
+		default:
+			return 0, 0, errInvalidWireType
+		}
+		if offset > len(buf) {
+			return 0, 0, errTruncated
+		}
+	}
+	return 0, 0, errTruncated
+}
+
+func decodeZigZag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
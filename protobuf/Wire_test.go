@@ -0,0 +1,108 @@
+package protobuf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		buf    []byte
+		fields []rawField
+	}{
+		{"empty", []byte{}, []rawField{}},
+		{"varint", []byte{0x08, 0x96, 0x01}, []rawField{{Number: 1, Type: Varint, Value: 150}}},
+		{"fixed64", []byte{0x09, 1, 0, 0, 0, 0, 0, 0, 0}, []rawField{{Number: 1, Type: Fixed64, Value: 1}}},
+		{"fixed32", []byte{0x0d, 1, 0, 0, 0}, []rawField{{Number: 1, Type: Fixed32, Value: 1}}},
+		{"bytes", []byte{0x12, 0x02, 'h', 'i'}, []rawField{{Number: 2, Type: Bytes, Data: []byte("hi")}}},
+		{"empty bytes", []byte{0x12, 0x00}, []rawField{{Number: 2, Type: Bytes, Data: []byte{}}}},
+		{"group", []byte{0x1b, 0x08, 0x01, 0x1c}, []rawField{{Number: 3, Type: StartGroup, Data: []byte{0x08, 0x01}}}},
+		{"nested groups", []byte{0x1b, 0x23, 0x08, 0x01, 0x24, 0x1c, 0x08, 0x02}, []rawField{
+			{Number: 3, Type: StartGroup, Data: []byte{0x23, 0x08, 0x01, 0x24}},
+			{Number: 1, Type: Varint, Value: 2},
+		}},
+		{"large field number", []byte{0xf8, 0xff, 0xff, 0xff, 0x0f, 0x01}, []rawField{{Number: 536870911, Type: Varint, Value: 1}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields, err := readFields(test.buf)
+			if err != nil {
+				t.Fatalf("readFields() %v", err)
+			}
+			if len(fields) != len(test.fields) {
+				t.Fatalf("readFields() = %d fields, want %d", len(fields), len(test.fields))
+			}
+			for i, field := range fields {
+				want := test.fields[i]
+				if field.Number != want.Number || field.Type != want.Type || field.Value != want.Value || !bytes.Equal(field.Data, want.Data) {
+					t.Errorf("field %d = %+v, want %+v", i, field, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadFieldsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+		err  string
+	}{
+		{"truncated key", []byte{0x80}, errTruncated.Error()},
+		{"truncated varint", []byte{0x08, 0x96}, errTruncated.Error()},
+		{"truncated fixed64", []byte{0x09, 1, 0, 0}, errTruncated.Error()},
+		{"truncated fixed32", []byte{0x0d, 1, 0}, errTruncated.Error()},
+		{"truncated bytes", []byte{0x12, 0x05, 'h', 'i'}, errTruncated.Error()},
+		{"truncated bytes length", []byte{0x12, 0x80}, errTruncated.Error()},
+		{"field number zero", []byte{0x00, 0x01}, "protobuf: invalid field number"},
+		{"wire type 6", []byte{0x0e, 0x01}, errInvalidWireType.Error()},
+		{"wire type 7", []byte{0x0f, 0x01}, errInvalidWireType.Error()},
+		{"unterminated group", []byte{0x1b, 0x08, 0x01}, errTruncated.Error()},
+		{"mismatched end group", []byte{0x1b, 0x24}, "protobuf: mismatched end group"},
+		{"end group without start", []byte{0x1c}, errInvalidWireType.Error()},
+		{"truncated bytes in group", []byte{0x1b, 0x12, 0x09, 0x1c}, errTruncated.Error()},
+		{"truncated fixed64 in group", []byte{0x1b, 0x09, 1, 0x1c}, errTruncated.Error()},
+		{"groups nested too deeply", deepGroups(maxGroupDepth + 1), errTooDeep.Error()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readFields(test.buf)
+			if err == nil || err.Error() != test.err {
+				t.Errorf("readFields() error = %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestReadFieldsDeepestGroup(t *testing.T) {
+	fields, err := readFields(deepGroups(maxGroupDepth))
+	if err != nil || len(fields) != 1 {
+		t.Errorf("readFields() = %d fields, %v, want 1 field", len(fields), err)
+	}
+}
+
+// depth field 1 groups, one inside the other
+func deepGroups(depth int) []byte {
+	return append(bytes.Repeat([]byte{0x0b}, depth), bytes.Repeat([]byte{0x0c}, depth)...)
+}
+
+func TestDecodeZigZag(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want int64
+	}{
+		{0, 0},
+		{1, -1},
+		{2, 1},
+		{3, -2},
+		{4294967294, 2147483647},
+		{4294967295, -2147483648},
+		{1<<64 - 1, -1 << 63},
+	}
+	for _, test := range tests {
+		if got := decodeZigZag(test.v); got != test.want {
+			t.Errorf("decodeZigZag(%d) = %d, want %d", test.v, got, test.want)
+		}
+	}
+}
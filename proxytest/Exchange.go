@@ -0,0 +1,131 @@
+package proxytest
+
+import (
+	"fmt"
+	"goproxy/api"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// How long Expect() waits for exchanges still in flight
+var WaitTimeout = time.Second
+
+// Request and response captured by the proxy
+type Exchange struct {
+	Message      *api.Message
+	RequestBody  []byte // as sent, nil when there is none
+	ResponseBody []byte
+}
+
+// URL path of the request
+func (e *Exchange) Path() string {
+	if u, err := url.Parse(e.Message.Url); err == nil {
+		return u.Path
+	}
+	return e.Message.Url
+}
+
+// Keep messages with a response, the request alone is emitted first
+func (p *Proxy) add(message *api.Message, requestBody []byte, responseBody []byte) {
+	if message.Type == api.Request {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.exchanges = append(p.exchanges, &Exchange{Message: message, RequestBody: requestBody, ResponseBody: responseBody})
+}
+
+// Exchanges with method (any when empty) whose URL path matches the path
+// regular expression, and whose request body matches the body regular
+// expression.  Empty expressions match anything.
+func (p *Proxy) Exchanges(method string, path string, body string) ([]*Exchange, error) {
+	pathRegexp, bodyRegexp, err := compile(path, body)
+	if err != nil {
+		return nil, err
+	}
+	return p.matching(method, pathRegexp, bodyRegexp), nil
+}
+
+func compile(path string, body string) (*regexp.Regexp, *regexp.Regexp, error) {
+	pathRegexp, err := regexp.Compile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid path: %w", err)
+	}
+	bodyRegexp, err := regexp.Compile(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid body: %w", err)
+	}
+	return pathRegexp, bodyRegexp, nil
+}
+
+func (p *Proxy) matching(method string, pathRegexp *regexp.Regexp, bodyRegexp *regexp.Regexp) []*Exchange {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	matching := make([]*Exchange, 0)
+	for _, e := range p.exchanges {
+		if len(method) > 0 && !strings.EqualFold(method, e.Message.Method) {
+			continue
+		}
+		if !pathRegexp.MatchString(e.Path()) || !bodyRegexp.Match(e.RequestBody) {
+			continue
+		}
+		matching = append(matching, e)
+	}
+	return matching
+}
+
+// Fail the test unless count exchanges match, see Exchanges().  Exchanges
+// in flight are waited for, up to WaitTimeout.
+func (p *Proxy) Expect(t testing.TB, count int, method string, path string, body string) []*Exchange {
+	t.Helper()
+	pathRegexp, bodyRegexp, err := compile(path, body)
+	if err != nil {
+		t.Fatalf("proxytest Expect() %v", err)
+	}
+	deadline := time.Now().Add(WaitTimeout)
+	matching := p.matching(method, pathRegexp, bodyRegexp)
+	for len(matching) < count && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		matching = p.matching(method, pathRegexp, bodyRegexp)
+	}
+	if len(matching) != count {
+		t.Fatalf("proxytest expected %d %s exchanges, got %d\n%s",
+			count, describe(method, path, body), len(matching), p.summary())
+	}
+	return matching
+}
+
+// Fail the test unless exactly one exchange matches, see Exchanges()
+func (p *Proxy) ExpectOne(t testing.TB, method string, path string, body string) *Exchange {
+	t.Helper()
+	return p.Expect(t, 1, method, path, body)[0]
+}
+
+func describe(method string, path string, body string) string {
+	if len(method) == 0 {
+		method = "*"
+	}
+	s := method + " " + path
+	if len(body) > 0 {
+		s += " body~" + body
+	}
+	return s
+}
+
+// One line per exchange captured, to show what did happen
+func (p *Proxy) summary() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.exchanges) == 0 {
+		return "no exchanges captured"
+	}
+	lines := make([]string, 0, len(p.exchanges))
+	for _, e := range p.exchanges {
+		lines = append(lines, "\t"+e.Message.Method+" "+e.Message.Url+" "+strconv.Itoa(e.Message.Status))
+	}
+	return "captured:\n" + strings.Join(lines, "\n")
+}
@@ -0,0 +1,245 @@
+// Package proxytest runs goproxy in the test process, so a test can send
+// its traffic through the proxy, mock and rewrite it, and make assertions
+// about the exchanges captured.
+//
+//	func TestOrder(t *testing.T) {
+//		p := proxytest.Start(t)
+//		p.Mock(t, proxytest.Mock{Method: "GET", Path: "^/stock$", Body: `{"count": 3}`})
+//		... run the code under test with p.Client, or p.URL as its HTTP proxy ...
+//		p.ExpectOne(t, "POST", "^/orders$", `"sku":"42"`)
+//	}
+//
+// Each test gets a proxy of its own, so tests may run in parallel.
+package proxytest
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"goproxy"
+	"goproxy/config"
+	"io"
+	"log"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// How long a proxy waits for exchanges in flight when the test ends
+const stopTimeout = time.Second
+
+type Proxy struct {
+	URL    *url.URL          // http://127.0.0.1:port
+	Client *nethttp.Client   // sends requests through the proxy, and trusts its CA
+	CA     *x509.Certificate // issues the certificates of https hosts
+
+	proxy     *goproxy.Proxy
+	mutex     sync.Mutex
+	configs   []*config.ProxyConfig // added by Configure()
+	mocks     []*mock
+	rewrites  []*config.RewriteRule
+	exchanges []*Exchange
+}
+
+// Canned response to requests with Method (any when empty) whose URL path
+// matches the Path regular expression (any when empty)
+type Mock struct {
+	Method string
+	Path   string
+	Status int // 200 when 0
+	Header map[string]string
+	Body   string
+}
+
+type mock struct {
+	Mock
+	path *regexp.Regexp
+}
+
+// Request hook answering the requests that match a mock
+type mockHook struct {
+	proxy *Proxy
+}
+
+var setupOnce sync.Once
+
+// Proxy of its own for the test, with no mocks, rewrites or exchanges, and
+// a temporary data dir.  Requests with an absolute URL and CONNECT tunnels
+// are forwarded to their host.  The proxy is stopped and its data dir
+// removed when the test ends.
+func Start(t testing.TB) *Proxy {
+	t.Helper()
+	setupOnce.Do(setup)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("proxytest.Start() %v", err)
+	}
+	p := &Proxy{}
+	instance, err := goproxy.New(goproxy.Options{
+		Listeners:   []net.Listener{listener},
+		Configs:     p.proxyConfigs(nil, nil),
+		DataDir:     t.TempDir(),
+		MemoryCa:    true,
+		ForwardHttp: true,
+		Middleware:  []interface{}{&mockHook{proxy: p}},
+	})
+	if err != nil {
+		listener.Close()
+		t.Fatalf("proxytest.Start() %v", err)
+	}
+	p.proxy = instance
+	instance.Dashboard().AddMessageListener(p.add)
+	t.Cleanup(p.stop)
+	if err := instance.Start(); err != nil {
+		t.Fatalf("proxytest.Start() %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(instance.Certificate())
+	transport := nethttp.DefaultTransport.(*nethttp.Transport).Clone()
+	transport.Proxy = nethttp.ProxyURL(instance.URL())
+	transport.TLSClientConfig.RootCAs = roots
+	p.URL = instance.URL()
+	p.Client = &nethttp.Client{Transport: transport}
+	p.CA = instance.Certificate()
+	return p
+}
+
+// The log is shared by every proxy of the process
+func setup() {
+	// goproxy logs every exchange
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+}
+
+func (p *Proxy) stop() {
+	if p.Client != nil {
+		p.Client.Transport.(*nethttp.Transport).CloseIdleConnections()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	p.proxy.Stop(ctx)
+}
+
+// Add reverse proxy configs, e.g. an http: config for the server under
+// test.  Mocks and rewrites apply to them too.
+func (p *Proxy) Configure(t testing.TB, proxyConfigs ...*config.ProxyConfig) {
+	t.Helper()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	configs := append(p.configs[:len(p.configs):len(p.configs)], proxyConfigs...)
+	if err := p.apply(configs, p.rewrites); err != nil {
+		t.Fatalf("proxytest Configure() %v", err)
+	}
+}
+
+// Answer matching requests with the mock instead of proxying them.  The
+// first matching mock wins.
+func (p *Proxy) Mock(t testing.TB, m Mock) {
+	t.Helper()
+	path, err := regexp.Compile(m.Path)
+	if err != nil {
+		t.Fatalf("proxytest Mock() invalid path: %v", err)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.mocks = append(p.mocks, &mock{Mock: m, path: path})
+}
+
+// First mock matching the request, or nil
+func (p *Proxy) findMock(request *nethttp.Request) *mock {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, m := range p.mocks {
+		if len(m.Method) > 0 && !strings.EqualFold(m.Method, request.Method) {
+			continue
+		}
+		if m.path.MatchString(request.URL.Path) {
+			return m
+		}
+	}
+	return nil
+}
+
+func (h *mockHook) OnRequest(exchange *goproxy.Exchange) {
+	m := h.proxy.findMock(exchange.Request)
+	if m == nil {
+		return
+	}
+	status := m.Status
+	if status == 0 {
+		status = nethttp.StatusOK
+	}
+	header := make(nethttp.Header)
+	for key, value := range m.Header {
+		header.Set(key, value)
+	}
+	exchange.Response = &nethttp.Response{
+		Status:        strconv.Itoa(status) + " " + nethttp.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(m.Body)),
+		Request:       exchange.Request,
+	}
+	exchange.ResponseBody = []byte(m.Body)
+}
+
+// Trust cert, e.g. of an httptest.NewTLSServer(), for https upstreams
+func (p *Proxy) TrustUpstream(cert *x509.Certificate) {
+	p.proxy.TrustUpstream(cert)
+}
+
+// Apply a rewrite rule to matching requests, after the rules added before
+func (p *Proxy) Rewrite(t testing.TB, rule *config.RewriteRule) {
+	t.Helper()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(rule.Name) == 0 {
+		named := *rule
+		named.Name = "rewrite " + strconv.Itoa(len(p.rewrites)+1)
+		rule = &named
+	}
+	rewrites := append(p.rewrites[:len(p.rewrites):len(p.rewrites)], rule)
+	if err := p.apply(p.configs, rewrites); err != nil {
+		t.Fatalf("proxytest Rewrite() %v", err)
+	}
+}
+
+// Activate the forward proxy config and the configs, with the rewrites, and
+// keep them if they are valid
+func (p *Proxy) apply(configs []*config.ProxyConfig, rewrites []*config.RewriteRule) error {
+	if err := p.proxy.ApplyConfig(p.proxyConfigs(configs, rewrites)); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	p.configs, p.rewrites = configs, rewrites
+	return nil
+}
+
+// The forward proxy config and the configs, with the rewrites.  The configs
+// passed in are not changed.
+func (p *Proxy) proxyConfigs(configs []*config.ProxyConfig, rewrites []*config.RewriteRule) []*config.ProxyConfig {
+	proxyConfigs := []*config.ProxyConfig{{
+		Protocol:      config.Browser,
+		Path:          "/",
+		Recording:     true,
+		HostReachable: true,
+	}}
+	for _, proxyConfig := range configs {
+		c := *proxyConfig
+		proxyConfigs = append(proxyConfigs, &c)
+	}
+	for _, proxyConfig := range proxyConfigs {
+		proxyConfig.Rewrites = append(append([]*config.RewriteRule{}, proxyConfig.Rewrites...), rewrites...)
+	}
+	return proxyConfigs
+}
@@ -0,0 +1,165 @@
+package proxytest_test
+
+import (
+	"encoding/json"
+	"goproxy/api"
+	"goproxy/config"
+	"goproxy/proxytest"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Shop answering POST /orders, and counting the requests it gets
+func newShop(t *testing.T, requests *int32) *httptest.Server {
+	shop := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.Method != nethttp.MethodPost || !strings.HasSuffix(r.URL.Path, "/orders") {
+			nethttp.NotFound(w, r)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(nethttp.StatusCreated)
+		io.WriteString(w, `{"id": 7, "status": "pending"}`)
+	}))
+	t.Cleanup(shop.Close)
+	return shop
+}
+
+func send(t *testing.T, client *nethttp.Client, method string, url string, body string) (*nethttp.Response, string) {
+	t.Helper()
+	request, err := nethttp.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(data)
+}
+
+func TestMockRewriteExpect(t *testing.T) {
+	var requests int32
+	shop := newShop(t, &requests)
+
+	p := proxytest.Start(t)
+	p.Mock(t, proxytest.Mock{Method: "GET", Path: "^/stock$", Body: `{"count": 3}`})
+	p.Rewrite(t, &config.RewriteRule{
+		Path: "^/orders$",
+		Response: &config.Rewrite{
+			SetHeaders: map[string]string{"cache-control": "no-store"},
+			JsonSet:    map[string]interface{}{"$.status": "accepted"},
+		},
+	})
+
+	res, body := send(t, p.Client, "GET", shop.URL+"/stock", "")
+	if res.StatusCode != nethttp.StatusOK || body != `{"count": 3}` {
+		t.Fatalf("GET /stock = %d %s, want the mock", res.StatusCode, body)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("shop got %d requests, want the mock to answer", n)
+	}
+
+	res, body = send(t, p.Client, "POST", shop.URL+"/orders", `{"sku":"42"}`)
+	if res.StatusCode != nethttp.StatusCreated {
+		t.Fatalf("POST /orders = %d %s", res.StatusCode, body)
+	}
+	if res.Header.Get("cache-control") != "no-store" {
+		t.Errorf("cache-control = %q, want the rewritten header", res.Header.Get("cache-control"))
+	}
+	var order map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &order); err != nil || order["status"] != "accepted" {
+		t.Errorf("POST /orders body = %s, want the rewritten status", body)
+	}
+
+	p.ExpectOne(t, "GET", "^/stock$", "")
+	exchange := p.ExpectOne(t, "POST", "^/orders$", `"sku":"42"`)
+	if exchange.Message.Status != nethttp.StatusCreated {
+		t.Errorf("captured status = %d, want %d", exchange.Message.Status, nethttp.StatusCreated)
+	}
+	if !strings.Contains(string(exchange.ResponseBody), "accepted") {
+		t.Errorf("captured response = %s, want the rewritten body", exchange.ResponseBody)
+	}
+	if exchanges, err := p.Exchanges("", "", ""); err != nil || len(exchanges) != 2 {
+		t.Errorf("Exchanges() = %d, %v, want 2", len(exchanges), err)
+	}
+	if _, err := p.Exchanges("", "(", ""); err == nil {
+		t.Error("Exchanges() with an invalid path succeeded")
+	}
+}
+
+func TestHttpsUpstream(t *testing.T) {
+	var requests int32
+	shop := httptest.NewTLSServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("content-type", "application/json")
+		io.WriteString(w, `{"count": 5}`)
+	}))
+	t.Cleanup(shop.Close)
+
+	p := proxytest.Start(t)
+	p.TrustUpstream(shop.Certificate())
+	p.Mock(t, proxytest.Mock{Method: "POST", Path: "^/orders$", Status: nethttp.StatusCreated,
+		Header: map[string]string{"location": "/orders/1"}})
+
+	res, body := send(t, p.Client, "GET", shop.URL+"/stock", "")
+	if res.StatusCode != nethttp.StatusOK || body != `{"count": 5}` {
+		t.Fatalf("GET /stock = %d %s, want the shop's response", res.StatusCode, body)
+	}
+	res, body = send(t, p.Client, "POST", shop.URL+"/orders", `{"sku":"42"}`)
+	if res.StatusCode != nethttp.StatusCreated || res.Header.Get("location") != "/orders/1" || body != "" {
+		t.Fatalf("POST /orders = %d %v %s, want the mock", res.StatusCode, res.Header, body)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("shop got %d requests, want 1", n)
+	}
+
+	exchange := p.ExpectOne(t, "GET", "^/stock$", "")
+	if exchange.Message.Protocol != api.Https || string(exchange.ResponseBody) != `{"count": 5}` {
+		t.Errorf("captured %s %s, want the https exchange", exchange.Message.Protocol, exchange.ResponseBody)
+	}
+	exchange = p.ExpectOne(t, "POST", "^/orders$", `"sku":"42"`)
+	if exchange.Message.Status != nethttp.StatusCreated {
+		t.Errorf("captured status = %d, want the mock's", exchange.Message.Status)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	var requests int32
+	shop := newShop(t, &requests)
+	shopUrl, _ := url.Parse(shop.URL)
+	host, port, _ := net.SplitHostPort(shopUrl.Host)
+	portNumber, _ := strconv.Atoi(port)
+
+	p := proxytest.Start(t)
+	p.Configure(t, &config.ProxyConfig{
+		Protocol:      config.Http,
+		Path:          "/shop",
+		Hostname:      host,
+		Port:          portNumber,
+		Recording:     true,
+		HostReachable: true,
+	})
+
+	// The proxy is the server, as for a client configured with its address
+	res, body := send(t, &nethttp.Client{}, "POST", p.URL.String()+"/shop/orders", `{"sku":"7"}`)
+	if res.StatusCode != nethttp.StatusCreated {
+		t.Fatalf("POST /shop/orders = %d %s", res.StatusCode, body)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("shop got %d requests, want 1", n)
+	}
+	p.ExpectOne(t, "POST", "/orders$", `"sku":"7"`)
+}
@@ -0,0 +1,58 @@
+package rewrite
+
+import (
+	"goproxy/config"
+	"net/http"
+)
+
+const corsMaxAge = "600" // seconds browsers may cache a preflight answer
+
+// First rule with a CORS preset, if the request is a CORS preflight that
+// goproxy should answer itself
+func PreflightRule(rules []*config.RewriteRule, request *http.Request) *config.RewriteRule {
+	if request.Method != http.MethodOptions ||
+		len(request.Header.Get("origin")) == 0 ||
+		len(request.Header.Get("access-control-request-method")) == 0 {
+		return nil
+	}
+	for _, rule := range rules {
+		if len(rule.Cors) > 0 {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Set the CORS response headers of the preset for request.  False if
+// nothing was set.
+func Cors(preset config.CorsPreset, request *http.Request, header http.Header) bool {
+	switch preset {
+	case config.PermissiveCors:
+		header.Set("access-control-allow-origin", "*")
+		header.Set("access-control-allow-methods", "*")
+		header.Set("access-control-allow-headers", "*")
+		header.Set("access-control-expose-headers", "*")
+		header.Del("access-control-allow-credentials")
+	case config.CredentialsCors:
+		// Wildcards are not allowed with credentials, so echo what was asked for
+		origin := request.Header.Get("origin")
+		if len(origin) == 0 {
+			return false // not a cross-origin request
+		}
+		header.Set("access-control-allow-origin", origin)
+		header.Set("access-control-allow-credentials", "true")
+		if method := request.Header.Get("access-control-request-method"); len(method) > 0 {
+			header.Set("access-control-allow-methods", method)
+		}
+		if headers := request.Header.Get("access-control-request-headers"); len(headers) > 0 {
+			header.Set("access-control-allow-headers", headers)
+		}
+		header.Add("vary", "Origin")
+	default:
+		return false
+	}
+	if request.Method == http.MethodOptions {
+		header.Set("access-control-max-age", corsMaxAge)
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package rewrite
+
+import (
+	"bytes"
+	"goproxy/config"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var cspHeaders = []string{"content-security-policy", "content-security-policy-report-only"}
+
+var cspMeta = regexp.MustCompile(`(?i)<meta[^>]+http-equiv\s*=\s*["']?content-security-policy[^>]*>`)
+
+func isHtml(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("content-type"))
+	return mediaType == "text/html"
+}
+
+// Insert the snippet before </head> or </body> of a page.  False if the
+// page was left alone.
+func inject(injection *config.Injection, injectDir string, header http.Header, body []byte) ([]byte, bool) {
+	snippet := injectSnippet(injection, injectDir)
+	if len(snippet) == 0 {
+		return body, false
+	}
+	page, ok := decodeBody(header, body)
+	if !ok {
+		return body, false
+	}
+	if injection.RelaxCsp {
+		page = cspMeta.ReplaceAll(page, nil)
+	}
+
+	lower := bytes.ToLower(page)
+	at := -1
+	if injection.Position == config.HeadEnd {
+		at = bytes.Index(lower, []byte("</head>"))
+	}
+	if at < 0 {
+		at = bytes.LastIndex(lower, []byte("</body>"))
+	}
+	if at < 0 {
+		at = len(page)
+	}
+	injected := make([]byte, 0, len(page)+len(snippet))
+	injected = append(injected, page[:at]...)
+	injected = append(injected, snippet...)
+	injected = append(injected, page[at:]...)
+	return injected, true
+}
+
+// Snippet of the injection, or its file read from injectDir.  The file is
+// read for every page, so edits show on reload.
+func injectSnippet(injection *config.Injection, injectDir string) []byte {
+	if len(injection.File) == 0 {
+		return []byte(injection.Snippet)
+	}
+	data, err := os.ReadFile(filepath.Join(injectDir, injection.File))
+	if err != nil {
+		log.Println("Inject injectSnippet()", err)
+		return nil
+	}
+	if strings.EqualFold(filepath.Ext(injection.File), ".js") {
+		data = append(append([]byte("<script>\n"), bytes.TrimSpace(data)...), "\n</script>"...)
+	}
+	return data
+}
@@ -0,0 +1,288 @@
+package rewrite
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"goproxy/config"
+	"goproxy/jsonpath"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var regexps sync.Map // compiled rule patterns, key=pattern
+
+// Request headers that let the upstream answer 304 Not Modified
+var conditionalHeaders = []string{"if-none-match", "if-modified-since"}
+
+// Response headers that let the browser cache or revalidate
+var cacheHeaders = []string{"cache-control", "etag", "last-modified", "expires"}
+
+// Rules of a config that apply to the request, in config order
+func Matching(rules []*config.RewriteRule, request *http.Request, scheme string) []*config.RewriteRule {
+	matching := make([]*config.RewriteRule, 0)
+	for _, rule := range rules {
+		if len(rule.Path) > 0 {
+			re := compile(rule.Path)
+			if re == nil || !re.MatchString(request.URL.Path) {
+				continue
+			}
+		}
+		if !rule.Match.Matches(request, scheme) {
+			continue
+		}
+		matching = append(matching, rule)
+	}
+	return matching
+}
+
+// Apply the request side of the rules to a request about to be sent
+// upstream.  Returns the names of the rules that changed it.
+func Request(rules []*config.RewriteRule, request *http.Request) []string {
+	applied := make([]string, 0)
+	var body []byte
+	bodyRead := false
+	bodyChanged := false
+	for _, rule := range rules {
+		changed := false
+		if rule.NoCache {
+			changed = removeHeaders(request.Header, conditionalHeaders) || changed
+		}
+		if rule.Request != nil && contentTypeMatches(rule, request.Header) {
+			changed = changeHeaders(rule.Request, request.Header) || changed
+			if hasBodyChanges(rule.Request) && request.Body != nil {
+				if !bodyRead {
+					body = readBody(request.Body)
+					bodyRead = true
+				}
+				var ok bool
+				if body, ok = changeBody(rule.Request, request.Header, body); ok {
+					request.Header.Del("content-encoding")
+					changed = true
+					bodyChanged = true
+				}
+			}
+		}
+		if rule.Inject != nil && len(request.Header.Get("accept-encoding")) > 0 {
+			// Only encodings that can be decoded for the injection
+			request.Header.Set("accept-encoding", "gzip, deflate")
+		}
+		if changed {
+			applied = append(applied, rule.Name)
+		}
+	}
+	if bodyRead {
+		if bodyChanged {
+			request.Header.Set("content-length", strconv.Itoa(len(body)))
+			request.ContentLength = int64(len(body))
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		request.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	return applied
+}
+
+// Apply the response side of the rules to an upstream response whose body
+// has been read.  Returns the body to send and the names of the rules that
+// changed the response.  Injection files are read from injectDir.
+func Response(rules []*config.RewriteRule, res *http.Response, body []byte, injectDir string) ([]byte, []string) {
+	applied := make([]string, 0)
+	bodyChanged := false
+	for _, rule := range rules {
+		changed := false
+		if rule.Status != 0 && rule.Status != res.StatusCode {
+			res.StatusCode = rule.Status
+			res.Status = strconv.Itoa(rule.Status) + " " + http.StatusText(rule.Status)
+			changed = true
+		}
+		if len(rule.Cors) > 0 {
+			changed = Cors(rule.Cors, res.Request, res.Header) || changed
+		}
+		if rule.NoCache {
+			removeHeaders(res.Header, cacheHeaders)
+			res.Header.Set("cache-control", "no-store")
+			changed = true
+		}
+		if rule.Response != nil && contentTypeMatches(rule, res.Header) {
+			changed = changeHeaders(rule.Response, res.Header) || changed
+			if hasBodyChanges(rule.Response) {
+				var ok bool
+				if body, ok = changeBody(rule.Response, res.Header, body); ok {
+					res.Header.Del("content-encoding")
+					changed = true
+					bodyChanged = true
+				}
+			}
+		}
+		if rule.Inject != nil && isHtml(res.Header) && contentTypeMatches(rule, res.Header) {
+			if rule.Inject.RelaxCsp {
+				changed = removeHeaders(res.Header, cspHeaders) || changed
+			}
+			var ok bool
+			if body, ok = inject(rule.Inject, injectDir, res.Header, body); ok {
+				res.Header.Del("content-encoding")
+				changed = true
+				bodyChanged = true
+			}
+		}
+		if changed {
+			applied = append(applied, rule.Name)
+		}
+	}
+	if bodyChanged {
+		res.Header.Set("content-length", strconv.Itoa(len(body)))
+		res.ContentLength = int64(len(body))
+	}
+	return body, applied
+}
+
+func contentTypeMatches(rule *config.RewriteRule, header http.Header) bool {
+	if len(rule.ContentType) == 0 {
+		return true
+	}
+	re := compile(rule.ContentType)
+	return re != nil && re.MatchString(header.Get("content-type"))
+}
+
+// Remove, set then add headers.  True if anything changed.
+func changeHeaders(r *config.Rewrite, header http.Header) bool {
+	changed := removeHeaders(header, r.RemoveHeaders)
+	for name, value := range r.SetHeaders {
+		header.Set(name, value)
+		changed = true
+	}
+	for name, value := range r.AddHeaders {
+		header.Add(name, value)
+		changed = true
+	}
+	return changed
+}
+
+func removeHeaders(header http.Header, names []string) bool {
+	removed := false
+	for _, name := range names {
+		if len(header.Values(name)) > 0 {
+			header.Del(name)
+			removed = true
+		}
+	}
+	return removed
+}
+
+func hasBodyChanges(r *config.Rewrite) bool {
+	return len(r.Replace) > 0 || len(r.JsonSet) > 0 || len(r.JsonDelete) > 0
+}
+
+// Apply the regular expression replacements, then the JSONPath changes.  A
+// compressed body is decoded first; the caller removes Content-Encoding when
+// the body changed.
+func changeBody(r *config.Rewrite, header http.Header, body []byte) ([]byte, bool) {
+	decoded, ok := decodeBody(header, body)
+	if !ok {
+		return body, false
+	}
+	changed := decoded
+	for _, replace := range r.Replace {
+		if re := compile(replace.Pattern); re != nil {
+			changed = re.ReplaceAll(changed, []byte(replace.Replacement))
+		}
+	}
+	if len(r.JsonSet) > 0 || len(r.JsonDelete) > 0 {
+		changed = changeJson(r, changed)
+	}
+	if bytes.Equal(changed, decoded) {
+		return body, false
+	}
+	return changed, true
+}
+
+func changeJson(r *config.Rewrite, body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		log.Println("Rules changeJson() body is not JSON:", err)
+		return body
+	}
+	count := 0
+	for expr, value := range r.JsonSet {
+		if path, err := jsonpath.Parse(expr); err == nil {
+			count += path.Set(doc, value)
+		}
+	}
+	for _, expr := range r.JsonDelete {
+		if path, err := jsonpath.Parse(expr); err == nil {
+			var n int
+			doc, n = path.Delete(doc)
+			count += n
+		}
+	}
+	if count == 0 {
+		return body
+	}
+	changed, err := json.Marshal(doc)
+	if err != nil {
+		log.Println("Rules changeJson()", err)
+		return body
+	}
+	return changed
+}
+
+// Body with any gzip or deflate content encoding removed.  False if the
+// encoding is not supported or the body cannot be decoded.
+func decodeBody(header http.Header, body []byte) ([]byte, bool) {
+	var reader io.ReadCloser
+	var err error
+	switch encoding := strings.ToLower(header.Get("content-encoding")); encoding {
+	case "", "identity":
+		return body, true
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		log.Printf("Rules decodeBody() content encoding %q is not supported\n", encoding)
+		return body, false
+	}
+	if err != nil {
+		log.Println("Rules decodeBody()", err)
+		return body, false
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		log.Println("Rules decodeBody()", err)
+		return body, false
+	}
+	return decoded, true
+}
+
+func readBody(body io.ReadCloser) []byte {
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		log.Println("Rules readBody()", err)
+	}
+	return data
+}
+
+func compile(pattern string) *regexp.Regexp {
+	if re, ok := regexps.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Println("Rules compile()", err)
+		return nil
+	}
+	regexps.Store(pattern, re)
+	return re
+}
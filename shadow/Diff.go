@@ -0,0 +1,209 @@
+package shadow
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"goproxy/api"
+	"goproxy/config"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Headers that differ between any two responses
+var defaultIgnoreHeaders = []string{
+	"Date", "Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length", "Server-Timing",
+}
+
+// Response to compare
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+var ignoreRegexps sync.Map // compiled IgnorePaths, key=path
+
+// Differences in status, headers and body.  JSON bodies are compared value
+// by value, other bodies as a whole.
+func Compare(primary *Response, shadow *Response, settings *config.Shadow) []*api.Difference {
+	differences := make([]*api.Difference, 0)
+	if primary.Status != shadow.Status {
+		differences = append(differences, &api.Difference{
+			Kind:    api.StatusDifference,
+			Primary: primary.Status,
+			Shadow:  shadow.Status,
+		})
+	}
+	differences = append(differences, compareHeaders(primary.Header, shadow.Header, settings.IgnoreHeaders)...)
+
+	primaryBody := decodedBody(primary)
+	shadowBody := decodedBody(shadow)
+	var primaryJson, shadowJson interface{}
+	if json.Unmarshal(primaryBody, &primaryJson) == nil && json.Unmarshal(shadowBody, &shadowJson) == nil {
+		ignore := ignoreMatcher(settings.IgnorePaths)
+		compareJson("$", primaryJson, shadowJson, ignore, &differences)
+	} else if !bytes.Equal(primaryBody, shadowBody) {
+		differences = append(differences, &api.Difference{
+			Kind:    api.BodyDifference,
+			Primary: string(primaryBody),
+			Shadow:  string(shadowBody),
+		})
+	}
+	return differences
+}
+
+func compareHeaders(primary http.Header, shadow http.Header, ignoreHeaders []string) []*api.Difference {
+	ignore := make(map[string]bool)
+	for _, name := range append(defaultIgnoreHeaders, ignoreHeaders...) {
+		ignore[http.CanonicalHeaderKey(name)] = true
+	}
+	names := make(map[string]bool)
+	for name := range primary {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range shadow {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !ignore[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	differences := make([]*api.Difference, 0)
+	for _, name := range sorted {
+		primaryValue, primaryOk := headerValue(primary, name)
+		shadowValue, shadowOk := headerValue(shadow, name)
+		if primaryOk == shadowOk && primaryValue == shadowValue {
+			continue
+		}
+		difference := &api.Difference{Kind: api.HeaderDifference, Path: name}
+		if primaryOk {
+			difference.Primary = primaryValue
+		}
+		if shadowOk {
+			difference.Shadow = shadowValue
+		}
+		differences = append(differences, difference)
+	}
+	return differences
+}
+
+func headerValue(header http.Header, name string) (string, bool) {
+	values := header.Values(name)
+	return strings.Join(values, ", "), len(values) > 0
+}
+
+// Body with any gzip content encoding removed
+func decodedBody(response *Response) []byte {
+	if !strings.EqualFold(response.Header.Get("content-encoding"), "gzip") {
+		return response.Body
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(response.Body))
+	if err != nil {
+		return response.Body
+	}
+	defer reader.Close()
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return response.Body
+	}
+	return body
+}
+
+func compareJson(path string, primary interface{}, shadow interface{}, ignore func(string) bool, differences *[]*api.Difference) {
+	if ignore(path) {
+		return
+	}
+	switch p := primary.(type) {
+	case map[string]interface{}:
+		if s, ok := shadow.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(p)+len(s))
+			for key := range p {
+				keys = append(keys, key)
+			}
+			for key := range s {
+				if _, ok := p[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				childPath := path + "." + key
+				primaryValue, primaryOk := p[key]
+				shadowValue, shadowOk := s[key]
+				if primaryOk && shadowOk {
+					compareJson(childPath, primaryValue, shadowValue, ignore, differences)
+				} else if !ignore(childPath) {
+					*differences = append(*differences, &api.Difference{
+						Kind: api.BodyDifference, Path: childPath, Primary: primaryValue, Shadow: shadowValue,
+					})
+				}
+			}
+			return
+		}
+	case []interface{}:
+		if s, ok := shadow.([]interface{}); ok {
+			for i := 0; i < len(p) || i < len(s); i++ {
+				childPath := path + "[" + strconv.Itoa(i) + "]"
+				switch {
+				case i < len(p) && i < len(s):
+					compareJson(childPath, p[i], s[i], ignore, differences)
+				case i < len(p):
+					if !ignore(childPath) {
+						*differences = append(*differences, &api.Difference{
+							Kind: api.BodyDifference, Path: childPath, Primary: p[i],
+						})
+					}
+				default:
+					if !ignore(childPath) {
+						*differences = append(*differences, &api.Difference{
+							Kind: api.BodyDifference, Path: childPath, Shadow: s[i],
+						})
+					}
+				}
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(primary, shadow) {
+		*differences = append(*differences, &api.Difference{
+			Kind: api.BodyDifference, Path: path, Primary: primary, Shadow: shadow,
+		})
+	}
+}
+
+// Match JSON paths against the ignore list.  "[*]" matches any index and
+// ".*" any key, and ignoring a path ignores everything below it.
+func ignoreMatcher(ignorePaths []string) func(string) bool {
+	regexps := make([]*regexp.Regexp, 0, len(ignorePaths))
+	for _, ignorePath := range ignorePaths {
+		if re, ok := ignoreRegexps.Load(ignorePath); ok {
+			regexps = append(regexps, re.(*regexp.Regexp))
+			continue
+		}
+		pattern := regexp.QuoteMeta(ignorePath)
+		pattern = strings.ReplaceAll(pattern, `\[\*\]`, `\[[0-9]+\]`)
+		pattern = strings.ReplaceAll(pattern, `\.\*`, `\.[^.\[]+`)
+		re := regexp.MustCompile("^" + pattern + `($|[.\[])`)
+		ignoreRegexps.Store(ignorePath, re)
+		regexps = append(regexps, re)
+	}
+	return func(path string) bool {
+		for _, re := range regexps {
+			if re.MatchString(path) {
+				return true
+			}
+		}
+		return false
+	}
+}
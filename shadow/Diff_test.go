@@ -0,0 +1,109 @@
+package shadow
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"goproxy/config"
+	"net/http"
+	"testing"
+)
+
+func gzipped(data string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(data))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary *Response
+		shadow  *Response
+		ignore  *config.Shadow
+		want    string // JSON
+	}{
+		{"equal",
+			&Response{200, http.Header{"Content-Type": {"text/plain"}}, []byte("a")},
+			&Response{200, http.Header{"Content-Type": {"text/plain"}}, []byte("a")},
+			&config.Shadow{}, `[]`},
+		{"status",
+			&Response{200, http.Header{}, nil},
+			&Response{500, http.Header{}, nil},
+			&config.Shadow{}, `[{"kind":"status","primary":200,"shadow":500}]`},
+		{"header values and missing headers",
+			&Response{200, http.Header{"A": {"1"}, "B": {"1", "2"}}, nil},
+			&Response{200, http.Header{"A": {"2"}, "C": {"1"}}, nil},
+			&config.Shadow{}, `[{"kind":"header","path":"A","primary":"1","shadow":"2"},{"kind":"header","path":"B","primary":"1, 2","shadow":null},{"kind":"header","path":"C","primary":null,"shadow":"1"}]`},
+		{"default and configured ignored headers",
+			&Response{200, http.Header{"Date": {"1"}, "X-Request-Id": {"1"}}, nil},
+			&Response{200, http.Header{"Date": {"2"}, "X-Request-Id": {"2"}}, nil},
+			&config.Shadow{IgnoreHeaders: []string{"x-request-id"}}, `[]`},
+		{"text body",
+			&Response{200, http.Header{}, []byte("a")},
+			&Response{200, http.Header{}, []byte("b")},
+			&config.Shadow{}, `[{"kind":"body","primary":"a","shadow":"b"}]`},
+		{"json and text body",
+			&Response{200, http.Header{}, []byte(`{"a":1}`)},
+			&Response{200, http.Header{}, []byte("a")},
+			&config.Shadow{}, `[{"kind":"body","primary":"{\"a\":1}","shadow":"a"}]`},
+		{"json key order and spacing",
+			&Response{200, http.Header{}, []byte(`{"a":1,"b":2}`)},
+			&Response{200, http.Header{}, []byte(`{ "b": 2, "a": 1 }`)},
+			&config.Shadow{}, `[]`},
+		{"json values",
+			&Response{200, http.Header{}, []byte(`{"a":{"b":1},"c":[1,2],"d":true}`)},
+			&Response{200, http.Header{}, []byte(`{"a":{"b":2},"c":[1],"e":null}`)},
+			&config.Shadow{}, `[{"kind":"body","path":"$.a.b","primary":1,"shadow":2},{"kind":"body","path":"$.c[1]","primary":2,"shadow":null},{"kind":"body","path":"$.d","primary":true,"shadow":null},{"kind":"body","path":"$.e","primary":null,"shadow":null}]`},
+		{"json type change",
+			&Response{200, http.Header{}, []byte(`{"a":[1]}`)},
+			&Response{200, http.Header{}, []byte(`{"a":{"0":1}}`)},
+			&config.Shadow{}, `[{"kind":"body","path":"$.a","primary":[1],"shadow":{"0":1}}]`},
+		{"ignored path",
+			&Response{200, http.Header{}, []byte(`{"id":1,"name":"a"}`)},
+			&Response{200, http.Header{}, []byte(`{"id":2,"name":"a"}`)},
+			&config.Shadow{IgnorePaths: []string{"$.id"}}, `[]`},
+		{"ignored path is not a prefix match",
+			&Response{200, http.Header{}, []byte(`{"id":1,"idx":1}`)},
+			&Response{200, http.Header{}, []byte(`{"id":2,"idx":2}`)},
+			&config.Shadow{IgnorePaths: []string{"$.id"}}, `[{"kind":"body","path":"$.idx","primary":1,"shadow":2}]`},
+		{"ignored path covers children",
+			&Response{200, http.Header{}, []byte(`{"meta":{"a":1,"b":[1]}}`)},
+			&Response{200, http.Header{}, []byte(`{"meta":{"a":2}}`)},
+			&config.Shadow{IgnorePaths: []string{"$.meta"}}, `[]`},
+		{"ignored missing key",
+			&Response{200, http.Header{}, []byte(`{"a":1}`)},
+			&Response{200, http.Header{}, []byte(`{"a":1,"b":2}`)},
+			&config.Shadow{IgnorePaths: []string{"$.b"}}, `[]`},
+		{"ignored array wildcard",
+			&Response{200, http.Header{}, []byte(`{"items":[{"id":1,"at":1},{"id":2,"at":1}]}`)},
+			&Response{200, http.Header{}, []byte(`{"items":[{"id":1,"at":2},{"id":3,"at":2}]}`)},
+			&config.Shadow{IgnorePaths: []string{"$.items[*].at"}}, `[{"kind":"body","path":"$.items[1].id","primary":2,"shadow":3}]`},
+		{"ignored key wildcard",
+			&Response{200, http.Header{}, []byte(`{"a":{"at":1},"b":{"at":1,"x":1}}`)},
+			&Response{200, http.Header{}, []byte(`{"a":{"at":2},"b":{"at":2,"x":2}}`)},
+			&config.Shadow{IgnorePaths: []string{"$.*.at"}}, `[{"kind":"body","path":"$.b.x","primary":1,"shadow":2}]`},
+		{"ignored extra array element",
+			&Response{200, http.Header{}, []byte(`[1]`)},
+			&Response{200, http.Header{}, []byte(`[1,2]`)},
+			&config.Shadow{IgnorePaths: []string{"$[*]"}}, `[]`},
+		{"gzip body",
+			&Response{200, http.Header{"Content-Encoding": {"gzip"}}, gzipped(`{"a":1}`)},
+			&Response{200, http.Header{}, []byte(`{"a":2}`)},
+			&config.Shadow{}, `[{"kind":"header","path":"Content-Encoding","primary":"gzip","shadow":null},{"kind":"body","path":"$.a","primary":1,"shadow":2}]`},
+		{"bad gzip body",
+			&Response{200, http.Header{"Content-Encoding": {"gzip"}}, []byte("a")},
+			&Response{200, http.Header{"Content-Encoding": {"gzip"}}, []byte("a")},
+			&config.Shadow{}, `[]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _ := json.Marshal(Compare(test.primary, test.shadow, test.ignore))
+			if string(got) != test.want {
+				t.Errorf("Compare() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package shaping
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const minBurst = 512 // bytes
+
+// Token bucket holding up to 100ms worth of bytes.  A nil bucket is
+// unlimited.
+type bucket struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(float64(rate)/10, minBurst)
+	return &bucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Largest amount to take at once
+func (b *bucket) capacity() int {
+	if b == nil {
+		return math.MaxInt32
+	}
+	return int(b.burst)
+}
+
+// Wait for n bytes worth of tokens
+func (b *bucket) take(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mutex.Unlock()
+	time.Sleep(wait)
+}
@@ -0,0 +1,167 @@
+package shaping
+
+import (
+	"fmt"
+	"goproxy/config"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Applies one Shaping rule to a connection or an HTTP exchange
+type Shaper struct {
+	rule      *config.Shaping
+	upload    *bucket
+	download  *bucket
+	drop      bool // decided up front, so the message can show it
+	mutex     sync.Mutex
+	lastStall time.Time
+}
+
+func New(rule *config.Shaping) *Shaper {
+	return &Shaper{
+		rule:      rule,
+		upload:    newBucket(rule.UploadRate),
+		download:  newBucket(rule.DownloadRate),
+		drop:      rule.DropProbability > 0 && rand.Float64() < rule.DropProbability,
+		lastStall: time.Now(),
+	}
+}
+
+// Description of each condition applied, shown on the message
+func (s *Shaper) Applied() []string {
+	applied := make([]string, 0)
+	if s.rule.Latency > 0 || s.rule.Jitter > 0 {
+		if s.rule.Jitter > 0 {
+			applied = append(applied, fmt.Sprintf("latency %d±%dms", s.rule.Latency, s.rule.Jitter))
+		} else {
+			applied = append(applied, fmt.Sprintf("latency %dms", s.rule.Latency))
+		}
+	}
+	if s.rule.UploadRate > 0 {
+		applied = append(applied, fmt.Sprintf("upload %d B/s", s.rule.UploadRate))
+	}
+	if s.rule.DownloadRate > 0 {
+		applied = append(applied, fmt.Sprintf("download %d B/s", s.rule.DownloadRate))
+	}
+	if s.rule.StallEvery > 0 {
+		applied = append(applied, fmt.Sprintf("stall %dms every %ds", s.rule.StallFor, s.rule.StallEvery))
+	}
+	if s.drop {
+		applied = append(applied, "drop mid-response")
+	}
+	return applied
+}
+
+func (s *Shaper) Rule() *config.Shaping {
+	return s.rule
+}
+
+// Will the connection be dropped mid-response?
+func (s *Shaper) Drop() bool {
+	return s.drop
+}
+
+// Sleep for the latency, varied by up to +/- jitter
+func (s *Shaper) Delay() {
+	delay := s.rule.Latency
+	if s.rule.Jitter > 0 {
+		delay += rand.Intn(2*s.rule.Jitter+1) - s.rule.Jitter
+	}
+	if delay > 0 {
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+}
+
+// Wait until n bytes may be sent upstream
+func (s *Shaper) Upload(n int) {
+	s.stall()
+	s.upload.take(n)
+}
+
+// Wait until n bytes may be sent to the client
+func (s *Shaper) Download(n int) {
+	s.stall()
+	s.download.take(n)
+}
+
+// Largest write that keeps the download rate smooth
+func (s *Shaper) DownloadChunk() int {
+	return s.download.capacity()
+}
+
+func (s *Shaper) stall() {
+	if s.rule.StallEvery <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	now := time.Now()
+	due := now.Sub(s.lastStall) >= time.Duration(s.rule.StallEvery)*time.Second
+	if due {
+		s.lastStall = now.Add(time.Duration(s.rule.StallFor) * time.Millisecond)
+	}
+	s.mutex.Unlock()
+	if due {
+		time.Sleep(time.Duration(s.rule.StallFor) * time.Millisecond)
+	}
+}
+
+// Request body reader limited to the upload rate
+func (s *Shaper) Reader(reader io.ReadCloser) io.ReadCloser {
+	return &shapedReader{ReadCloser: reader, shaper: s}
+}
+
+type shapedReader struct {
+	io.ReadCloser
+	shaper *Shaper
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	if chunk := r.shaper.upload.capacity(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.shaper.Upload(n)
+	return n, err
+}
+
+// Shape a tunnelled client connection: reads are uploads and writes are
+// downloads.  Latency and drops are left to the HTTP exchanges inside the
+// tunnel.
+func (s *Shaper) Conn(conn net.Conn) net.Conn {
+	return &shapedConn{Conn: conn, shaper: s}
+}
+
+type shapedConn struct {
+	net.Conn
+	shaper *Shaper
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if chunk := c.shaper.upload.capacity(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := c.Conn.Read(p)
+	c.shaper.Upload(n)
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := len(p)
+		if max := c.shaper.DownloadChunk(); chunk > max {
+			chunk = max
+		}
+		c.shaper.Download(chunk)
+		n, err := c.Conn.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
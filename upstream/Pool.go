@@ -0,0 +1,216 @@
+package upstream
+
+import (
+	"fmt"
+	"goproxy/config"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxFailures = 3
+	defaultCooldown    = 30 * time.Second
+)
+
+// Upstream targets of a config, with their health and load
+type Pool struct {
+	mutex       sync.Mutex
+	targets     []*target
+	balance     config.Balance
+	next        int // round robin position
+	maxFailures int
+	cooldown    time.Duration
+}
+
+type target struct {
+	address      string
+	active       int       // requests in flight
+	failures     int       // consecutive failures
+	ejectedUntil time.Time // passive health check
+}
+
+// Target chosen for one request.  Done() must be called when the exchange
+// is over.
+type Backend struct {
+	Address string
+	pool    *Pool
+	target  *target
+	once    sync.Once
+}
+
+// Pools of the configs of one proxy.  The zero value is ready to use.
+type Pools struct {
+	pools sync.Map // *Pool, key=targets and balance settings
+}
+
+// "host" or "host:port".  port is appended when host has none.
+func Address(host string, port int) string {
+	if port > 0 {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+		}
+	}
+	return host
+}
+
+// Pool for a config with Targets, or nil when it has a single Hostname.
+// Configs with the same targets and balance settings share a pool, so
+// target health survives config reloads.
+func (pools *Pools) For(proxyConfig *config.ProxyConfig) *Pool {
+	if len(proxyConfig.Targets) == 0 {
+		return nil
+	}
+	addresses := make([]string, len(proxyConfig.Targets))
+	for i, t := range proxyConfig.Targets {
+		addresses[i] = Address(t, proxyConfig.Port)
+	}
+	balance := config.Balance{Policy: config.RoundRobin}
+	if proxyConfig.Balance != nil {
+		balance = *proxyConfig.Balance
+	}
+	key := strings.Join(addresses, ",") + "|" + fmt.Sprintf("%+v", balance)
+	if pool, ok := pools.pools.Load(key); ok {
+		return pool.(*Pool)
+	}
+
+	pool := &Pool{balance: balance, maxFailures: defaultMaxFailures, cooldown: defaultCooldown}
+	if balance.MaxFailures > 0 {
+		pool.maxFailures = balance.MaxFailures
+	}
+	if balance.Cooldown > 0 {
+		pool.cooldown = time.Duration(balance.Cooldown) * time.Second
+	}
+	for _, address := range addresses {
+		pool.targets = append(pool.targets, &target{address: address})
+	}
+	actual, _ := pools.pools.LoadOrStore(key, pool)
+	return actual.(*Pool)
+}
+
+// Choose a target for the request, skipping those already tried.  Ejected
+// targets are only used when every target is ejected.  Returns nil when
+// every target has been tried.
+func (p *Pool) Pick(request *http.Request, tried map[string]bool) *Backend {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	candidates := make([]*target, 0, len(p.targets))
+	ejected := make([]*target, 0)
+	for _, t := range p.targets {
+		if tried[t.address] {
+			continue
+		}
+		if now.Before(t.ejectedUntil) {
+			ejected = append(ejected, t)
+		} else {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = ejected
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var chosen *target
+	switch p.balance.Policy {
+	case config.LeastConnections:
+		for _, t := range candidates {
+			if chosen == nil || t.active < chosen.active {
+				chosen = t
+			}
+		}
+	case config.Random:
+		chosen = candidates[rand.Intn(len(candidates))]
+	case config.Hash:
+		if key, ok := p.hashKey(request); ok {
+			chosen = rendezvous(candidates, key)
+		}
+	}
+	if chosen == nil {
+		// round robin, also used by hash when the request has no key
+		chosen = candidates[p.next%len(candidates)]
+		p.next++
+	}
+	chosen.active++
+	return &Backend{Address: chosen.address, pool: p, target: chosen}
+}
+
+func (p *Pool) hashKey(request *http.Request) (string, bool) {
+	if len(p.balance.HashHeader) > 0 {
+		if value := request.Header.Get(p.balance.HashHeader); len(value) > 0 {
+			return value, true
+		}
+	}
+	if len(p.balance.HashCookie) > 0 {
+		if cookie, err := request.Cookie(p.balance.HashCookie); err == nil {
+			return cookie.Value, true
+		}
+	}
+	return "", false
+}
+
+// Highest random weight hashing: a key keeps its target while that target
+// is healthy, and only the keys of an ejected target move.
+func rendezvous(candidates []*target, key string) *target {
+	var chosen *target
+	var best uint64
+	for _, t := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(t.address))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if weight := mix(h.Sum64()); chosen == nil || weight > best {
+			chosen, best = t, weight
+		}
+	}
+	return chosen
+}
+
+// FNV only carries differences toward the high bits, so addresses differing
+// in their last digit would always rank the same.  Mix all the bits.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Release the backend and record the outcome.  Errors and 502/503/504
+// responses count as failures.
+func (b *Backend) Done(failed bool) {
+	b.once.Do(func() {
+		p := b.pool
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		b.target.active--
+		if !failed {
+			b.target.failures = 0
+			return
+		}
+		b.target.failures++
+		if b.target.failures >= p.maxFailures {
+			log.Printf("Pool Done() %s ejected for %v after %d failures\n", b.target.address, p.cooldown, b.target.failures)
+			b.target.ejectedUntil = time.Now().Add(p.cooldown)
+			b.target.failures = 0
+		}
+	})
+}
+
+// Is the response status a backend failure?
+func IsFailureStatus(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
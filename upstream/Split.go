@@ -0,0 +1,97 @@
+package upstream
+
+import (
+	"goproxy/config"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+)
+
+// Cookie keeping a client on the variant it was given by a weight split
+const VariantCookie = "goproxy-variant"
+
+// Choose the variant serving a request.  sticky is true when the client
+// should be sent the VariantCookie to keep it on this variant.  The
+// request.RemoteAddr of a tunneled request must be that of the client that
+// opened the tunnel, else every https client hashes alike.
+func ChooseVariant(split *config.Split, request *http.Request) (variant *config.Variant, sticky bool) {
+	if len(split.Variants) == 0 {
+		return nil, false
+	}
+	switch split.By {
+	case config.SplitByHeader:
+		if value := request.Header.Get(split.Header); len(value) > 0 {
+			return byValue(split.Variants, value), false
+		}
+	case config.SplitByCookie:
+		if cookie, err := request.Cookie(split.Cookie); err == nil && len(cookie.Value) > 0 {
+			return byValue(split.Variants, cookie.Value), false
+		}
+	case config.SplitByWeight, "":
+		if cookie, err := request.Cookie(VariantCookie); err == nil {
+			for _, variant := range split.Variants {
+				if variant.Name == cookie.Value {
+					return variant, false
+				}
+			}
+		}
+		return byWeight(split.Variants, rand.Intn(totalWeight(split.Variants))), true
+	}
+	// Client IP split, and header and cookie splits without a value
+	return byHash(split.Variants, clientIp(request.RemoteAddr)), false
+}
+
+// The variant listing value, or else one chosen by hashing value
+func byValue(variants []*config.Variant, value string) *config.Variant {
+	for _, variant := range variants {
+		for _, v := range variant.Values {
+			if v == value {
+				return variant
+			}
+		}
+	}
+	return byHash(variants, value)
+}
+
+func byHash(variants []*config.Variant, key string) *config.Variant {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return byWeight(variants, int(mix(h.Sum64())%uint64(totalWeight(variants))))
+}
+
+// Weight of a variant.  When no variant has a weight they share equally.
+func weight(variants []*config.Variant, variant *config.Variant) int {
+	for _, v := range variants {
+		if v.Weight > 0 {
+			return variant.Weight
+		}
+	}
+	return 1
+}
+
+func totalWeight(variants []*config.Variant) int {
+	total := 0
+	for _, variant := range variants {
+		total += weight(variants, variant)
+	}
+	return total
+}
+
+// Variant owning position n of the total weight
+func byWeight(variants []*config.Variant, n int) *config.Variant {
+	for _, variant := range variants {
+		if n < weight(variants, variant) {
+			return variant
+		}
+		n -= weight(variants, variant)
+	}
+	return variants[len(variants)-1]
+}
+
+func clientIp(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
@@ -0,0 +1,185 @@
+package vcr
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Exchanges recorded to a file, played back in the order recorded
+type Cassette struct {
+	mutex        sync.Mutex
+	dir          string
+	name         string
+	interactions []*Interaction
+	played       map[string]int // key -> interactions played back
+	recording    bool           // the file has been started afresh by this library
+}
+
+type Interaction struct {
+	Key      string    `json:"key"`
+	Recorded string    `json:"recorded"` // RFC 3339
+	Request  *Exchange `json:"request"`
+	Response *Exchange `json:"response"`
+}
+
+// One side of an interaction.  Bodies are text, or base64 when BodyEncoding
+// is "base64".
+type Exchange struct {
+	Method       string      `json:"method,omitempty"`
+	Url          string      `json:"url,omitempty"`
+	Status       int         `json:"status,omitempty"`
+	Headers      http.Header `json:"headers"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+}
+
+type cassetteFile struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Cassettes of a directory, each loaded the first time it is used
+type Library struct {
+	dir       string
+	mutex     sync.Mutex
+	cassettes map[string]*Cassette // key=name
+}
+
+func NewLibrary(dir string) *Library {
+	return &Library{dir: dir, cassettes: make(map[string]*Cassette)}
+}
+
+// Cassette name, loaded from the library's dir the first time it is used
+func (l *Library) Load(name string) *Cassette {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if c, ok := l.cassettes[name]; ok {
+		return c
+	}
+	c := &Cassette{dir: l.dir, name: name, played: make(map[string]int)}
+	if data, err := os.ReadFile(c.path()); err == nil {
+		var file cassetteFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			log.Printf("Cassette Load() %s: %v\n", name, err)
+		}
+		c.interactions = validInteractions(name, file.Interactions)
+	} else if !os.IsNotExist(err) {
+		log.Printf("Cassette Load() %s: %v\n", name, err)
+	}
+	l.cassettes[name] = c
+	return c
+}
+
+// Interactions that can be played back.  Those with a response status that
+// could not be written, e.g. from a hand edited cassette, are dropped.
+func validInteractions(name string, interactions []*Interaction) []*Interaction {
+	valid := make([]*Interaction, 0, len(interactions))
+	for i, interaction := range interactions {
+		if interaction == nil {
+			continue
+		}
+		if response := interaction.Response; response != nil && (response.Status < 100 || response.Status > 599) {
+			log.Printf("Cassette Load() %s: interactions[%d] has invalid status %d\n", name, i, response.Status)
+			continue
+		}
+		valid = append(valid, interaction)
+	}
+	return valid
+}
+
+func (c *Cassette) path() string {
+	return filepath.Join(c.dir, c.name+".json")
+}
+
+func (c *Cassette) Name() string {
+	return c.name
+}
+
+// Next recorded response for key.  Responses recorded for the same key are
+// played back in order, and the last one is repeated.  Nil if there is none.
+func (c *Cassette) Play(key string) *Exchange {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var matching []*Interaction
+	for _, interaction := range c.interactions {
+		if interaction.Key == key && interaction.Response != nil {
+			matching = append(matching, interaction)
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+	i := c.played[key]
+	if i >= len(matching) {
+		i = len(matching) - 1
+	}
+	c.played[key] = i + 1
+	return matching[i].Response
+}
+
+// Add an exchange and save the cassette.  The first recording made by a
+// Library discards what the cassette held before.
+func (c *Cassette) Record(key string, request *Exchange, response *Exchange) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.recording {
+		c.interactions = nil
+		c.played = make(map[string]int)
+		c.recording = true
+	}
+	c.interactions = append(c.interactions, &Interaction{
+		Key:      key,
+		Recorded: time.Now().Format(time.RFC3339),
+		Request:  request,
+		Response: response,
+	})
+	c.save()
+}
+
+// Write a temporary file and rename it, so the cassette is never seen half
+// written
+func (c *Cassette) save() {
+	data, err := json.MarshalIndent(cassetteFile{Interactions: c.interactions}, "", "  ")
+	if err != nil {
+		log.Println("Cassette save()", err)
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		log.Println("Cassette save()", err)
+		return
+	}
+	path := c.path()
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Println("Cassette save()", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Println("Cassette save()", err)
+	}
+}
+
+func SetBody(exchange *Exchange, body []byte) {
+	if utf8.Valid(body) {
+		exchange.Body = string(body)
+		exchange.BodyEncoding = ""
+	} else {
+		exchange.Body = base64.StdEncoding.EncodeToString(body)
+		exchange.BodyEncoding = "base64"
+	}
+}
+
+func (exchange *Exchange) BodyBytes() []byte {
+	if exchange.BodyEncoding == "base64" {
+		if body, err := base64.StdEncoding.DecodeString(exchange.Body); err == nil {
+			return body
+		}
+	}
+	return []byte(exchange.Body)
+}
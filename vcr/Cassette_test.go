@@ -0,0 +1,32 @@
+package vcr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSkipsInvalidStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		played bool
+	}{
+		{"ok", `"status":200`, true},
+		{"missing status", `"status":0`, false},
+		{"below 100", `"status":99`, false},
+		{"above 599", `"status":600`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			data := `{"interactions":[null,{"key":"GET /","response":{` + test.status + `,"headers":{}}}]}`
+			if err := os.WriteFile(filepath.Join(dir, "c.json"), []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if played := NewLibrary(dir).Load("c").Play("GET /") != nil; played != test.played {
+				t.Errorf("Play() returned a response %v, want %v", played, test.played)
+			}
+		})
+	}
+}
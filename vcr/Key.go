@@ -0,0 +1,40 @@
+package vcr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"goproxy/config"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Request key: method and path, then the sorted query string, the selected
+// headers and a hash of the body, as configured
+func Key(key *config.VcrKey, request *http.Request, body []byte) string {
+	var b strings.Builder
+	b.WriteString(request.Method)
+	b.WriteString(" ")
+	b.WriteString(request.URL.Path)
+	if key == nil || !key.IgnoreQuery {
+		if query := request.URL.Query(); len(query) > 0 {
+			b.WriteString("?")
+			b.WriteString(query.Encode()) // sorted by name
+		}
+	}
+	if key == nil {
+		return b.String()
+	}
+	for _, name := range key.Headers {
+		b.WriteString(" ")
+		b.WriteString(strings.ToLower(name))
+		b.WriteString("=")
+		b.WriteString(url.QueryEscape(strings.Join(request.Header.Values(name), ",")))
+	}
+	if key.Body && len(body) > 0 {
+		sum := sha256.Sum256(body)
+		b.WriteString(" body=")
+		b.WriteString(hex.EncodeToString(sum[:8]))
+	}
+	return b.String()
+}